@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API keys look like mvk_<prefix>_<secret>: the prefix identifies the key, the whole key is hashed
+const (
+	apiKeyScheme       = "mvk_"
+	apiKeyPrefixLength = 8  // hex characters
+	apiKeySecretLength = 32 // random bytes, 64 hex characters
+)
+
+// value of the typ claim of the claims built for an API key
+const apiKeyTokenType = "api_key"
+
+// last_used_at is written at most this often per key, not on every request
+const apiKeyTouchInterval = time.Minute
+
+var (
+	ErrAPIKeyInvalid = errors.New("invalid api key")
+	ErrAPIKeyExpired = errors.New("api key is expired")
+	ErrAPIKeyRevoked = errors.New("api key has been revoked")
+	ErrAPIKeyCreator = errors.New("the user who created the api key was disabled or deleted")
+)
+
+// generate a new key, returning it with its prefix and hash
+func newAPIKey() (key string, prefix string, hash string, err error) {
+	b := make([]byte, apiKeyPrefixLength/2+apiKeySecretLength)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	prefix = hex.EncodeToString(b[:apiKeyPrefixLength/2])
+	key = apiKeyScheme + prefix + "_" + hex.EncodeToString(b[apiKeyPrefixLength/2:])
+	return key, prefix, hashToken(key), nil
+}
+
+// the prefix of a key, if it has the shape of one
+func apiKeyPrefix(key string) (string, bool) {
+	rest := strings.TrimPrefix(key, apiKeyScheme)
+	if rest == key || len(rest) != apiKeyPrefixLength+1+2*apiKeySecretLength || rest[apiKeyPrefixLength] != '_' {
+		return "", false
+	}
+	return rest[:apiKeyPrefixLength], true
+}
+
+// check the key of an X-API-Key header and return claims granting its scopes.
+// Actions made with the key are attributed to the user who created it, so the key stops working
+// with its creator, and only grants the scopes their role still has.
+func (app *application) apiKeyClaims(r *http.Request, key string) (*Claims, error) {
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	stored, err := app.DB.GetAPIKeyByPrefix(r.Context(), prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(stored.Hash)) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	now := time.Now()
+	if stored.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if stored.ExpiresAt != nil && now.After(*stored.ExpiresAt) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	// the creator is 0 once deleted, the foreign key is set to null
+	if stored.CreatedBy == 0 {
+		return nil, ErrAPIKeyCreator
+	}
+	creator, err := app.DB.GetUserByID(r.Context(), stored.CreatedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyCreator
+	}
+	if err != nil {
+		return nil, err
+	}
+	if creator.DisabledAt != nil {
+		return nil, ErrAPIKeyCreator
+	}
+
+	// read on every request, so taking a permission from a role takes it from the keys of its users too
+	granted, err := app.DB.RolePermissions(r.Context(), creator.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) > apiKeyTouchInterval {
+		err := app.DB.TouchAPIKey(r.Context(), stored.ID, now)
+		if err != nil {
+			log.Printf("api key %s: %v", stored.Prefix, err)
+		}
+	}
+
+	claims := &Claims{
+		TokenType:   apiKeyTokenType,
+		Name:        stored.Name,
+		Permissions: intersect(stored.Scopes, granted),
+	}
+	claims.Subject = fmt.Sprint(stored.CreatedBy)
+	return claims, nil
+}
+
+// the scopes also in granted, in the order of scopes
+func intersect(scopes []string, granted []string) []string {
+	allowed := make(map[string]bool, len(granted))
+	for _, p := range granted {
+		allowed[p] = true
+	}
+
+	kept := []string{}
+	for _, scope := range scopes {
+		if allowed[scope] {
+			kept = append(kept, scope)
+		}
+	}
+	return kept
+}
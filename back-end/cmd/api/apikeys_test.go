@@ -0,0 +1,69 @@
+package main
+
+import (
+	"backend/internal/models"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyFollowsCreator(t *testing.T) {
+	ta := newTestApp(t)
+	admin := ta.newTestUser(t, "keys@example.com", models.RoleAdmin)
+	token := ta.logIn(t, "keys@example.com")
+
+	rec := ta.request(t, http.MethodPost, "/admin/api-keys", map[string]interface{}{
+		"name":   "reports",
+		"scopes": []string{"movies:read", "users:read"},
+	}, bearer(token)...)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("creating the key: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var res struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	decode(t, rec, &res)
+	key := []string{"X-API-Key", res.Data.Key}
+
+	get := func(path string) int {
+		t.Helper()
+		return ta.request(t, http.MethodGet, path, nil, key...).Code
+	}
+
+	if code := get("/admin/users"); code != http.StatusOK {
+		t.Fatalf("users with the key of an admin: status %d", code)
+	}
+
+	// an editor can not read users, nor can their keys
+	err := ta.repo.SetUserRole(context.Background(), admin.ID, models.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin/users"); code != http.StatusForbidden {
+		t.Fatalf("users with the key of an editor: status %d", code)
+	}
+	if code := get("/admin/movies"); code != http.StatusOK {
+		t.Fatalf("movies with the key of an editor: status %d", code)
+	}
+
+	now := time.Now()
+	err = ta.repo.SetUserDisabled(context.Background(), admin.ID, &now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin/movies"); code != http.StatusUnauthorized {
+		t.Fatalf("movies with the key of a disabled user: status %d", code)
+	}
+
+	err = ta.repo.DeleteUser(context.Background(), admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin/movies"); code != http.StatusUnauthorized {
+		t.Fatalf("movies with the key of a deleted user: status %d", code)
+	}
+}
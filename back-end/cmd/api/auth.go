@@ -1,7 +1,10 @@
 package main
 
 import (
-	"errors"
+	"backend/internal/jwtkeys"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"strings"
@@ -15,8 +18,10 @@ type Auth struct {
 	Issuer        string
 	Audience      string
 	Secret        string
+	Keys          *jwtkeys.KeySet // when set, tokens are signed with these keys instead of Secret
 	TokenExpiry   time.Duration
 	RefreshExpiry time.Duration
+	ClockSkew     time.Duration // how far the clock of whoever issued a token may be ahead or behind ours
 	CookieDomain  string
 	CookiePath    string
 	CookieName    string
@@ -24,26 +29,72 @@ type Auth struct {
 
 // user object (who is requesting authentication)
 type jwtUser struct {
-	ID        int    `json:"id"`
-	Firstname string `json:"first_name"`
-	Lastname  string `json:"last_name"`
+	ID          int      `json:"id"`
+	Firstname   string   `json:"first_name"`
+	Lastname    string   `json:"last_name"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
 }
 
 // token object that contains 2 tokens (refresh and access)
 type TokenPairs struct {
 	Token        string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+
+	// what the server has to remember about the refresh token
+	RefreshTokenID     string    `json:"-"`
+	RefreshTokenExpiry time.Time `json:"-"`
 }
 
+// value of the typ claim of each kind of token, so one is never accepted as the other
+const (
+	accessTokenType      = "JWT"
+	refreshTokenType     = "refresh"
+	verifyEmailTokenType = "verify_email"
+	challengeTokenType   = "2fa_challenge"
+	magicLinkTokenType   = "magic_link"
+)
+
 // claims object
 type Claims struct {
+	TokenType   string   `json:"typ,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Email       string   `json:"email,omitempty"`       // tokens of links sent by email, see LinkToken
+	Permissions []string `json:"permissions,omitempty"` // granted by the role when the token was issued
 	jwt.RegisteredClaims
 }
 
+// HasPermission tells whether the token grants permission, such as "movies:delete"
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // method of Auth object to generate TokenPair
 func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
+	now := time.Now().UTC()
+
+	method, signingKey, kid, err := j.signingKey()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	// the jti of the access token is what the revocation list holds
+	accessJTI, err := newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
 	// Create a token
-	token := jwt.New(jwt.SigningMethodHS256)
+	token := jwt.New(method)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
 
 	// Set claims
 	// Assert token.Claims type as MapClaims
@@ -52,29 +103,46 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 	claims["sub"] = fmt.Sprint(user.ID)
 	claims["aud"] = j.Audience
 	claims["iss"] = j.Issuer
-	claims["iat"] = time.Now().UTC().Unix()
-	claims["typ"] = "JWT"
+	claims["iat"] = now.Unix()
+	claims["jti"] = accessJTI
+	claims["typ"] = accessTokenType
+	claims["role"] = user.Role
+	claims["permissions"] = user.Permissions
 
 	// Set the expiry for JWT
-	claims["exp"] = time.Now().UTC().Add(j.TokenExpiry).Unix()
+	claims["exp"] = now.Add(j.TokenExpiry).Unix()
 
 	// Create a signed token
-	signedAccessToken, err := token.SignedString([]byte(j.Secret))
+	signedAccessToken, err := token.SignedString(signingKey)
 	if err != nil {
 		return TokenPairs{}, err
 	}
 
+	// the jti identifies the refresh token in the refresh_tokens table
+	jti, err := newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	refreshExpiry := now.Add(j.RefreshExpiry)
+
 	// Create a refresh token and set claims
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
+	refreshToken := jwt.New(method)
+	if kid != "" {
+		refreshToken.Header["kid"] = kid
+	}
 	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
-	refreshTokenClaims["iat"] = time.Now().UTC().Unix()
+	refreshTokenClaims["aud"] = j.Audience
+	refreshTokenClaims["iss"] = j.Issuer
+	refreshTokenClaims["iat"] = now.Unix()
+	refreshTokenClaims["jti"] = jti
+	refreshTokenClaims["typ"] = refreshTokenType
 
 	// Set the expiry for the refresh token
-	refreshTokenClaims["exp"] = time.Now().UTC().Add(j.RefreshExpiry).Unix()
+	refreshTokenClaims["exp"] = refreshExpiry.Unix()
 
 	// Create signed refresh token
-	signedRefreshToken, err := token.SignedString([]byte(j.Secret))
+	signedRefreshToken, err := refreshToken.SignedString(signingKey)
 
 	if err != nil {
 		return TokenPairs{}, err
@@ -82,14 +150,102 @@ func (j *Auth) GenerateTokenPair(user *jwtUser) (TokenPairs, error) {
 
 	// Create TokenPairs and populate with signed tokens
 	var tokenPair = TokenPairs{
-		Token:        signedAccessToken,
-		RefreshToken: signedRefreshToken,
+		Token:              signedAccessToken,
+		RefreshToken:       signedRefreshToken,
+		RefreshTokenID:     jti,
+		RefreshTokenExpiry: refreshExpiry,
 	}
 
 	// Return TokenPairs
 	return tokenPair, nil
 }
 
+// LinkToken signs a token of tokenType to put in a link sent to email, valid for ttl.
+// The email is part of the token, so a link stops working once the user changes it.
+// It has a jti, so it can be revoked like an access token once used.
+func (j *Auth) LinkToken(tokenType string, userID int, email string, ttl time.Duration) (string, error) {
+	method, signingKey, kid, err := j.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+
+	token := jwt.NewWithClaims(method, Claims{
+		TokenType: tokenType,
+		Email:     email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   fmt.Sprint(userID),
+			Audience:  jwt.ClaimStrings{j.Audience},
+			Issuer:    j.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	return token.SignedString(signingKey)
+}
+
+// the method and key new tokens are signed with, and the kid to put in their header
+func (j *Auth) signingKey() (jwt.SigningMethod, interface{}, string, error) {
+	if j.Keys == nil {
+		return jwt.SigningMethodHS256, []byte(j.Secret), "", nil
+	}
+
+	key, err := j.Keys.Signing()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return key.Method(), key.Private, key.ID, nil
+}
+
+// find the key a token has to be verified with.
+// Only the algorithm of that key is accepted, so a token can not pick a weaker one (alg confusion).
+func (j *Auth) keyFunc(token *jwt.Token) (interface{}, error) {
+	if j.Keys == nil {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("%w: %v", ErrTokenAlgorithm, token.Header["alg"])
+		}
+		return []byte(j.Secret), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := j.Keys.Verifying(kid)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrTokenKey, kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("%w: %v", ErrTokenAlgorithm, token.Header["alg"])
+	}
+	return key.Public(), nil
+}
+
+// hash of a random token kept in the database instead of the token, such as an API key.
+// Tokens are long random strings, a fast hash is enough for nobody to recover them.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// random identifier for the jti claim
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // return a pointer to a http Cookie
 func (j *Auth) GetRefreshCookie(refreshToken string) *http.Cookie {
 	return &http.Cookie{
@@ -120,6 +276,7 @@ func (j *Auth) GetExpiredRefreshCookie() *http.Cookie {
 	}
 }
 
+// GetTokenFromHeaderAndVerify reads the bearer token of the Authorization header and verifies it is an access token
 func (j *Auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Request) (string, *Claims, error) {
 	w.Header().Add("Vary", "Authorization")
 
@@ -127,49 +284,22 @@ func (j *Auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Reques
 	authHeader := r.Header.Get("Authorization")
 
 	// sanity check whether authHeader exists
-
 	if authHeader == "" {
-		return "", nil, errors.New("no auth header")
+		return "", nil, ErrTokenMissing
 	}
 
-	// split the header on spaces
+	// auth headers have exactly 2 parts, the scheme being case insensitive
 	headerParts := strings.Split(authHeader, " ")
-
-	// auth headers have exactly 2 parts
-	if len(headerParts) != 2 {
-		return "", nil, errors.New("invalid auth header")
-	}
-
-	// check to see if we ahve the word Bearer
-	if headerParts[0] != "Bearer" {
-		return "", nil, errors.New("invalid auth header")
+	if len(headerParts) != 2 || !strings.EqualFold(headerParts[0], "Bearer") {
+		return "", nil, ErrAuthHeader
 	}
 
 	token := headerParts[1]
 
-	// declare an empty claims
-	claims := &Claims{}
-
-	//parse the token
-	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(j.Secret), nil
-	})
-
+	claims, err := j.VerifyToken(token, accessTokenType)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "token is expired by") {
-			return "", nil, errors.New("expired token")
-		}
 		return "", nil, err
 	}
 
-	// check if this token is issued by us
-	if claims.Issuer != j.Issuer {
-		return "", nil, errors.New("invalid issuer")
-	}
-
 	return token, claims, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"backend/internal/repository/dbrepo"
 	"database/sql"
 	"log"
 
@@ -45,3 +46,19 @@ func (app *application) connectToDB() (*sql.DB, error) {
 	log.Println("Connected to Postgres!")
 	return connection, nil
 }
+
+// create the in-memory repository, seeded from app.Fixture if one is given
+func (app *application) connectToMemoryDB() (*dbrepo.MemoryDBRepo, error) {
+	repo := dbrepo.NewMemoryDBRepo()
+
+	if app.Fixture != "" {
+		err := repo.LoadFixture(app.Fixture)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Seeded memory database from", app.Fixture)
+	}
+
+	log.Println("Using in-memory database!")
+	return repo, nil
+}
@@ -2,7 +2,16 @@ package main
 
 import (
 	"backend/internal/graph"
+	"backend/internal/jwtkeys"
+	"backend/internal/mailer"
 	"backend/internal/models"
+	"backend/internal/oidc"
+	"backend/internal/repository"
+	"backend/internal/totp"
+	"backend/internal/webauthn"
+	"context"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,10 +20,10 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
@@ -33,13 +42,45 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) AllMovies(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovies()
+	app.listMovies(w, r)
+}
+
+// write one page of movies, with the paging metadata, according to the query parameters
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request) {
+	opts, err := app.readMovieListOptions(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeMovieList(w, r, opts)
+}
+
+// write the page of movies of opts, with the paging metadata
+func (app *application) writeMovieList(w http.ResponseWriter, r *http.Request, opts repository.MovieListOptions) {
+	list, err := app.DB.ListMovies(r.Context(), opts)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movies)
+	meta := PageMeta{
+		Total:      list.Total,
+		Limit:      opts.Limit,
+		NextCursor: list.NextCursor,
+		PrevCursor: list.PrevCursor,
+	}
+	if opts.Cursor == "" {
+		meta.Page = opts.Page
+	}
+
+	resp := JSONResponse{
+		Error: false,
+		Data:  list.Movies,
+		Meta:  meta,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, resp)
 }
 
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
@@ -55,29 +96,94 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// an email or an address that failed too often waits, whether the email has an account or not
+	ip := clientIP(r)
+	if app.loginThrottled(w, r, requestPayload.Email, ip) {
+		return
+	}
+
 	// validate user in the database
-	user, err := app.DB.GetUserByEmail(requestPayload.Email)
-	if err != nil {
-		app.errorJSON(w, errors.New("invalid credentials"))
+	user, err := app.DB.GetUserByEmail(r.Context(), requestPayload.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err)
 		return
 	}
 
-	// check password
-	valid, err := user.PasswordMatches(requestPayload.Password)
-	if err != nil || !valid {
+	// check password. Unknown emails and users without a password, who log in with single sign-on,
+	// take as long as a wrong password and get the same answer
+	valid := false
+	if err == nil && user.Password != "" {
+		valid, err = user.PasswordMatches(requestPayload.Password)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	} else {
+		models.PasswordMatchesNobody(requestPayload.Password)
+	}
+
+	if !valid {
+		err = app.recordLoginFailure(r.Context(), requestPayload.Email, ip)
+		if err != nil {
+			log.Printf("failed login of %s from %s: %v", requestPayload.Email, ip, err)
+		}
 		app.errorJSON(w, errors.New("invalid credentials"))
 		return
 	}
 
-	// create a JWT user
-	u := jwtUser{
-		ID:        user.ID,
-		Firstname: user.FirstName,
-		Lastname:  user.Lastname,
+	// the password is right, the email starts again with no failed login. With two-factor authentication
+	// the code has to be right too, or a password known would reset the failures of the codes guessed.
+	if user.TOTPEnabledAt == nil {
+		err = app.DB.ClearLoginFailures(r.Context(), models.LoginThrottleAccount, loginAccountKey(requestPayload.Email))
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
 	}
 
-	// generate tokens
-	tokens, err := app.auth.GenerateTokenPair(&u)
+	if user.DisabledAt != nil {
+		app.errorJSON(w, errors.New("account is disabled"), http.StatusForbidden)
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		app.errorJSON(w, errors.New("email address is not verified, follow the link sent to it"), http.StatusForbidden)
+		return
+	}
+
+	app.logInWithTwoFactor(w, r, user)
+}
+
+// issue the tokens of a user who proved who they are with one factor, a password or an email,
+// unless they enabled two-factor authentication: then it only earns a challenge, to exchange with a code at /auth/2fa
+func (app *application) logInWithTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.TOTPEnabledAt == nil {
+		app.logIn(w, r, user)
+		return
+	}
+
+	challenge, err := app.twoFactorChallenge(user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+	}{true, challenge}
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// the challenge of a user who proved one factor, to exchange with a code at /auth/2fa
+func (app *application) twoFactorChallenge(user *models.User) (string, error) {
+	return app.auth.LinkToken(challengeTokenType, user.ID, user.Email, challengeExpiry)
+}
+
+// issue the tokens of a user who proved who they are, and set the refresh cookie
+func (app *application) logIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	tokens, err := app.newSession(r.Context(), user)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -89,124 +195,2305 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusAccepted, tokens)
 }
 
-func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
-	for _, cookie := range r.Cookies() {
-		if cookie.Name == app.auth.CookieName {
-			claims := &Claims{}
-			refreshToken := cookie.Value
+// generate and store the tokens of a new session of user
+func (app *application) newSession(ctx context.Context, user *models.User) (TokenPairs, error) {
+	// create a JWT user
+	u, err := app.newJWTUser(ctx, user)
+	if err != nil {
+		return TokenPairs{}, err
+	}
 
-			// parse the token to get the claims
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(t *jwt.Token) (interface{}, error) {
-				return []byte(app.JWTSecret), nil
-			})
+	// generate tokens
+	tokens, err := app.auth.GenerateTokenPair(u)
+	if err != nil {
+		return TokenPairs{}, err
+	}
 
-			if err != nil {
-				app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
-				return
-			}
+	// a login starts a new family of refresh tokens
+	err = app.storeRefreshToken(ctx, app.DB, user.ID, tokens, "")
+	if err != nil {
+		return TokenPairs{}, err
+	}
 
-			// get the user id from the token claims
-			userID, err := strconv.Atoi(claims.Subject)
+	return tokens, nil
+}
 
-			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
-				return
-			}
+// second step of a login with two-factor authentication: the challenge of /auth and a code
+// of the authenticator app, or a recovery code. A challenge is good for one attempt only,
+// and a wrong code counts as a failed login of the email and the client address.
+func (app *application) twoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
 
-			user, err := app.DB.GetUserByID(userID)
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
-				return
-			}
+	invalid := errors.New("invalid or expired challenge, log in again")
 
-			u := jwtUser{
-				ID:        user.ID,
-				Firstname: user.FirstName,
-				Lastname:  user.Lastname,
-			}
+	claims, err := app.auth.VerifyToken(payload.ChallengeToken, challengeTokenType)
+	if err != nil || app.revoked.Revoked(claims) {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	// checked before the challenge is used up, a client told to wait can still use it once the wait is over
+	ip := clientIP(r)
+	if app.loginThrottled(w, r, claims.Email, ip) {
+		return
+	}
+
+	id, _ := strconv.Atoi(claims.Subject)
+
+	user, err := app.DB.GetUserByID(r.Context(), id)
+	if err != nil || !strings.EqualFold(user.Email, claims.Email) || user.DisabledAt != nil || user.TOTPEnabledAt == nil {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	// the challenge is used up whatever the code, guessing one takes a password for each try.
+	// Of the requests sending the same challenge at once, only one gets past this.
+	err = app.consumeToken(r.Context(), claims.ID, claims.ExpiresAt.Time)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, invalid)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, err = app.useTwoFactorCode(r, app.DB, user, payload.Code)
+	if errors.Is(err, ErrTwoFactorCode) {
+		err = app.recordLoginFailure(r.Context(), claims.Email, ip)
+		if err != nil {
+			log.Printf("failed two-factor login of %s from %s: %v", claims.Email, ip, err)
+		}
+		app.errorJSON(w, errors.New("invalid code, log in again"))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// both factors are right, the email starts again with no failed login
+	err = app.DB.ClearLoginFailures(r.Context(), models.LoginThrottleAccount, loginAccountKey(claims.Email))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.logIn(w, r, user)
+}
+
+// start enabling two-factor authentication: a new secret to add to an authenticator app,
+// required at login once a code of it is confirmed at /auth/2fa/confirm
+func (app *application) setupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.SetTOTPSecret(r.Context(), user.ID, secret)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "add the account to your authenticator app, then confirm a code",
+		Data: map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(secret, siteName, user.Email),
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// finish enabling two-factor authentication with a code of the authenticator app.
+// The recovery codes are in the response, they are not shown again.
+func (app *application) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		app.errorJSON(w, errors.New("start with /auth/2fa/setup"))
+		return
+	}
+
+	// only a code of the app proves it was set up, there are no recovery codes yet
+	if len(normalizeCode(payload.Code)) != totp.Digits {
+		app.errorJSON(w, ErrTwoFactorCode)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		_, err := app.useTwoFactorCode(r, repo, user, payload.Code)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		err = repo.EnableTOTP(r.Context(), user.ID, now, hashes)
+		if err != nil {
+			return err
+		}
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventTwoFactorEnabled,
+			IP:        clientIP(r),
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication enabled, keep the recovery codes somewhere safe",
+		Data: map[string][]string{
+			"recovery_codes": codes,
+		},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// stop requiring two-factor authentication, with a code of the authenticator app or a recovery code.
+// Wrong codes are throttled like those of a login, or a stolen access token could guess its way to turning it off.
+func (app *application) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		app.errorJSON(w, errors.New("two-factor authentication is not enabled"))
+		return
+	}
+
+	ip := clientIP(r)
+	if app.loginThrottled(w, r, user.Email, ip) {
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		_, err := app.useTwoFactorCode(r, repo, user, payload.Code)
+		if err != nil {
+			return err
+		}
+
+		return app.disableTOTP(r, repo, user.ID)
+	})
+	if errors.Is(err, ErrTwoFactorCode) {
+		err = app.recordLoginFailure(r.Context(), user.Email, ip)
+		if err != nil {
+			log.Printf("failed two-factor code of %s from %s: %v", user.Email, ip, err)
+		}
+		app.errorJSON(w, ErrTwoFactorCode)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication disabled",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// start registering a passkey for the user logged in: the options to pass to navigator.credentials.create
+func (app *application) beginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	creds, err := app.DB.UserWebAuthnCredentials(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// the authenticator refuses to register a second passkey of the user
+	var exclude [][]byte
+	for _, cred := range creds {
+		id, err := webauthn.Encoding.DecodeString(cred.CredentialID)
+		if err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	challenge, err := app.newWebAuthnChallenge(r.Context(), models.WebAuthnRegistration, user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	options := app.relyingParty.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          webauthn.Encoding.EncodeToString(webauthnUserHandle(user.ID)),
+		Name:        user.Email,
+		DisplayName: strings.TrimSpace(user.FirstName + " " + user.Lastname),
+	}, exclude)
+
+	app.writeJSON(w, http.StatusAccepted, JSONResponse{Error: false, Data: options})
+}
+
+// finish registering a passkey with what navigator.credentials.create returned
+func (app *application) finishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name       string                       `json:"name"`
+		Credential webauthn.AttestationResponse `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	name, err := repository.ValidCredentialName(payload.Name)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	challenge, err := payload.Credential.Challenge()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	started, err := app.DB.UseWebAuthnChallenge(r.Context(), challenge, models.WebAuthnRegistration, now)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && started.UserID != user.ID {
+		app.errorJSON(w, errors.New("the passkey prompt has expired, try again"))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	cred, err := app.relyingParty.FinishRegistration(&payload.Credential, challenge)
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("passkey not registered: %w", err))
+		return
+	}
+
+	stored := models.WebAuthnCredential{
+		UserID:       user.ID,
+		CredentialID: webauthn.Encoding.EncodeToString(cred.ID),
+		PublicKey:    cred.PublicKey,
+		SignCount:    int64(cred.SignCount),
+		Name:         name,
+		CreatedAt:    now,
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		id, err := repo.InsertWebAuthnCredential(r.Context(), stored)
+		if err != nil {
+			return err
+		}
+		stored.ID = id
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventPasskeyAdded,
+			IP:        clientIP(r),
+			CreatedAt: now,
+		})
+	})
+	if errors.Is(err, repository.ErrDuplicateCredential) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "passkey registered",
+		Data:    stored,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// the passkeys of the user logged in
+func (app *application) webAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	creds, err := app.DB.UserWebAuthnCredentials(r.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: creds})
+}
+
+// delete a passkey of the user logged in
+func (app *application) deleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.sessionUser(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteWebAuthnCredential(r.Context(), user.ID, id)
+		if err != nil {
+			return err
+		}
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventPasskeyRemoved,
+			IP:        clientIP(r),
+			CreatedAt: time.Now(),
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("passkey not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "passkey deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// start a login with a passkey: the options to pass to navigator.credentials.get.
+// The user picks one of their passkeys, so nothing is asked here.
+func (app *application) beginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := app.newWebAuthnChallenge(r.Context(), models.WebAuthnLogin, 0)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	options := app.relyingParty.RequestOptions(challenge, nil)
+
+	app.writeJSON(w, http.StatusAccepted, JSONResponse{Error: false, Data: options})
+}
+
+// finish a login with what navigator.credentials.get returned, issuing the tokens like /auth
+func (app *application) finishWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	var payload webauthn.AssertionResponse
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	challenge, err := payload.Challenge()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	_, err = app.DB.UseWebAuthnChallenge(r.Context(), challenge, models.WebAuthnLogin, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("the passkey prompt has expired, try again"))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	invalid := errors.New("invalid passkey")
+
+	id, err := payload.CredentialID()
+	if err != nil {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	stored, err := app.DB.GetWebAuthnCredential(r.Context(), webauthn.Encoding.EncodeToString(id))
+	if err != nil {
+		// deleted, or never registered here
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	handle, err := payload.UserHandle()
+	if err != nil || handle != nil && string(handle) != string(webauthnUserHandle(stored.UserID)) {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	signCount, err := app.relyingParty.FinishLogin(&payload, challenge, &webauthn.Credential{
+		ID:        id,
+		PublicKey: stored.PublicKey,
+		SignCount: uint32(stored.SignCount),
+	})
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("%s: %w", invalid, err))
+		return
+	}
+
+	user, err := app.DB.GetUserByID(r.Context(), stored.UserID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if user.DisabledAt != nil {
+		app.errorJSON(w, errors.New("account is disabled"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.UseWebAuthnCredential(r.Context(), stored.ID, int64(signCount), now)
+	if errors.Is(err, sql.ErrNoRows) {
+		// another login with the same signature got there first
+		app.errorJSON(w, fmt.Errorf("%s: %w", invalid, webauthn.ErrSignCount))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// the authenticator verified the user, a passkey is two factors on its own
+	app.logIn(w, r, user)
+}
+
+// store the challenge of a ceremony starting now
+func (app *application) newWebAuthnChallenge(ctx context.Context, ceremony string, userID int) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	err = app.DB.InsertWebAuthnChallenge(ctx, models.WebAuthnChallenge{
+		Challenge: challenge,
+		Ceremony:  ceremony,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(webauthnTimeout),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// forget the secret and recovery codes of a user and record it
+func (app *application) disableTOTP(r *http.Request, repo repository.DatabaseRepo, userID int) error {
+	err := repo.DisableTOTP(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+		UserID:    userID,
+		Event:     models.AuthEventTwoFactorDisabled,
+		IP:        clientIP(r),
+		CreatedAt: time.Now(),
+	})
+}
+
+// the user to put in a JWT, with the permissions of their role
+func (app *application) newJWTUser(ctx context.Context, user *models.User) (*jwtUser, error) {
+	permissions, err := app.DB.RolePermissions(ctx, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtUser{
+		ID:          user.ID,
+		Firstname:   user.FirstName,
+		Lastname:    user.Lastname,
+		Role:        user.Role,
+		Permissions: permissions,
+	}, nil
+}
+
+// public keys to verify our tokens with, empty while tokens are signed with the shared secret
+func (app *application) JWKS(w http.ResponseWriter, r *http.Request) {
+	set := jwtkeys.JWKS{Keys: []jwtkeys.JWK{}}
+	if app.auth.Keys != nil {
+		set = app.auth.Keys.JWKS()
+	}
+
+	// clients may cache the keys a little, rotated keys are published before they sign anything
+	headers := http.Header{"Cache-Control": {"public, max-age=300"}}
+
+	app.writeJSON(w, http.StatusOK, set, headers)
+}
+
+// remember the refresh token of tokens so it can be rotated and revoked.
+// An empty familyID starts a new family, named after this first token.
+func (app *application) storeRefreshToken(ctx context.Context, repo repository.DatabaseRepo, userID int, tokens TokenPairs, familyID string) error {
+	if familyID == "" {
+		familyID = tokens.RefreshTokenID
+	}
+
+	return repo.InsertRefreshToken(ctx, models.RefreshToken{
+		ID:        tokens.RefreshTokenID,
+		FamilyID:  familyID,
+		UserID:    userID,
+		IssuedAt:  time.Now(),
+		ExpiresAt: tokens.RefreshTokenExpiry,
+	})
+}
+
+// exchange the refresh token cookie for a new token pair.
+// Every refresh token works once: it is replaced by the one sent back, and presenting it
+// a second time means it was stolen, so every token of its family is revoked.
+func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(app.auth.CookieName)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := app.auth.VerifyToken(cookie.Value, refreshTokenType)
+	if err != nil {
+		app.errorJSON(w, tokenReason(err), http.StatusUnauthorized)
+		return
+	}
+
+	stored, err := app.DB.GetRefreshToken(r.Context(), claims.ID)
+	if err != nil || stored.RevokedAt != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	if stored.UsedAt != nil {
+		app.refreshTokenReused(w, r, stored)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(r.Context(), stored.UserID)
+	if err != nil || user.DisabledAt != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+
+	// permissions are read again, so a role change applies at the next refresh
+	u, err := app.newJWTUser(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	tokenPairs, err := app.auth.GenerateTokenPair(u)
+	if err != nil {
+		app.errorJSON(w, errors.New("error generating tokens"), http.StatusUnauthorized)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.UseRefreshToken(r.Context(), stored.ID, tokenPairs.RefreshTokenID, time.Now())
+		if err != nil {
+			return err
+		}
+		return app.storeRefreshToken(r.Context(), repo, user.ID, tokenPairs, stored.FamilyID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// another request used the same token in the meantime
+		app.refreshTokenReused(w, r, stored)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	http.SetCookie(w, app.auth.GetRefreshCookie(tokenPairs.RefreshToken))
+
+	app.writeJSON(w, http.StatusOK, tokenPairs)
+}
+
+// a refresh token was presented after it had been exchanged: revoke its whole family
+func (app *application) refreshTokenReused(w http.ResponseWriter, r *http.Request, token *models.RefreshToken) {
+	revoked, err := app.DB.RevokeRefreshTokenFamily(r.Context(), token.FamilyID, time.Now())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	log.Printf("refresh token %s of user %d reused, %d tokens of family %s revoked", token.ID, token.UserID, revoked, token.FamilyID)
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+}
+
+// end the session of the refresh token cookie: every token of its family is revoked,
+// and so is the access token sent in the Authorization header, if any
+func (app *application) logout(w http.ResponseWriter, r *http.Request) {
+	_, claims, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+	if err == nil && claims.ID != "" {
+		revoke, err := app.revokeAccessToken(r.Context(), app.DB, claims.ID, claims.ExpiresAt.Time)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		revoke()
+	}
+
+	cookie, err := r.Cookie(app.auth.CookieName)
+	if err == nil {
+		claims, err := app.auth.VerifyToken(cookie.Value, refreshTokenType)
+		if err == nil {
+			stored, err := app.DB.GetRefreshToken(r.Context(), claims.ID)
+			if err == nil {
+				_, err = app.DB.RevokeRefreshTokenFamily(r.Context(), stored.FamilyID, time.Now())
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				app.errorJSON(w, err)
+				return
+			}
+		}
+	}
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// how long the link sent to verify an email address works
+const verifyEmailExpiry = 24 * time.Hour
+
+// sign up: create a viewer account, usable once the link sent to its email has been followed
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	now := time.Now()
+	user := models.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		Lastname:  strings.TrimSpace(payload.LastName),
+		Role:      models.RoleViewer,
+		CreatedAt: now,
+		UpdateAt:  now,
+	}
+
+	if user.FirstName == "" || user.Lastname == "" {
+		app.errorJSON(w, errors.New("first and last name are required"))
+		return
+	}
+
+	user.Email, err = repository.ValidEmail(payload.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = repository.ValidPassword(payload.Password, user.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user.ID, err = app.DB.InsertUser(r.Context(), user)
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// the account exists whatever happens to the email, the link can be sent again
+	err = app.sendVerificationEmail(r.Context(), &user)
+	if err != nil {
+		log.Printf("verification email to user %d: %v", user.ID, err)
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "account created, follow the link sent to your email address to verify it",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// email a user the link to verify their address
+func (app *application) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, err := app.auth.LinkToken(verifyEmailTokenType, user.ID, user.Email, verifyEmailExpiry)
+	if err != nil {
+		return err
+	}
+
+	link := app.PublicURL + "/auth/verify-email?token=" + url.QueryEscape(token)
+
+	return app.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nFollow this link within %d hours to verify your email address and start using your account:\n\n%s\n\n"+
+			"If you did not sign up, ignore this email.\n", user.FirstName, int(verifyEmailExpiry.Hours()), link),
+	})
+}
+
+// the link of the verification email
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := app.auth.VerifyToken(r.URL.Query().Get("token"), verifyEmailTokenType)
+	if errors.Is(err, ErrTokenExpired) {
+		app.errorJSON(w, errors.New("the link has expired, ask for a new one"))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid link"))
+		return
+	}
+
+	id, _ := strconv.Atoi(claims.Subject)
+
+	user, err := app.DB.GetUserByID(r.Context(), id)
+	if err != nil || !strings.EqualFold(user.Email, claims.Email) {
+		// deleted since, or the link was sent to an address the user does not have anymore
+		app.errorJSON(w, errors.New("invalid link"))
+		return
+	}
+
+	err = app.DB.SetEmailVerified(r.Context(), user.ID, time.Now())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "email address verified, you can log in",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// send the verification link again. The answer is the same whether the email is known or not.
+func (app *application) resendVerification(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), strings.TrimSpace(payload.Email))
+	if err == nil && user.EmailVerifiedAt == nil && user.DisabledAt == nil {
+		err = app.sendVerificationEmail(r.Context(), user)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("verification email to %s: %v", payload.Email, err)
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "if an account waits for verification at this address, a new link has been sent to it",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// how long the link sent to reset a password works
+const passwordResetExpiry = time.Hour
+
+// email a link to choose a new password. The answer is the same whether the email is known or not,
+// and the email is sent in the background so the response time does not tell either.
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), strings.TrimSpace(payload.Email))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// accounts created by single sign-on have no password to reset
+	if err == nil && user.DisabledAt == nil && user.Password != "" {
+		ip := clientIP(r)
+		go func() {
+			err := app.sendPasswordReset(context.Background(), user, ip)
+			if err != nil {
+				log.Printf("password reset of user %d: %v", user.ID, err)
+			}
+		}()
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "if an account exists for this address, a link to reset its password has been sent to it",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// store a new reset token for user and email it
+func (app *application) sendPasswordReset(ctx context.Context, user *models.User, ip string) error {
+	token, err := newTokenID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		err := repo.InsertPasswordReset(ctx, models.PasswordReset{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			CreatedAt: now,
+			ExpiresAt: now.Add(passwordResetExpiry),
+		})
+		if err != nil {
+			return err
+		}
+
+		return repo.InsertAuthEvent(ctx, models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventPasswordResetRequested,
+			IP:        ip,
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	link := app.FrontendURL + "/reset-password?token=" + url.QueryEscape(token)
+
+	return app.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nFollow this link within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If you did not ask for it, ignore this email: your password has not changed.\n", user.FirstName, int(passwordResetExpiry.Minutes()), link),
+	})
+}
+
+// set a new password with the token of a reset link. Every session of the user ends.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	invalid := errors.New("the link is invalid or has expired, ask for a new one")
+
+	now := time.Now()
+	reset, err := app.DB.GetPasswordReset(r.Context(), hashToken(payload.Token))
+	if err != nil || reset.UsedAt != nil || !reset.ExpiresAt.After(now) {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(r.Context(), reset.UserID)
+	if err != nil || user.DisabledAt != nil {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	// checked before the token is used, so a weak password does not cost the user their link
+	err = repository.ValidPassword(payload.Password, user.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var revoke func()
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.UsePasswordReset(r.Context(), reset.TokenHash, now)
+		if err != nil {
+			return err
+		}
+
+		err = repo.SetUserPassword(r.Context(), user.ID, user.Password, now)
+		if err != nil {
+			return err
+		}
+
+		// the link proves the user reads the emails sent to the address
+		err = repo.SetEmailVerified(r.Context(), user.ID, now)
+		if err != nil {
+			return err
+		}
+
+		// whoever knew the old password is logged out
+		_, err = repo.RevokeUserRefreshTokens(r.Context(), user.ID, now)
+		if err != nil {
+			return err
+		}
+		revoke, err = app.revokeUserAccessTokens(r.Context(), repo, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventPasswordReset,
+			IP:        clientIP(r),
+			CreatedAt: now,
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// used by another request in the meantime
+		app.errorJSON(w, invalid)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revoke()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "password changed, you can log in with it",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// how long a login link works, and how many an address can ask for per magicLinkWindow
+const (
+	magicLinkExpiry = 15 * time.Minute
+	magicLinkLimit  = 3
+	magicLinkWindow = time.Hour
+)
+
+// email a link to log in without a password. The answer is the same whether the email is known or not,
+// and so is the rate limit, counted per address.
+func (app *application) magicLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	email := strings.TrimSpace(payload.Email)
+	if email == "" {
+		app.errorJSON(w, errors.New("email is required"))
+		return
+	}
+
+	now := time.Now()
+	count, err := app.DB.CountMagicLinks(r.Context(), email, now.Add(-magicLinkWindow))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if count >= magicLinkLimit {
+		app.errorJSON(w, errors.New("too many login links asked for this address, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err)
+		return
+	}
+
+	link := models.MagicLink{
+		Email:     email,
+		IP:        clientIP(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(magicLinkExpiry),
+	}
+
+	// only an address with an account gets a link, the request counts anyway
+	var token string
+	if err == nil && user.DisabledAt == nil {
+		token, err = app.auth.LinkToken(magicLinkTokenType, user.ID, user.Email, magicLinkExpiry)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		link.UserID, link.TokenHash = user.ID, hashToken(token)
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.InsertMagicLink(r.Context(), link)
+		if err != nil || link.UserID == 0 {
+			return err
+		}
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventMagicLinkRequested,
+			IP:        link.IP,
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if token != "" {
+		go func() {
+			err := app.sendMagicLink(context.Background(), user, token)
+			if err != nil {
+				log.Printf("login link of user %d: %v", user.ID, err)
+			}
+		}()
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "if an account exists for this address, a link to log in has been sent to it",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// email user the login link of token, to the /magic-link page of the front-end
+func (app *application) sendMagicLink(ctx context.Context, user *models.User, token string) error {
+	link := app.FrontendURL + "/magic-link?token=" + url.QueryEscape(token)
+
+	return app.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hello %s,\n\nFollow this link within %d minutes to log in:\n\n%s\n\n"+
+			"It works once. If you did not ask for it, ignore this email.\n", user.FirstName, int(magicLinkExpiry.Minutes()), link),
+	})
+}
+
+// log in with the token of a login link, issuing the tokens like /auth
+func (app *application) verifyMagicLink(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	invalid := errors.New("the link is invalid or has expired, ask for a new one")
+
+	claims, err := app.auth.VerifyToken(token, magicLinkTokenType)
+	if err != nil {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	now := time.Now()
+	link, err := app.DB.UseMagicLink(r.Context(), hashToken(token), now)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, invalid)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(r.Context(), link.UserID)
+	if err != nil || claims.Subject != fmt.Sprint(user.ID) || !strings.EqualFold(user.Email, claims.Email) {
+		// the link was sent to an address the user does not have anymore
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	if user.DisabledAt != nil {
+		app.errorJSON(w, errors.New("account is disabled"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		// the link proves the user reads the emails sent to the address
+		if user.EmailVerifiedAt == nil {
+			err := repo.SetEmailVerified(r.Context(), user.ID, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+			UserID:    user.ID,
+			Event:     models.AuthEventMagicLinkUsed,
+			IP:        clientIP(r),
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.logInWithTwoFactor(w, r, user)
+}
+
+// start a login with the OpenID Connect provider: remember the state, nonce and PKCE verifier
+// of the login, and send the browser to the provider
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.errorJSON(w, errOIDCDisabled, http.StatusNotFound)
+		return
+	}
+
+	var login models.OIDCLogin
+	for _, value := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		random, err := oidc.Random()
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		*value = random
+	}
+	login.ExpiresAt = time.Now().Add(oidcLoginExpiry)
+
+	err := app.DB.InsertOIDCLogin(r.Context(), login)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	http.SetCookie(w, oidcCookie(login.State, int(oidcLoginExpiry.Seconds())))
+	http.Redirect(w, r, app.oidc.AuthCodeURL(login.State, login.Nonce, login.CodeVerifier), http.StatusFound)
+}
+
+// where the provider sends the browser back with a code: trade it for the ID token, find or create the
+// user of the account, and go to the front-end with the refresh cookie set, where the page refreshes
+// into a session. The provider is one factor: a user with two-factor authentication goes to the login
+// page of the front-end instead, with a challenge to exchange with a code.
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.errorJSON(w, errOIDCDisabled, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// the state is good for one try, whatever happens next
+	http.SetCookie(w, oidcCookie("", -1))
+
+	if query.Get("error") != "" {
+		app.errorJSON(w, fmt.Errorf("login refused by the provider: %s", query.Get("error")), http.StatusUnauthorized)
+		return
+	}
+
+	// the state must come back to the browser it was given to, or anyone could log a victim into their account
+	invalid := errors.New("invalid or expired login, try again")
+	cookie, err := r.Cookie(oidcStateCookie)
+	state := query.Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		app.errorJSON(w, invalid)
+		return
+	}
+
+	login, err := app.DB.UseOIDCLogin(r.Context(), state, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, invalid)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	idToken, err := app.oidc.Exchange(r.Context(), query.Get("code"), login.CodeVerifier)
+	if err != nil {
+		log.Printf("oidc code exchange: %v", err)
+		app.errorJSON(w, errors.New("the provider did not accept the login"), http.StatusBadGateway)
+		return
+	}
+
+	claims, err := app.oidc.VerifyIDToken(r.Context(), idToken, login.Nonce)
+	if err != nil {
+		log.Printf("oidc id token: %v", err)
+		app.errorJSON(w, errors.New("invalid ID token"), http.StatusUnauthorized)
+		return
+	}
+
+	var user *models.User
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		var err error
+		user, err = app.oidcUser(r, repo, claims)
+		return err
+	})
+	if errors.Is(err, errOIDCEmail) || errors.Is(err, errOIDCUserDisabled) {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		challenge, err := app.twoFactorChallenge(user)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		// in the fragment, which the browser does not send on, nor put in a Referer
+		http.Redirect(w, r, app.FrontendURL+"/login#challenge="+url.QueryEscape(challenge), http.StatusFound)
+		return
+	}
+
+	tokens, err := app.newSession(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	http.SetCookie(w, app.auth.GetRefreshCookie(tokens.RefreshToken))
+	http.Redirect(w, r, app.FrontendURL+"/", http.StatusFound)
+}
+
+// disable the two-factor authentication of a user who lost their authenticator app and recovery codes
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		return app.disableTOTP(r, repo, id)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication disabled",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// the security events of a user, newest first
+func (app *application) UserAuthEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	events, err := app.DB.UserAuthEvents(r.Context(), id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: events})
+}
+
+// the emails and client addresses blocked from logging in after failed logins
+func (app *application) LoginLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := app.DB.LoginLockouts(r.Context(), time.Now())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: lockouts})
+}
+
+// forget the failed logins of an email or a client address, which can log in again at once
+func (app *application) ClearLoginLockout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.DeleteLoginThrottle(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("lockout not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "lockout cleared",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// list the users, ?q= filters on name and email
+func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.DB.ListUsers(r.Context(), r.URL.Query().Get("q"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if users == nil {
+		users = []*models.User{}
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: users})
+}
+
+func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, user)
+}
+
+func (app *application) InsertUser(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+		Role      string `json:"role"` // viewer when empty
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// the admin vouches for the email of the users they create
+	now := time.Now()
+	user := models.User{
+		FirstName:       strings.TrimSpace(payload.FirstName),
+		Lastname:        strings.TrimSpace(payload.LastName),
+		Role:            payload.Role,
+		CreatedAt:       now,
+		UpdateAt:        now,
+		EmailVerifiedAt: &now,
+	}
+
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+
+	user.Email, err = repository.ValidEmail(payload.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = repository.ValidPassword(payload.Password, user.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	newID, err := app.DB.InsertUser(r.Context(), user)
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, repository.ErrUnknownRole) {
+		app.errorJSON(w, fmt.Errorf("unknown role %q", user.Role))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "user created",
+		Data: struct {
+			ID int `json:"id"`
+		}{newID},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// change the name and email of a user, the password is not touched
+func (app *application) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+	}
+
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := models.User{
+		ID:        id,
+		FirstName: strings.TrimSpace(payload.FirstName),
+		Lastname:  strings.TrimSpace(payload.LastName),
+		UpdateAt:  time.Now(),
+	}
+
+	user.Email, err = repository.ValidEmail(payload.Email)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.UpdateUser(r.Context(), user)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrDuplicateEmail) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "user updated",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// give a user another role with {"role": "editor"}, it applies from their next login or token refresh
+func (app *application) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// an admin demoting themselves would need someone with database access to recover
+	if id == app.currentUserID(r) {
+		app.errorJSON(w, errors.New("you cannot change your own role"))
+		return
+	}
+
+	err = app.DB.SetUserRole(r.Context(), id, payload.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrUnknownRole) {
+		app.errorJSON(w, fmt.Errorf("unknown role %q", payload.Role))
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "role changed",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+func (app *application) AllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.AllRoles(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: roles})
+}
+
+func (app *application) DisableUser(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	app.setUserDisabled(w, r, &now, "user disabled")
+}
+
+func (app *application) EnableUser(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, nil, "user enabled")
+}
+
+func (app *application) setUserDisabled(w http.ResponseWriter, r *http.Request, disabledAt *time.Time, message string) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// an admin locking themselves out would need someone with database access to recover
+	if disabledAt != nil && id == app.currentUserID(r) {
+		app.errorJSON(w, errors.New("you cannot disable your own account"))
+		return
+	}
+
+	// nothing to apply when the user is enabled
+	revoke := func() {}
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.SetUserDisabled(r.Context(), id, disabledAt)
+		if err != nil || disabledAt == nil {
+			return err
+		}
+		// a disabled user has to log in again once enabled, and is locked out of the admin right away
+		_, err = repo.RevokeUserRefreshTokens(r.Context(), id, *disabledAt)
+		if err != nil {
+			return err
+		}
+		revoke, err = app.revokeUserAccessTokens(r.Context(), repo, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revoke()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: message,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if id == app.currentUserID(r) {
+		app.errorJSON(w, errors.New("you cannot delete your own account"))
+		return
+	}
+
+	// refresh tokens go with the user, its access tokens have to be revoked
+	var revoke func()
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteUser(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		revoke, err = app.revokeUserAccessTokens(r.Context(), repo, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revoke()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "user deleted",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// revoke every access and refresh token of a user, who has to log in again
+func (app *application) RevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var revoked int
+	var revoke func()
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		_, err := repo.GetUserByID(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		revoked, err = repo.RevokeUserRefreshTokens(r.Context(), id, time.Now())
+		if err != nil {
+			return err
+		}
+		revoke, err = app.revokeUserAccessTokens(r.Context(), repo, id)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revoke()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("tokens revoked, %d refresh tokens included", revoked),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// revoke one access token by its jti
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	jti := chi.URLParam(r, "jti")
+	if jti == "" || len(jti) > 64 {
+		app.errorJSON(w, errors.New("invalid token id"))
+		return
+	}
+
+	// the token expires TokenExpiry after it was issued at the latest
+	revoke, err := app.revokeAccessToken(r.Context(), app.DB, jti, time.Now().Add(app.auth.TokenExpiry))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	revoke()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "token revoked",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// list the API keys, never the keys themselves
+func (app *application) AllAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.AllAPIKeys(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: keys})
+}
+
+// create an API key. The key is only ever shown in this response, the database keeps its hash.
+func (app *application) InsertAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"` // never expires when empty
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	name := strings.TrimSpace(payload.Name)
+	if name == "" || len(name) > 255 {
+		app.errorJSON(w, errors.New("the name of the key is required, 255 characters at most"))
+		return
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		app.errorJSON(w, errors.New("expires_at must be in the future"))
+		return
+	}
+
+	// a key can not do more than whoever creates it
+	claims, _ := r.Context().Value(claimsKey).(*Claims)
+
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, scope := range payload.Scopes {
+		if seen[scope] {
+			continue
+		}
+		if claims == nil || !claims.HasPermission(scope) {
+			app.errorJSON(w, fmt.Errorf("you cannot grant the %q scope", scope), http.StatusForbidden)
+			return
+		}
+		seen[scope] = true
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		app.errorJSON(w, errors.New("a key needs at least one scope"))
+		return
+	}
+
+	key, prefix, hash, err := newAPIKey()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	newID, err := app.DB.InsertAPIKey(r.Context(), models.APIKey{
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    scopes,
+		CreatedBy: app.currentUserID(r),
+		CreatedAt: time.Now(),
+		ExpiresAt: payload.ExpiresAt,
+	})
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "api key created, store it now as it will not be shown again",
+		Data: struct {
+			ID     int    `json:"id"`
+			Prefix string `json:"prefix"`
+			Key    string `json:"key"`
+		}{newID, prefix, key},
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RevokeAPIKey(r.Context(), id, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("api key not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "api key revoked",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+func (app *application) MovieCatalog(w http.ResponseWriter, r *http.Request) {
+	app.listMovies(w, r)
+}
+
+func (app *application) SearchMovies(w http.ResponseWriter, r *http.Request) {
+	limit := repository.DefaultMovieLimit
+	if r.URL.Query().Get("limit") != "" {
+		n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || n < 1 {
+			app.errorJSON(w, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = n
+	}
+	if limit > repository.MaxMovieLimit {
+		limit = repository.MaxMovieLimit
+	}
+
+	results, err := app.DB.SearchMovies(r.Context(), r.URL.Query().Get("q"), limit)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error: false,
+		Data:  results,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) SuggestMovies(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if r.URL.Query().Get("limit") != "" {
+		n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || n < 1 || n > 20 {
+			app.errorJSON(w, errors.New("limit must be between 1 and 20"))
+			return
+		}
+		limit = n
+	}
+
+	prefix := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("prefix")))
+	if prefix == "" {
+		app.errorJSON(w, errors.New("prefix is required"))
+		return
+	}
+
+	key := fmt.Sprintf("%d:%s", limit, prefix)
+	suggestions, ok := app.suggestions.Get(key)
+
+	if !ok {
+		// a typeahead answer that arrives late is useless, so give up after the latency budget
+		ctx, cancel := context.WithTimeout(r.Context(), app.SuggestTimeout)
+		defer cancel()
+
+		var err error
+		suggestions, err = app.DB.SuggestMovies(ctx, prefix, limit)
+		if errors.Is(err, context.DeadlineExceeded) {
+			app.errorJSON(w, errors.New("suggestions took too long"), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		if suggestions == nil {
+			suggestions = []*models.MovieSuggestion{}
+		}
+		app.suggestions.Set(key, suggestions)
+	}
+
+	resp := JSONResponse{
+		Error: false,
+		Data:  suggestions,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) GetMovie(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	movieID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	movie, err := app.DB.OneMovie(r.Context(), movieID)
+
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, movie)
+}
+
+func (app *application) MovieForEdit(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	movieID, err := strconv.Atoi(id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	movie, genres, err := app.DB.OneMovieForEdit(r.Context(), movieID)
+
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload = struct {
+		Movie  *models.Movie   `json:"movie"`
+		Genres []*models.Genre `json:"genres"`
+	}{
+		movie,
+		genres,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload, movieETag(movie.Version))
+}
+
+// the ETag header of a movie at version
+func movieETag(version int) http.Header {
+	return http.Header{"Etag": {strconv.Quote(strconv.Itoa(version))}}
+}
+
+// the movie version the client read, from its If-Match header
+func ifMatchVersion(r *http.Request) (int, error) {
+	etag := r.Header.Get("If-Match")
+	if etag == "" {
+		return 0, errors.New("send the ETag of the movie in an If-Match header")
+	}
+
+	version, err := strconv.Atoi(strings.Trim(etag, `"`))
+	if err != nil {
+		return 0, fmt.Errorf("invalid If-Match header %s", etag)
+	}
+
+	return version, nil
+}
+
+// answer an edit made on an outdated copy with 412 and the current copy,
+// so the client can show what changed and let the user merge
+func (app *application) versionConflict(w http.ResponseWriter, r *http.Request, id int) {
+	movie, genres, err := app.DB.OneMovieForEdit(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("movie has been deleted"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   true,
+		Message: repository.ErrVersionConflict.Error(),
+		Data: struct {
+			Movie  *models.Movie   `json:"movie"`
+			Genres []*models.Genre `json:"genres"`
+		}{movie, genres},
+	}
+
+	app.writeJSON(w, http.StatusPreconditionFailed, res, movieETag(movie.Version))
+}
+
+func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.DB.AllGenres(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, genres)
+}
+
+func (app *application) InsertGenre(w http.ResponseWriter, r *http.Request) {
+	var genre models.Genre
+	err := app.readJSON(w, r, &genre)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-			tokenPairs, err := app.auth.GenerateTokenPair(&u)
+	genre.Genre, err = repository.ValidGenreName(genre.Genre)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-			if err != nil {
-				app.errorJSON(w, errors.New("error generating tokens"), http.StatusUnauthorized)
-				return
-			}
+	genre.CreatedAt = time.Now()
+	genre.UpdatedAt = time.Now()
 
-			http.SetCookie(w, app.auth.GetRefreshCookie(tokenPairs.RefreshToken))
+	newID, err := app.DB.InsertGenre(r.Context(), genre)
+	if errors.Is(err, repository.ErrDuplicateGenre) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-			app.writeJSON(w, http.StatusOK, tokenPairs)
-		}
+	res := JSONResponse{
+		Error:   false,
+		Message: "genre created",
+		Data: struct {
+			ID int `json:"id"`
+		}{newID},
 	}
-}
 
-func (app *application) logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
-	w.WriteHeader(http.StatusAccepted)
+	app.writeJSON(w, http.StatusAccepted, res)
 }
 
-func (app *application) MovieCatalog(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovies()
+func (app *application) RenameGenre(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movies)
-}
+	var genre models.Genre
+	err = app.readJSON(w, r, &genre)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-func (app *application) GetMovie(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	movieID, err := strconv.Atoi(id)
+	genre.Genre, err = repository.ValidGenreName(genre.Genre)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie, err := app.DB.OneMovie(movieID)
+	genre.ID = id
+	genre.UpdatedAt = time.Now()
 
+	err = app.DB.UpdateGenre(r.Context(), genre)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrDuplicateGenre) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, movie)
+	res := JSONResponse{
+		Error:   false,
+		Message: "genre renamed",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
 }
 
-func (app *application) MovieForEdit(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	movieID, err := strconv.Atoi(id)
+// move every movie of genre {id} to the genre sent as {"into": 3}, then delete genre {id}
+func (app *application) MergeGenre(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		Into int `json:"into"`
+	}
+	err = app.readJSON(w, r, &payload)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie, genres, err := app.DB.OneMovieForEdit(movieID)
+	if payload.Into == id {
+		app.errorJSON(w, errors.New("cannot merge a genre into itself"))
+		return
+	}
 
+	moved, err := app.DB.MergeGenres(r.Context(), id, payload.Into)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	var payload = struct {
-		Movie  *models.Movie   `json:"movie"`
-		Genres []*models.Genre `json:"genres"`
-	}{
-		movie,
-		genres,
+	res := JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("genre merged, %d movies moved", moved),
+		Data: struct {
+			Moved int `json:"moved"`
+		}{moved},
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusAccepted, res)
 }
 
-func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
-	genres, err := app.DB.AllGenres()
+// delete a genre. When movies still have it the delete is refused with the number of movies
+// that would lose it, unless ?force=true is sent.
+func (app *application) DeleteGenre(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, genres)
+	force := r.URL.Query().Get("force") == "true"
+
+	var count int
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		n, err := repo.GenreMovieCount(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		count = n
+		if count > 0 && !force {
+			return nil
+		}
+		return repo.DeleteGenre(r.Context(), id)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("genre not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	data := struct {
+		Movies int `json:"movies"`
+	}{count}
+
+	if count > 0 && !force {
+		res := JSONResponse{
+			Error:   true,
+			Message: fmt.Sprintf("%d movies would lose this genre, send force=true to delete it anyway", count),
+			Data:    data,
+		}
+		app.writeJSON(w, http.StatusConflict, res)
+		return
+	}
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "genre deleted",
+		Data:    data,
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
 }
 
 func (app *application) InsertMovie(w http.ResponseWriter, r *http.Request) {
@@ -223,19 +2510,27 @@ func (app *application) InsertMovie(w http.ResponseWriter, r *http.Request) {
 	movie.CreateAt = time.Now()
 	movie.UpdatedAt = time.Now()
 
-	//insert movie
-	newID, err := app.DB.InsertMovie(movie)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	//handle genres
-	err = app.DB.UpdateMovieGenres(newID, movie.GenresArray)
+	//insert movie and its genres together, either both are saved or neither
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		newID, err := repo.InsertMovie(r.Context(), movie)
+		if err != nil {
+			return err
+		}
+		//handle genres
+		err = repo.UpdateMovieGenres(r.Context(), newID, movie.GenresArray)
+		if err != nil {
+			return err
+		}
+		return app.recordRevision(r, repo, newID, models.RevisionInsert)
+	})
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
+	// the cached suggestions would miss the movie until they expire, as after every change of the titles
+	app.suggestions.Clear()
+
 	resp := JSONResponse{
 		Error:   false,
 		Message: "movie updated",
@@ -292,15 +2587,37 @@ func (app *application) getPoster(movie models.Movie) models.Movie {
 }
 
 func (app *application) UpdateMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusPreconditionRequired)
+		return
+	}
+
 	var payload models.Movie
 
-	err := app.readJSON(w, r, &payload)
+	err = app.readJSON(w, r, &payload)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie, err := app.DB.OneMovie(payload.ID)
+	// the movie updated is the one of the path, the id of the body may only repeat it
+	if payload.ID != 0 && payload.ID != id {
+		app.errorJSON(w, fmt.Errorf("movie id %d does not match the path", payload.ID))
+		return
+	}
+
+	movie, err := app.DB.OneMovie(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("movie not found"), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -312,35 +2629,283 @@ func (app *application) UpdateMovie(w http.ResponseWriter, r *http.Request) {
 	movie.MPAARating = payload.MPAARating
 	movie.RunTime = payload.RunTime
 	movie.UpdatedAt = time.Now()
+	movie.Version = version
+
+	//update movie and its genres together, either both are saved or neither
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.UpdateMovie(r.Context(), *movie)
+		if err != nil {
+			return err
+		}
+		err = repo.UpdateMovieGenres(r.Context(), movie.ID, payload.GenresArray)
+		if err != nil {
+			return err
+		}
+		return app.recordRevision(r, repo, movie.ID, models.RevisionUpdate)
+	})
+	if errors.Is(err, repository.ErrVersionConflict) {
+		app.versionConflict(w, r, movie.ID)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.suggestions.Clear()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "movie udpated",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res, movieETag(version+1))
+}
 
-	err = app.DB.UpdateMovie(*movie)
+func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	err = app.DB.UpdateMovieGenres(movie.ID, payload.GenresArray)
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusPreconditionRequired)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.DeleteMovie(r.Context(), id, version)
+		if err != nil {
+			return err
+		}
+		return app.recordRevision(r, repo, id, models.RevisionDelete)
+	})
+	if errors.Is(err, repository.ErrVersionConflict) {
+		app.versionConflict(w, r, id)
+		return
+	}
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	app.suggestions.Clear()
 
 	res := JSONResponse{
 		Error:   false,
-		Message: "movie udpated",
+		Message: "movie moved to trash",
 	}
 
 	app.writeJSON(w, http.StatusAccepted, res)
 }
 
-func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
+func (app *application) MovieTrash(w http.ResponseWriter, r *http.Request) {
+	movies, err := app.DB.TrashedMovies(r.Context())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if movies == nil {
+		movies = []*models.Movie{}
+	}
+
+	// tell the admin when each movie will be purged for good
+	res := JSONResponse{
+		Error: false,
+		Data:  movies,
+		Meta: struct {
+			Retention string `json:"retention"`
+		}{app.TrashRetention.String()},
+	}
+
+	app.writeJSON(w, http.StatusOK, res)
+}
+
+func (app *application) RestoreMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.RestoreMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		return app.recordRevision(r, repo, id, models.RevisionRestore)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("movie is not in the trash"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.suggestions.Clear()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: "movie restored",
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// snapshot a movie after a change and append it to its history, inside the transaction of the change
+func (app *application) recordRevision(r *http.Request, repo repository.DatabaseRepo, movieID int, action string) error {
+	snapshot, err := repo.MovieSnapshot(r.Context(), movieID)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.InsertMovieRevision(r.Context(), models.MovieRevision{
+		MovieID:   movieID,
+		Action:    action,
+		Snapshot:  *snapshot,
+		UserID:    app.currentUserID(r),
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+func (app *application) MovieRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	revisions, err := app.DB.MovieRevisions(r.Context(), id)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if revisions == nil {
+		revisions = []*models.MovieRevision{}
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: revisions})
+}
+
+// field by field difference between two revisions: ?from=2&to=5
+func (app *application) MovieRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		app.errorJSON(w, errors.New("from and to must be revision numbers"))
+		return
+	}
+
+	fromRevision, err := app.DB.MovieRevision(r.Context(), id, from)
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("revision %d not found", from), http.StatusNotFound)
+		return
+	}
+
+	toRevision, err := app.DB.MovieRevision(r.Context(), id, to)
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("revision %d not found", to), http.StatusNotFound)
+		return
+	}
+
+	var payload = struct {
+		From    int                  `json:"from"`
+		To      int                  `json:"to"`
+		Changes []models.FieldChange `json:"changes"`
+	}{
+		from,
+		to,
+		models.DiffMovies(fromRevision.Snapshot, toRevision.Snapshot),
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{Error: false, Data: payload})
+}
+
+// put a movie back in the state of an earlier revision, which is recorded as a new revision
+func (app *application) RollbackMovie(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	err = app.DB.DeleteMovie(id)
+	revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	target, err := app.DB.MovieRevision(r.Context(), id, revision)
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("revision %d not found", revision), http.StatusNotFound)
+		return
+	}
+
+	if target.Snapshot.DeletedAt != nil {
+		app.errorJSON(w, errors.New("cannot roll back to a deleted revision, delete the movie instead"))
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		current, err := repo.MovieSnapshot(r.Context(), id)
+		if err != nil {
+			return errors.New("movie has been purged")
+		}
+
+		// a movie in the trash has to come back before it can be updated
+		if current.DeletedAt != nil {
+			err = repo.RestoreMovie(r.Context(), id)
+			if err != nil {
+				return err
+			}
+			current.Version++
+		}
+
+		movie := target.Snapshot
+		movie.ID = id
+		movie.UpdatedAt = time.Now()
+		// the rollback applies on top of whatever is there now, not on the old version
+		movie.Version = current.Version
+
+		err = repo.UpdateMovie(r.Context(), movie)
+		if err != nil {
+			return err
+		}
+
+		err = repo.UpdateMovieGenres(r.Context(), id, movie.GenresArray)
+		if err != nil {
+			return err
+		}
+
+		return app.recordRevision(r, repo, id, models.RevisionRollback)
+	})
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.suggestions.Clear()
+
+	res := JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("movie rolled back to revision %d", revision),
+	}
+
+	app.writeJSON(w, http.StatusAccepted, res)
+}
+
+// permanently delete what has been in the trash longer than the retention period
+func (app *application) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	purged, err := app.DB.PurgeTrash(r.Context(), time.Now().Add(-app.TrashRetention))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -348,7 +2913,10 @@ func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 
 	res := JSONResponse{
 		Error:   false,
-		Message: "movie deleted",
+		Message: fmt.Sprintf("%d movies purged", purged),
+		Data: struct {
+			Purged int `json:"purged"`
+		}{purged},
 	}
 
 	app.writeJSON(w, http.StatusAccepted, res)
@@ -361,18 +2929,20 @@ func (app *application) AllMoviesByGenre(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movies, err := app.DB.AllMovies(id)
+	// paged like /movies, the genre of the path replaces any genre filter
+	opts, err := app.readMovieListOptions(r)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	opts.Genres = []int{id}
 
-	app.writeJSON(w, http.StatusOK, movies)
+	app.writeMovieList(w, r, opts)
 }
 
 func (app *application) movieGraphQL(w http.ResponseWriter, r *http.Request) {
 	// we need to populate our Graph type with the movie list
-	movies, _ := app.DB.AllMovies()
+	movies, _ := app.DB.AllMovies(r.Context())
 
 	// get the query from the request
 	q, _ := io.ReadAll(r.Body)
@@ -381,6 +2951,20 @@ func (app *application) movieGraphQL(w http.ResponseWriter, r *http.Request) {
 	// create a new var of tyepe *graph.Graph
 	g := graph.New(movies)
 
+	// search with the same full text ranking as GET /movies/search
+	g.Search = func(query string) ([]*models.Movie, error) {
+		results, err := app.DB.SearchMovies(r.Context(), query, repository.MaxMovieLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		var movies []*models.Movie
+		for _, result := range results {
+			movies = append(movies, result.Movie)
+		}
+		return movies, nil
+	}
+
 	// set the query string on the variable
 	g.QueryString = query
 
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"backend/internal/jwtkeys"
+	"backend/internal/models"
+	"backend/internal/repository"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestAllMovies(t *testing.T) {
+	ta := newTestApp(t)
+
+	rec := ta.request(t, http.MethodGet, "/movies?limit=2", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var res struct {
+		Data []models.Movie `json:"data"`
+		Meta PageMeta       `json:"meta"`
+	}
+	decode(t, rec, &res)
+
+	if len(res.Data) != 2 || res.Meta.Total != 3 || res.Meta.NextCursor == "" {
+		t.Fatalf("got %d movies of %d, next cursor %q", len(res.Data), res.Meta.Total, res.Meta.NextCursor)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		status   int
+	}{
+		{"right password", "viewer@example.com", testPassword, http.StatusAccepted},
+		{"wrong password", "viewer@example.com", "wrong", http.StatusBadRequest},
+		{"unknown email", "nobody@example.com", testPassword, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.request(t, http.MethodPost, "/auth", map[string]string{"email": tt.email, "password": tt.password})
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+	viewer := ta.logIn(t, "viewer@example.com")
+
+	rec := ta.request(t, http.MethodGet, "/admin/movies", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without a token: status %d", rec.Code)
+	}
+
+	rec = ta.request(t, http.MethodGet, "/admin/movies", nil, bearer(viewer)...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("viewer listing movies: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = ta.request(t, http.MethodGet, "/admin/users", nil, bearer(viewer)...)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer listing users: status %d", rec.Code)
+	}
+}
+
+func TestAllMoviesByGenre(t *testing.T) {
+	ta := newTestApp(t)
+
+	// genre 5 has Highlander and Raiders of the Lost Ark, a genre filter of the query is ignored
+	rec := ta.request(t, http.MethodGet, "/movies/genres/5?limit=1&genre=9", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var page struct {
+		Data []models.Movie `json:"data"`
+		Meta PageMeta       `json:"meta"`
+	}
+	decode(t, rec, &page)
+
+	if len(page.Data) != 1 || page.Meta.Total != 2 || page.Meta.NextCursor == "" {
+		t.Fatalf("got %d movies of %d, next cursor %q", len(page.Data), page.Meta.Total, page.Meta.NextCursor)
+	}
+	first := page.Data[0].Title
+
+	rec = ta.request(t, http.MethodGet, "/movies/genres/5?limit=1&cursor="+page.Meta.NextCursor, nil)
+	var next struct {
+		Data []models.Movie `json:"data"`
+		Meta PageMeta       `json:"meta"`
+	}
+	decode(t, rec, &next)
+
+	if len(next.Data) != 1 || next.Data[0].Title == first || next.Meta.NextCursor != "" {
+		t.Fatalf("second page: %d movies, next cursor %q", len(next.Data), next.Meta.NextCursor)
+	}
+}
+
+func TestUpdateMovie(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "editor@example.com", models.RoleEditor)
+	editor := ta.logIn(t, "editor@example.com")
+
+	movie, err := ta.repo.OneMovie(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := strconv.Quote(strconv.Itoa(movie.Version))
+
+	update := *movie
+	update.Title = "Renamed"
+
+	tests := []struct {
+		name   string
+		path   string
+		id     int
+		status int
+	}{
+		{"id of the body is another movie", "/admin/movies/1", 2, http.StatusBadRequest},
+		{"unknown movie", "/admin/movies/999", 0, http.StatusNotFound},
+		{"id only in the path", "/admin/movies/1", 0, http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			update.ID = tt.id
+			headers := append(bearer(editor), "If-Match", etag)
+			rec := ta.request(t, http.MethodPatch, tt.path, update, headers...)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	for _, id := range []int{1, 2} {
+		movie, err := ta.repo.OneMovie(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renamed := movie.Title == "Renamed"; renamed != (id == 1) {
+			t.Errorf("movie %d titled %q", id, movie.Title)
+		}
+	}
+}
+
+// logInTokens logs in with testPassword and returns the token pair, refresh token included
+func (ta *testApp) logInTokens(t *testing.T, email string) TokenPairs {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodPost, "/auth", map[string]string{"email": email, "password": testPassword})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login of %s: %d %s", email, rec.Code, rec.Body)
+	}
+
+	var tokens TokenPairs
+	decode(t, rec, &tokens)
+	return tokens
+}
+
+// refresh exchanges refreshToken at /refresh, sent in its cookie
+func (ta *testApp) refresh(t *testing.T, refreshToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodGet, "/refresh", nil, "Cookie", ta.auth.CookieName+"="+refreshToken)
+}
+
+func TestRefreshTokenRotated(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+	first := ta.logInTokens(t, "viewer@example.com")
+
+	rec := ta.refresh(t, first.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d: %s", rec.Code, rec.Body)
+	}
+	var second TokenPairs
+	decode(t, rec, &second)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token not rotated: %q", second.RefreshToken)
+	}
+
+	// the first token was stolen: presenting it again ends the session of the family
+	rec = ta.refresh(t, first.RefreshToken)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused token: status %d", rec.Code)
+	}
+	if rec := ta.refresh(t, second.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token issued after the reused one: status %d", rec.Code)
+	}
+
+	// another login is another family
+	if rec := ta.refresh(t, ta.logInTokens(t, "viewer@example.com").RefreshToken); rec.Code != http.StatusOK {
+		t.Fatalf("new login: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestLogoutRevokesRefreshToken(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+	tokens := ta.logInTokens(t, "viewer@example.com")
+
+	rec := ta.request(t, http.MethodGet, "/logout", nil, "Cookie", ta.auth.CookieName+"="+tokens.RefreshToken)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("logout: status %d", rec.Code)
+	}
+
+	if rec := ta.refresh(t, tokens.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout: status %d", rec.Code)
+	}
+}
+
+func TestRefreshNeedsRefreshToken(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+
+	// an access token is not a refresh token, even a valid one
+	if rec := ta.refresh(t, ta.logIn(t, "viewer@example.com")); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("access token: status %d", rec.Code)
+	}
+}
+
+func TestJWKSKeySelection(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+
+	dir := t.TempDir()
+	keys, err := jwtkeys.New(dir, jwtkeys.ES256, time.Hour, ta.auth.RefreshExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.auth.Keys = keys
+
+	sign := func() (string, string) {
+		token := ta.logIn(t, "viewer@example.com")
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kid, _ := parsed.Header["kid"].(string)
+		return token, kid
+	}
+	oldToken, oldKid := sign()
+
+	// the first key is a rotation old: the next one is generated and signs from now on
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("%d keys: %v", len(files), err)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(files[0], past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := keys.Rotate(time.Now())
+	if err != nil || !rotated {
+		t.Fatalf("rotated %v: %v", rotated, err)
+	}
+	newToken, newKid := sign()
+	if newKid == oldKid {
+		t.Fatalf("still signing with %s", oldKid)
+	}
+
+	// both keys are published, and each token is verified with the key of its kid
+	rec := ta.request(t, http.MethodGet, "/.well-known/jwks.json", nil)
+	var set jwtkeys.JWKS
+	decode(t, rec, &set)
+	if len(set.Keys) != 2 || set.Keys[0].KeyID != oldKid || set.Keys[1].KeyID != newKid {
+		t.Fatalf("published %+v, want %s and %s", set.Keys, oldKid, newKid)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		_, err := ta.auth.VerifyToken(token, accessTokenType)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the kid picks the key: changed, the signature is checked with the wrong key, unknown, there is none
+	forge := func(kid string) string {
+		parts := strings.Split(oldToken, ".")
+		header, err := json.Marshal(map[string]string{"alg": jwtkeys.ES256, "typ": "JWT", "kid": kid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[0] = base64.RawURLEncoding.EncodeToString(header)
+		return strings.Join(parts, ".")
+	}
+	_, err = ta.auth.VerifyToken(forge(newKid), accessTokenType)
+	if !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("kid of the other key: got %v, want %v", err, ErrTokenSignature)
+	}
+	_, err = ta.auth.VerifyToken(forge("unknown"), accessTokenType)
+	if !errors.Is(err, ErrTokenKey) {
+		t.Fatalf("unknown kid: got %v, want %v", err, ErrTokenKey)
+	}
+}
+
+func TestVerifyTokenErrors(t *testing.T) {
+	ta := newTestApp(t)
+
+	claims := func() *Claims {
+		now := time.Now()
+		return &Claims{
+			TokenType: accessTokenType,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        "jti",
+				Subject:   "1",
+				Issuer:    ta.auth.Issuer,
+				Audience:  jwt.ClaimStrings{ta.auth.Audience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}
+	}
+	secret := []byte(ta.auth.Secret)
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    interface{}
+		change func(c *Claims)
+		want   error
+	}{
+		{"valid", jwt.SigningMethodHS256, secret, func(c *Claims) {}, nil},
+		{"expired", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		}, ErrTokenExpired},
+		{"expired within the clock skew", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-ta.auth.ClockSkew / 2))
+		}, nil},
+		{"not valid yet", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute))
+		}, ErrTokenNotYetValid},
+		{"issued within the clock skew", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(ta.auth.ClockSkew / 2))
+		}, nil},
+		{"no expiry", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.ExpiresAt = nil
+		}, ErrTokenMalformed},
+		{"other issuer", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.Issuer = "evil.test"
+		}, ErrTokenIssuer},
+		{"other audience", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.Audience = jwt.ClaimStrings{"another.test"}
+		}, ErrTokenAudience},
+		{"refresh token", jwt.SigningMethodHS256, secret, func(c *Claims) {
+			c.TokenType = refreshTokenType
+		}, ErrTokenType},
+		{"other algorithm", jwt.SigningMethodHS384, secret, func(c *Claims) {}, ErrTokenAlgorithm},
+		{"unsigned", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, func(c *Claims) {}, ErrTokenAlgorithm},
+		{"other secret", jwt.SigningMethodHS256, []byte("another secret"), func(c *Claims) {}, ErrTokenSignature},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims()
+			tt.change(c)
+			token, err := jwt.NewWithClaims(tt.method, c).SignedString(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ta.auth.VerifyToken(token, accessTokenType)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	_, err := ta.auth.VerifyToken("not.a-token", accessTokenType)
+	if !errors.Is(err, ErrTokenMalformed) {
+		t.Fatalf("malformed: got %v, want %v", err, ErrTokenMalformed)
+	}
+}
+
+func TestUnauthorizedChallenge(t *testing.T) {
+	ta := newTestApp(t)
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		TokenType: accessTokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ta.auth.Issuer,
+			Audience:  jwt.ClaimStrings{ta.auth.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		},
+	}).SignedString([]byte(ta.auth.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+		want    string
+	}{
+		{"no token", nil, http.StatusUnauthorized, `Bearer realm="api.test"`},
+		{"other scheme", []string{"Authorization", "Basic dXNlcjpwYXNz"}, http.StatusBadRequest, `error="invalid_request"`},
+		{"expired token", bearer(expired), http.StatusUnauthorized, `error="invalid_token", error_description="token is expired"`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ta.request(t, http.MethodGet, "/admin/movies", nil, tt.headers...)
+			challenge := rec.Header().Get("WWW-Authenticate")
+			if rec.Code != tt.status || !strings.Contains(challenge, tt.want) {
+				t.Fatalf("status %d, WWW-Authenticate %q, want %d with %q", rec.Code, challenge, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func (ta *testApp) register(t *testing.T, email, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodPost, "/auth/register", map[string]string{
+		"first_name": "New",
+		"last_name":  "User",
+		"email":      email,
+		"password":   password,
+	})
+}
+
+func (ta *testApp) verifyEmailLink(t *testing.T, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodGet, "/auth/verify-email?token="+url.QueryEscape(token), nil)
+}
+
+func TestRegisterAndVerifyEmail(t *testing.T) {
+	ta := newTestApp(t)
+
+	if rec := ta.register(t, "new@example.com", testPassword); rec.Code != http.StatusAccepted {
+		t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+	}
+	token := ta.linkToken(t, "new@example.com")
+
+	// no login before the address is verified
+	rec := ta.request(t, http.MethodPost, "/auth", map[string]string{"email": "new@example.com", "password": testPassword})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("login before verification: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := ta.verifyEmailLink(t, token); rec.Code != http.StatusAccepted {
+		t.Fatalf("following the link: status %d: %s", rec.Code, rec.Body)
+	}
+	ta.logIn(t, "new@example.com")
+
+	user, err := ta.repo.GetUserByEmail(context.Background(), "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != models.RoleViewer || user.EmailVerifiedAt == nil {
+		t.Fatalf("registered %+v", user)
+	}
+}
+
+func TestRegisterRejected(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "taken@example.com", models.RoleViewer)
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		status   int
+	}{
+		{"email taken", "taken@example.com", testPassword, http.StatusConflict},
+		{"email taken in another case", "Taken@Example.com", testPassword, http.StatusConflict},
+		{"invalid email", "not an email", testPassword, http.StatusBadRequest},
+		{"short password", "new@example.com", "s3cret", http.StatusBadRequest},
+		{"letters only", "new@example.com", "onlyletters", http.StatusBadRequest},
+		{"password with the email", "newuser@example.com", "newuser-2024", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := ta.register(t, tt.email, tt.password); rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+	ta.noMail(t)
+}
+
+func TestVerifyEmailLinkRejected(t *testing.T) {
+	ta := newTestApp(t)
+	ta.register(t, "new@example.com", testPassword)
+	user, err := ta.repo.GetUserByEmail(context.Background(), "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := ta.linkToken(t, "new@example.com")
+
+	expired, err := ta.auth.LinkToken(verifyEmailTokenType, user.ID, user.Email, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ta.verifyEmailLink(t, expired); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "expired") {
+		t.Fatalf("expired link: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// a token of another kind, such as an access token, verifies nothing
+	access, err := ta.auth.LinkToken(accessTokenType, user.ID, user.Email, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ta.verifyEmailLink(t, access); rec.Code != http.StatusBadRequest {
+		t.Fatalf("access token: status %d", rec.Code)
+	}
+
+	// the link was sent to an address the user does not have anymore
+	user.Email = "changed@example.com"
+	err = ta.repo.UpdateUser(context.Background(), *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ta.verifyEmailLink(t, sent); rec.Code != http.StatusBadRequest {
+		t.Fatalf("link to the old address: status %d", rec.Code)
+	}
+
+	user, err = ta.repo.GetUserByID(context.Background(), user.ID)
+	if err != nil || user.EmailVerifiedAt != nil {
+		t.Fatalf("verified %+v: %v", user, err)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	ta := newTestApp(t)
+	ta.register(t, "new@example.com", testPassword)
+	ta.linkToken(t, "new@example.com")
+	ta.newTestUser(t, "verified@example.com", models.RoleViewer)
+
+	// the same answer whether a link is sent or not
+	for _, email := range []string{"new@example.com", "verified@example.com", "nobody@example.com"} {
+		if rec := ta.request(t, http.MethodPost, "/auth/verify-email/resend", map[string]string{"email": email}); rec.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d", email, rec.Code)
+		}
+	}
+
+	if rec := ta.verifyEmailLink(t, ta.linkToken(t, "new@example.com")); rec.Code != http.StatusAccepted {
+		t.Fatalf("following the new link: status %d: %s", rec.Code, rec.Body)
+	}
+	ta.noMail(t)
+}
+
+func (ta *testApp) resetPassword(t *testing.T, token, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodPost, "/auth/reset-password", map[string]string{"token": token, "password": password})
+}
+
+func TestPasswordReset(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "forgot@example.com", models.RoleViewer)
+	session := ta.logInTokens(t, "forgot@example.com")
+
+	// tokens issued in the second of a revocation are kept, the reset comes in the next one
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	rec := ta.request(t, http.MethodPost, "/auth/forgot-password", map[string]string{"email": "forgot@example.com"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("forgot password: status %d: %s", rec.Code, rec.Body)
+	}
+	token := ta.linkToken(t, "forgot@example.com")
+
+	// a weak password does not use the link up
+	if rec := ta.resetPassword(t, token, "weak"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("weak password: status %d", rec.Code)
+	}
+	if rec := ta.resetPassword(t, token, "n3w-password"); rec.Code != http.StatusAccepted {
+		t.Fatalf("reset: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = ta.request(t, http.MethodPost, "/auth", map[string]string{"email": "forgot@example.com", "password": "n3w-password"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login with the new password: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// the link works once, and whoever had a session is logged out
+	if rec := ta.resetPassword(t, token, "an0ther-password"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("link used twice: status %d", rec.Code)
+	}
+	if rec := ta.refresh(t, session.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh token of the old session: status %d", rec.Code)
+	}
+	if rec := ta.request(t, http.MethodGet, "/admin/movies", nil, bearer(session.Token)...); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("access token of the old session: status %d", rec.Code)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	ta := newTestApp(t)
+	user := ta.newTestUser(t, "forgot@example.com", models.RoleViewer)
+
+	token, err := newTokenID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = ta.repo.InsertPasswordReset(context.Background(), models.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		CreatedAt: now.Add(-passwordResetExpiry - time.Minute),
+		ExpiresAt: now.Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := ta.resetPassword(t, token, "n3w-password"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expired link: status %d: %s", rec.Code, rec.Body)
+	}
+	ta.logIn(t, "forgot@example.com")
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "forgot@example.com", models.RoleViewer)
+
+	known := ta.request(t, http.MethodPost, "/auth/forgot-password", map[string]string{"email": "forgot@example.com"})
+	ta.linkToken(t, "forgot@example.com")
+
+	// the same answer, without an email
+	unknown := ta.request(t, http.MethodPost, "/auth/forgot-password", map[string]string{"email": "nobody@example.com"})
+	if unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Fatalf("known: %d %s, unknown: %d %s", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+	ta.noMail(t)
+}
+
+// slowSuggestions is a database whose suggestions only come once their query has been cancelled
+type slowSuggestions struct {
+	repository.DatabaseRepo
+}
+
+func (s slowSuggestions) SuggestMovies(ctx context.Context, prefix string, limit int) ([]*models.MovieSuggestion, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (ta *testApp) suggest(t *testing.T, prefix string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodGet, "/movies/suggest?prefix="+url.QueryEscape(prefix), nil)
+}
+
+func (ta *testApp) suggested(t *testing.T, prefix string) []models.MovieSuggestion {
+	t.Helper()
+
+	rec := ta.suggest(t, prefix)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("suggestions for %q: status %d: %s", prefix, rec.Code, rec.Body)
+	}
+	var res struct {
+		Data []models.MovieSuggestion `json:"data"`
+	}
+	decode(t, rec, &res)
+	return res.Data
+}
+
+func TestSuggestMoviesTimeout(t *testing.T) {
+	ta := newTestApp(t)
+	ta.SuggestTimeout = 10 * time.Millisecond
+	ta.DB = slowSuggestions{ta.repo}
+
+	if rec := ta.suggest(t, "godf"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// nothing was cached, the next query finds the movie
+	ta.DB = ta.repo
+	if suggestions := ta.suggested(t, "godf"); len(suggestions) != 1 {
+		t.Fatalf("suggested %+v once the database answers", suggestions)
+	}
+}
+
+func TestSuggestionsClearedOnWrite(t *testing.T) {
+	ta := newTestApp(t)
+	ta.suggestions.TTL = time.Hour
+	ta.newTestUser(t, "editor@example.com", models.RoleEditor)
+	editor := ta.logIn(t, "editor@example.com")
+
+	if suggestions := ta.suggested(t, "zardoz"); len(suggestions) != 0 {
+		t.Fatalf("suggested %+v", suggestions)
+	}
+
+	movie, err := ta.repo.OneMovie(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movie.Title = "Zardoz"
+	headers := append(bearer(editor), "If-Match", strconv.Quote(strconv.Itoa(movie.Version)))
+	if rec := ta.request(t, http.MethodPatch, "/admin/movies/1", movie, headers...); rec.Code != http.StatusAccepted {
+		t.Fatalf("renaming: status %d: %s", rec.Code, rec.Body)
+	}
+
+	suggestions := ta.suggested(t, "zardoz")
+	if len(suggestions) != 1 || suggestions[0].ID != 1 {
+		t.Fatalf("suggested %+v after the rename", suggestions)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"backend/internal/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func (ta *testApp) askMagicLink(t *testing.T, email string) int {
+	t.Helper()
+	return ta.request(t, http.MethodPost, "/auth/magic-link", map[string]string{"email": email}).Code
+}
+
+func (ta *testApp) verifyMagicLink(t *testing.T, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodGet, "/auth/magic-link/verify?token="+url.QueryEscape(token), nil)
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "link@example.com", models.RoleViewer)
+
+	if code := ta.askMagicLink(t, "link@example.com"); code != http.StatusAccepted {
+		t.Fatalf("asking a link: status %d", code)
+	}
+	token := ta.linkToken(t, "link@example.com")
+
+	rec := ta.verifyMagicLink(t, token)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("following the link: status %d: %s", rec.Code, rec.Body)
+	}
+	var tokens TokenPairs
+	decode(t, rec, &tokens)
+	if tokens.Token == "" {
+		t.Fatalf("no access token: %s", rec.Body)
+	}
+
+	// a link works once
+	if rec := ta.verifyMagicLink(t, token); rec.Code != http.StatusBadRequest {
+		t.Fatalf("following the link again: status %d", rec.Code)
+	}
+}
+
+func TestMagicLinkUnknownEmail(t *testing.T) {
+	ta := newTestApp(t)
+
+	// the same answer as for an account, without an email
+	if code := ta.askMagicLink(t, "nobody@example.com"); code != http.StatusAccepted {
+		t.Fatalf("status %d", code)
+	}
+	ta.noMail(t)
+}
+
+func TestMagicLinkExpired(t *testing.T) {
+	ta := newTestApp(t)
+	user := ta.newTestUser(t, "link@example.com", models.RoleViewer)
+
+	// a link whose token is still good, but whose row has expired
+	token, err := ta.auth.LinkToken(magicLinkTokenType, user.ID, user.Email, magicLinkExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = ta.repo.InsertMagicLink(context.Background(), models.MagicLink{
+		Email:     user.Email,
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		CreatedAt: now.Add(-time.Hour),
+		ExpiresAt: now.Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := ta.verifyMagicLink(t, token); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// and a token past its own expiry
+	token, err = ta.auth.LinkToken(magicLinkTokenType, user.ID, user.Email, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := ta.verifyMagicLink(t, token); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expired token: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMagicLinkRateLimited(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "link@example.com", models.RoleViewer)
+
+	for _, email := range []string{"link@example.com", "nobody@example.com"} {
+		for i := 0; i < magicLinkLimit; i++ {
+			if code := ta.askMagicLink(t, email); code != http.StatusAccepted {
+				t.Fatalf("link %d for %s: status %d", i+1, email, code)
+			}
+		}
+		if code := ta.askMagicLink(t, email); code != http.StatusTooManyRequests {
+			t.Fatalf("link over the limit for %s: status %d", email, code)
+		}
+	}
+}
+
+func TestMagicLinkDisabledUser(t *testing.T) {
+	ta := newTestApp(t)
+	user := ta.newTestUser(t, "link@example.com", models.RoleViewer)
+
+	ta.askMagicLink(t, "link@example.com")
+	token := ta.linkToken(t, "link@example.com")
+
+	now := time.Now()
+	err := ta.repo.SetUserDisabled(context.Background(), user.ID, &now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := ta.verifyMagicLink(t, token); rec.Code != http.StatusForbidden {
+		t.Fatalf("link sent before the account was disabled: status %d", rec.Code)
+	}
+
+	// a disabled account gets no more links
+	if code := ta.askMagicLink(t, "link@example.com"); code != http.StatusAccepted {
+		t.Fatalf("asking a link: status %d", code)
+	}
+	ta.noMail(t)
+}
+
+func TestMagicLinkNeedsSecondFactor(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTwoFactorUser(t, "2fa@example.com")
+
+	ta.askMagicLink(t, "2fa@example.com")
+
+	// the mailbox is one factor, the link only earns a challenge
+	rec := ta.verifyMagicLink(t, ta.linkToken(t, "2fa@example.com"))
+	var res struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		Token             string `json:"access_token"`
+	}
+	decode(t, rec, &res)
+	if rec.Code != http.StatusAccepted || !res.TwoFactorRequired || res.ChallengeToken == "" || res.Token != "" {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if code := ta.twoFactor(t, res.ChallengeToken, "000000"); code != http.StatusBadRequest {
+		t.Fatalf("wrong code: status %d", code)
+	}
+}
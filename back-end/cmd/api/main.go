@@ -1,11 +1,19 @@
 package main
 
 import (
+	"backend/internal/cache"
+	"backend/internal/jwtkeys"
+	"backend/internal/mailer"
+	"backend/internal/models"
+	"backend/internal/oidc"
 	"backend/internal/repository"
 	"backend/internal/repository/dbrepo"
+	"backend/internal/webauthn"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
@@ -18,12 +26,58 @@ type application struct {
 	DB           repository.DatabaseRepo //pointer to Database Repository interface
 	auth         Auth                    // pointer to Auth object
 	JWTSecret    string
+	JWTKeys      string        // directory of PEM signing keys, HS256 with JWTSecret when empty
+	JWTAlgorithm string        // algorithm of the keys generated in JWTKeys
+	JWTRotation  time.Duration // how often a new signing key is generated, 0 never
 	JWTIssuer    string
 	JWTAudience  string
+	JWTClockSkew time.Duration // leeway on the exp, nbf and iat claims
 	CookieDomain string
 	APIKey       string
+	DBDriver     string // "postgres" or "memory"
+	Fixture      string // JSON seed file for the memory driver
+	DBTimeouts   dbrepo.Timeouts
+
+	SuggestTimeout  time.Duration // latency budget of GET /movies/suggest
+	SuggestCacheTTL time.Duration
+	suggestions     *cache.Cache[[]*models.MovieSuggestion] // suggestions per prefix
+
+	TrashRetention time.Duration // how long deleted movies stay restorable
+
+	RevocationReload time.Duration   // how often the access token revocation list is read again
+	revoked          *revocationList // access tokens revoked before they expire
+
+	PublicURL   string // where clients reach the api, for the links sent by email
+	FrontendURL string // where users reach the front-end, for the links to its pages sent by email
+	Mailer      string // "file" or "smtp"
+	MailFrom    string
+	MailDir     string // where the file mailer writes messages, the log when empty
+	SMTP        mailer.SMTPMailer
+	mailer      mailer.Mailer
+
+	WebAuthnOrigin string                 // where passkeys are used, the front-end by default
+	WebAuthnRPID   string                 // domain passkeys are registered with, the host of the origin by default
+	relyingParty   *webauthn.RelyingParty // verifies the passkey ceremonies
+
+	OIDCIssuer       string // OpenID Connect provider of single sign-on, disabled when empty
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string // the callback registered with the provider, under -public-url by default
+	OIDCScopes       string
+	OIDCRole         string         // role of the users created on their first single sign-on
+	oidc             *oidc.Provider // nil when single sign-on is disabled
+
+	LoginMaxFailures   int           // failed logins of an email before it is locked out
+	LoginMaxIPFailures int           // failed logins of a client address before it is locked out
+	LoginLockout       time.Duration // how long a lockout lasts
+
+	TrustedProxies string       // proxies whose X-Forwarded-For gives the client address, none when empty
+	trustedProxies []*net.IPNet // the ranges of -trusted-proxies
 }
 
+// name of the site shown by authenticator apps and passkey prompts
+const siteName = "Go Movies"
+
 func main() {
 	// set application config
 	var app application
@@ -31,23 +85,87 @@ func main() {
 	// read from command line
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=movies sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection string")
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret")
+	flag.StringVar(&app.JWTKeys, "jwt-keys", "", "directory of PEM keys to sign tokens with instead of the secret")
+	flag.StringVar(&app.JWTAlgorithm, "jwt-alg", "RS256", "algorithm of the keys generated in -jwt-keys (RS256, ES256 or EdDSA)")
+	flag.DurationVar(&app.JWTRotation, "jwt-key-rotation", 0, "generate a new signing key in -jwt-keys this often, 0 never rotates")
 	flag.StringVar(&app.JWTIssuer, "jwt-issuer", "example.com", "signing issuer")
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "example.com", "signing audience")
+	flag.DurationVar(&app.JWTClockSkew, "jwt-clock-skew", 30*time.Second, "clock difference tolerated when checking the time claims of a token")
 	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "cookie domain")
 	flag.StringVar(&app.Domain, "domain", "example.com", "domain")
 	flag.StringVar(&app.APIKey, "api-key", "6bb623021b1474dff9243d32fc942aa1", "api key")
+	flag.StringVar(&app.DBDriver, "db", "postgres", "database repository to use (postgres or memory)")
+	flag.StringVar(&app.Fixture, "fixture", "", "JSON fixture to seed the memory database with")
+	flag.DurationVar(&app.DBTimeouts.Read, "db-read-timeout", 3*time.Second, "timeout for read queries")
+	flag.DurationVar(&app.DBTimeouts.Write, "db-write-timeout", 3*time.Second, "timeout for insert, update and delete statements")
+	flag.DurationVar(&app.DBTimeouts.Admin, "db-admin-timeout", 10*time.Second, "timeout for admin queries")
+	flag.DurationVar(&app.SuggestTimeout, "suggest-timeout", 250*time.Millisecond, "latency budget for title suggestions")
+	flag.DurationVar(&app.SuggestCacheTTL, "suggest-cache-ttl", 30*time.Second, "how long title suggestions are cached per prefix")
+	flag.DurationVar(&app.TrashRetention, "trash-retention", 30*24*time.Hour, "how long deleted movies stay in the trash before they can be purged")
+	flag.DurationVar(&app.RevocationReload, "revocation-reload", 30*time.Second, "how often revoked access tokens are read from the database")
+	flag.StringVar(&app.PublicURL, "public-url", "http://localhost:8080", "URL the api is reached at, used in the links sent by email")
+	flag.StringVar(&app.FrontendURL, "frontend-url", "http://localhost:3000", "URL of the front-end, used in the links sent by email")
+	flag.StringVar(&app.Mailer, "mailer", "file", "how emails are sent (file or smtp)")
+	flag.StringVar(&app.MailFrom, "mail-from", "Go Movies <no-reply@example.com>", "sender of the emails")
+	flag.StringVar(&app.MailDir, "mail-dir", "", "directory the file mailer writes emails to, the log when empty")
+	flag.StringVar(&app.SMTP.Addr, "smtp-addr", "localhost:25", "SMTP server (host:port)")
+	flag.StringVar(&app.SMTP.Username, "smtp-username", "", "SMTP user, no authentication when empty")
+	flag.StringVar(&app.SMTP.Password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&app.WebAuthnOrigin, "webauthn-origin", "", "origin of the pages passkeys are used on, -frontend-url when empty")
+	flag.StringVar(&app.WebAuthnRPID, "webauthn-rp-id", "", "domain passkeys are registered with, the host of -webauthn-origin when empty")
+	flag.StringVar(&app.OIDCIssuer, "oidc-issuer", "", "issuer URL of the OpenID Connect provider for single sign-on, disabled when empty")
+	flag.StringVar(&app.OIDCClientID, "oidc-client-id", "", "client id registered with the OpenID Connect provider")
+	flag.StringVar(&app.OIDCClientSecret, "oidc-client-secret", "", "client secret, empty for a public client")
+	flag.StringVar(&app.OIDCRedirectURL, "oidc-redirect-url", "", "callback registered with the provider, -public-url + /auth/oidc/callback when empty")
+	flag.StringVar(&app.OIDCScopes, "oidc-scopes", "openid email profile", "scopes asked from the OpenID Connect provider")
+	flag.StringVar(&app.OIDCRole, "oidc-role", models.RoleViewer, "role of the users created on their first single sign-on")
+	flag.IntVar(&app.LoginMaxFailures, "login-max-failures", 10, "failed logins of an email before it is locked out")
+	flag.IntVar(&app.LoginMaxIPFailures, "login-max-ip-failures", 100, "failed logins from a client address before it is locked out")
+	flag.DurationVar(&app.LoginLockout, "login-lockout", 15*time.Minute, "how long an email or a client address is locked out after too many failed logins")
+	flag.StringVar(&app.TrustedProxies, "trusted-proxies", "", "comma separated addresses or CIDR ranges of the proxies in front of the api, whose X-Forwarded-For is believed")
 	flag.Parse()
 
-	// connect to the database
-	//if nil then, the whole app crashed so log.Fatal()
-	conn, err := app.connectToDB()
-	if err != nil {
-		log.Fatal(err)
+	// `api migrate ...` manages the schema and exits instead of starting the server
+	if flag.Arg(0) == "migrate" {
+		err := app.migrate(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
 
-	//defer: when the function ends, the DB closes
-	defer app.DB.Connection().Close()
+	switch app.DBDriver {
+	case "postgres":
+		// connect to the database
+		//if nil then, the whole app crashed so log.Fatal()
+		conn, err := app.connectToDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.DB = &dbrepo.PostgresDBRepo{DB: conn, Timeouts: app.DBTimeouts}
+
+		//defer: when the function ends, the DB closes
+		defer app.DB.Connection().Close()
+	case "memory":
+		// keep everything in memory, no Postgres required
+		repo, err := app.connectToMemoryDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.DB = repo
+	default:
+		log.Fatalf("unknown database repository %q", app.DBDriver)
+	}
+
+	switch app.Mailer {
+	case "file":
+		app.mailer = &mailer.FileMailer{Dir: app.MailDir, From: app.MailFrom}
+	case "smtp":
+		app.SMTP.From = app.MailFrom
+		app.mailer = &app.SMTP
+	default:
+		log.Fatalf("unknown mailer %q", app.Mailer)
+	}
 
 	app.auth = Auth{
 		Issuer:        app.JWTIssuer,
@@ -55,11 +173,56 @@ func main() {
 		Secret:        app.JWTSecret,
 		TokenExpiry:   time.Minute * 15,
 		RefreshExpiry: time.Hour * 24,
+		ClockSkew:     app.JWTClockSkew,
 		CookieDomain:  app.CookieDomain,
 		CookiePath:    "/",
 		CookieName:    "__Host-refresh_token",
 	}
 
+	if app.JWTKeys != "" {
+		// replaced keys keep verifying as long as the longest lived token they signed
+		keys, err := jwtkeys.New(app.JWTKeys, app.JWTAlgorithm, app.JWTRotation, app.auth.RefreshExpiry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.auth.Keys = keys
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go keys.Run(time.Minute, stop)
+	}
+
+	trustedProxies, err := parseTrustedProxies(app.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.trustedProxies = trustedProxies
+
+	relyingParty, err := app.newRelyingParty()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.relyingParty = relyingParty
+
+	// the discovery document of the provider is read once, at startup
+	app.oidc, err = app.newOIDCProvider(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// every instance reloads the list, so a revocation applies everywhere within RevocationReload
+	app.revoked = newRevocationList()
+	err = app.revoked.load(context.Background(), app.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopRevocations := make(chan struct{})
+	defer close(stopRevocations)
+	go app.revoked.Run(app.DB, app.RevocationReload, stopRevocations)
+
+	app.suggestions = cache.New[[]*models.MovieSuggestion](app.SuggestCacheTTL, 1000)
+
 	log.Println("Starting application on port", port)
 
 	// start a web server
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"backend/internal/cache"
+	"backend/internal/mailer"
+	"backend/internal/models"
+	"backend/internal/repository/dbrepo"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password of the users created by newTestUser
+const testPassword = "s3cret-password"
+
+// testApp is an application on the memory repository, seeded with sql/seed.json, and its routes
+type testApp struct {
+	*application
+	repo    *dbrepo.MemoryDBRepo
+	mail    *testMailer
+	handler http.Handler
+}
+
+// testMailer keeps the messages sent, most are sent in the background after the answer
+type testMailer struct {
+	sent chan mailer.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent <- msg
+	return nil
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	repo := dbrepo.NewMemoryDBRepo()
+	err := repo.LoadFixture("../../sql/seed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mail := &testMailer{sent: make(chan mailer.Message, 100)}
+	app := &application{
+		DB:                 repo,
+		JWTClockSkew:       30 * time.Second,
+		PublicURL:          "http://api.test",
+		FrontendURL:        "http://front.test",
+		mailer:             mail,
+		revoked:            newRevocationList(),
+		SuggestTimeout:     time.Second,
+		suggestions:        cache.New[[]*models.MovieSuggestion](time.Second, 10),
+		LoginMaxFailures:   10,
+		LoginMaxIPFailures: 100,
+		LoginLockout:       15 * time.Minute,
+		OIDCRole:           models.RoleViewer,
+	}
+	app.auth = Auth{
+		Issuer:        "api.test",
+		Audience:      "api.test",
+		Secret:        "test-secret",
+		TokenExpiry:   15 * time.Minute,
+		RefreshExpiry: 24 * time.Hour,
+		ClockSkew:     app.JWTClockSkew,
+		CookieDomain:  "api.test",
+		CookiePath:    "/",
+		CookieName:    "__Host-refresh_token",
+	}
+
+	app.relyingParty, err = app.newRelyingParty()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testApp{application: app, repo: repo, mail: mail, handler: app.routes()}
+}
+
+// newTestUser creates a verified user with role and testPassword, hashed at the lowest cost to keep tests fast
+func (ta *testApp) newTestUser(t *testing.T, email string, role string) *models.User {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	user := models.User{
+		FirstName:       "Test",
+		Lastname:        "User",
+		Email:           email,
+		Role:            role,
+		Password:        string(hash),
+		CreatedAt:       now,
+		UpdateAt:        now,
+		EmailVerifiedAt: &now,
+	}
+
+	user.ID, err = ta.repo.InsertUser(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+// request sends a request to the routes, body encoded as JSON unless it is nil.
+// Headers come in pairs of name and value.
+func (ta *testApp) request(t *testing.T, method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&buf).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	ta.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// logIn logs in with testPassword at /auth and returns the access token
+func (ta *testApp) logIn(t *testing.T, email string) string {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodPost, "/auth", map[string]string{"email": email, "password": testPassword})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login of %s: %d %s", email, rec.Code, rec.Body)
+	}
+
+	var tokens TokenPairs
+	decode(t, rec, &tokens)
+	return tokens.Token
+}
+
+// linkToken waits for the next email, which must be to the address to, and returns the token of its link
+func (ta *testApp) linkToken(t *testing.T, to string) string {
+	t.Helper()
+
+	select {
+	case msg := <-ta.mail.sent:
+		if msg.To != to {
+			t.Fatalf("email to %s, want %s", msg.To, to)
+		}
+		match := regexp.MustCompile(`[?&]token=([^&\s]+)`).FindStringSubmatch(msg.Body)
+		if match == nil {
+			t.Fatalf("no link in %q", msg.Body)
+		}
+		token, err := url.QueryUnescape(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	case <-time.After(time.Second):
+		t.Fatalf("no email to %s", to)
+		return ""
+	}
+}
+
+// noMail checks nothing was emailed, giving the background senders a moment
+func (ta *testApp) noMail(t *testing.T) {
+	t.Helper()
+
+	select {
+	case msg := <-ta.mail.sent:
+		t.Fatalf("email to %s: %s", msg.To, msg.Subject)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, dst interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(rec.Body.Bytes(), dst)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+}
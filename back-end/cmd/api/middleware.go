@@ -1,16 +1,31 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// type of the keys this package stores in a request context, so they never collide with other packages
+type contextKey string
+
+// the verified JWT claims of the caller, set by authRequired
+const claimsKey contextKey = "claims"
 
 // modify the request from HTTP
 func (app *application) enableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://*")
+		// the admin pages read the ETag of a movie to send it back in If-Match
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == "OPTIONS" {
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization, If-Match, X-API-Key")
 			return
 		} else {
 			h.ServeHTTP(w, r)
@@ -18,13 +33,100 @@ func (app *application) enableCORS(h http.Handler) http.Handler {
 	})
 }
 
+// realIP sets the client address of requests from a trusted proxy to the one it forwards them for:
+// the last address of X-Forwarded-For that is not a trusted proxy, as the ones before it can be
+// made up by the client. Requests from anywhere else keep their remote address.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.trustedProxy(clientIP(r)) {
+			forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(forwarded) - 1; i >= 0; i-- {
+				addr := strings.TrimSpace(forwarded[i])
+				if net.ParseIP(addr) == nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(addr, "0")
+				if !app.trustedProxy(addr) {
+					break
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authRequired lets through requests with a valid bearer token, or with an API key in X-API-Key
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+		w.Header().Add("Vary", "X-API-Key")
+
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			claims, err := app.apiKeyClaims(r, key)
+			if err != nil {
+				app.errorJSON(w, err, http.StatusUnauthorized)
+				return
+			}
+
+			// API keys are revoked on their own, the revocation list is about tokens
+			ctx := context.WithValue(r.Context(), claimsKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		_, claims, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			app.unauthorized(w, err)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		// a valid signature is not enough, the token may have been revoked before it expires
+		if app.revoked.Revoked(claims) {
+			app.unauthorized(w, ErrTokenRevoked)
+			return
+		}
+
+		// make the claims available to the handlers
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// reject a request whose bearer token is missing or invalid, telling the client why in WWW-Authenticate
+func (app *application) unauthorized(w http.ResponseWriter, err error) {
+	challenge, status := app.auth.Challenge(err)
+	w.Header().Set("WWW-Authenticate", challenge)
+	app.errorJSON(w, tokenReason(err), status)
+}
+
+// requirePermission only lets through callers whose token grants permission.
+// It runs after authRequired: a missing or invalid token is a 401, a valid token without the permission a 403.
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(claimsKey).(*Claims)
+			if !ok {
+				app.unauthorized(w, ErrTokenMissing)
+				return
+			}
+
+			if !claims.HasPermission(permission) {
+				w.Header().Set("WWW-Authenticate", app.auth.InsufficientScope(permission))
+				app.errorJSON(w, fmt.Errorf("you need the %s permission", permission), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// id of the authenticated user (the JWT subject), 0 outside of authRequired routes
+func (app *application) currentUserID(r *http.Request) int {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		return 0
+	}
+
+	id, _ := strconv.Atoi(claims.Subject)
+	return id
+}
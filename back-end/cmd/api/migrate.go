@@ -0,0 +1,122 @@
+package main
+
+import (
+	"backend/internal/migrate"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const migrateUsage = `usage: api [flags] migrate <command>
+
+commands:
+  up                apply every pending migration
+  down [n]          revert the last n migrations (default 1)
+  status            list migrations and whether they are applied
+  create [-dir d] <name>
+                    write an empty pair of migration files`
+
+// handle `api migrate ...`, args are the arguments after "migrate"
+func (app *application) migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	// create only writes files, it does not need a database
+	if args[0] == "create" {
+		fs := flag.NewFlagSet("create", flag.ContinueOnError)
+		dir := fs.String("dir", "internal/migrate/migrations", "directory of the migration files")
+		err := fs.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New(migrateUsage)
+		}
+
+		up, down, err := migrate.Create(*dir, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		log.Println("Created", up)
+		log.Println("Created", down)
+		return nil
+	}
+
+	conn, err := app.connectToDB()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	migrator, err := migrate.New(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		done, err := migrator.Up(ctx)
+		for _, m := range done {
+			log.Printf("Applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			log.Println("Database is up to date")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+
+		done, err := migrator.Down(ctx, steps)
+		for _, m := range done {
+			log.Printf("Reverted %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			log.Println("No migrations to revert")
+		}
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+		for _, s := range statuses {
+			status := "pending"
+			if s.Applied {
+				status = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Modified {
+				status += " (modified since applied!)"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, status)
+		}
+		return tw.Flush()
+
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/oidc"
+	"backend/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how long a login sent to the provider has to come back to the callback
+const oidcLoginExpiry = 10 * time.Minute
+
+// cookie tying the callback to the browser that started the login, against login CSRF
+const oidcStateCookie = "oidc_state"
+
+var (
+	errOIDCDisabled     = errors.New("single sign-on is not configured")
+	errOIDCEmail        = errors.New("the provider did not send a verified email address")
+	errOIDCUserDisabled = errors.New("account is disabled")
+)
+
+// the OpenID Connect provider users log in with, nil when -oidc-issuer is empty
+func (app *application) newOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+	if app.OIDCIssuer == "" {
+		return nil, nil
+	}
+
+	if app.OIDCClientID == "" {
+		return nil, errors.New("-oidc-client-id is required with -oidc-issuer")
+	}
+
+	redirectURL := app.OIDCRedirectURL
+	if redirectURL == "" {
+		redirectURL = app.PublicURL + "/auth/oidc/callback"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return oidc.New(ctx, oidc.Config{
+		Issuer:       app.OIDCIssuer,
+		ClientID:     app.OIDCClientID,
+		ClientSecret: app.OIDCClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Fields(app.OIDCScopes),
+		ClockSkew:    app.JWTClockSkew,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	})
+}
+
+// the cookie holding the state of a login, sent back on the redirect from the provider:
+// Lax since that redirect comes from another site, and only to the callback
+func oidcCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/auth/oidc",
+		Value:    value,
+		MaxAge:   maxAge,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	}
+}
+
+// the user the account of the provider is linked to. An account seen for the first time is linked
+// to the user with its email, when the provider verified it, or else to a new user created for it.
+// A disabled user is refused before anything is written, their account is not linked.
+func (app *application) oidcUser(r *http.Request, repo repository.DatabaseRepo, claims *oidc.Claims) (*models.User, error) {
+	ctx := r.Context()
+	now := time.Now()
+
+	identity, err := repo.GetUserIdentity(ctx, app.OIDCIssuer, claims.Subject)
+	if err == nil {
+		user, err := repo.GetUserByID(ctx, identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user.DisabledAt != nil {
+			return nil, errOIDCUserDisabled
+		}
+
+		err = repo.RecordIdentityLogin(ctx, identity.ID, claims.Email, now)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// an unverified email could be anyone's, linking it would hand them the account
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return nil, errOIDCEmail
+	}
+
+	event := models.AuthEventSSOLinked
+
+	user, err := repo.GetUserByEmail(ctx, claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = app.provisionOIDCUser(ctx, repo, claims)
+		event = models.AuthEventSSOProvisioned
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, errOIDCUserDisabled
+	}
+
+	_, err = repo.InsertUserIdentity(ctx, models.UserIdentity{
+		UserID:      user.ID,
+		Issuer:      app.OIDCIssuer,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		CreatedAt:   now,
+		LastLoginAt: &now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the provider verified the address, the link of the verification email is not needed anymore
+	if user.EmailVerifiedAt == nil {
+		err = repo.SetEmailVerified(ctx, user.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		user.EmailVerifiedAt = &now
+	}
+
+	err = repo.InsertAuthEvent(ctx, models.AuthEvent{
+		UserID:    user.ID,
+		Event:     event,
+		IP:        clientIP(r),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// create the user of an account of the provider, with -oidc-role and without a password
+func (app *application) provisionOIDCUser(ctx context.Context, repo repository.DatabaseRepo, claims *oidc.Claims) (*models.User, error) {
+	email, err := repository.ValidEmail(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	firstName, lastName := strings.TrimSpace(claims.GivenName), strings.TrimSpace(claims.FamilyName)
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(strings.TrimSpace(claims.Name), " ")
+	}
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(email, "@")
+	}
+
+	now := time.Now()
+	user := models.User{
+		FirstName:       firstName,
+		Lastname:        strings.TrimSpace(lastName),
+		Email:           email,
+		Role:            app.OIDCRole,
+		CreatedAt:       now,
+		UpdateAt:        now,
+		EmailVerifiedAt: &now,
+	}
+
+	user.ID, err = repo.InsertUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
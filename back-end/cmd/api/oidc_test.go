@@ -0,0 +1,212 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/oidc/oidctest"
+	"backend/internal/totp"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableOIDC starts a mock provider and logs users in with it
+func (ta *testApp) enableOIDC(t *testing.T) *oidctest.Provider {
+	t.Helper()
+
+	mock, err := oidctest.Start("movies", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mock.Close)
+
+	ta.OIDCIssuer = mock.Issuer
+	ta.OIDCClientID = "movies"
+	ta.OIDCClientSecret = "secret"
+	ta.OIDCScopes = "openid email profile"
+
+	ta.oidc, err = ta.newOIDCProvider(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock
+}
+
+// oidcLogin runs a login from /auth/oidc/login to the callback, with the state cookie of cookie
+// when it is not empty, and returns the answer of the callback
+func (ta *testApp) oidcLogin(t *testing.T, cookie string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodGet, "/auth/oidc/login", nil)
+	if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), ta.OIDCIssuer+"/authorize?") {
+		t.Fatalf("login: status %d, redirected to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if cookie == "" {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == oidcStateCookie {
+				cookie = c.Value
+			}
+		}
+	}
+
+	// the provider logs the user in at once and sends the browser back to the callback
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := res.Location()
+	if err != nil || !strings.HasPrefix(callback.String(), ta.PublicURL+"/auth/oidc/callback?") {
+		t.Fatalf("provider: %s, redirected to %v", res.Status, callback)
+	}
+
+	return ta.request(t, http.MethodGet, callback.RequestURI(), nil, "Cookie", oidcStateCookie+"="+cookie)
+}
+
+func TestOIDCProvisionsNewUser(t *testing.T) {
+	ta := newTestApp(t)
+	mock := ta.enableOIDC(t)
+	mock.SetUser(oidctest.User{Subject: "new", Email: "new@example.com", EmailVerified: true, GivenName: "New", FamilyName: "User"})
+
+	rec := ta.oidcLogin(t, "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != ta.FrontendURL+"/" {
+		t.Fatalf("callback: status %d, redirected to %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	refreshed := false
+	for _, c := range rec.Result().Cookies() {
+		refreshed = refreshed || c.Name == ta.auth.CookieName && c.Value != ""
+	}
+	if !refreshed {
+		t.Fatalf("no refresh cookie: %v", rec.Header()["Set-Cookie"])
+	}
+
+	user, err := ta.repo.GetUserByEmail(context.Background(), "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != ta.OIDCRole || user.Password != "" || user.EmailVerifiedAt == nil || user.FirstName != "New" {
+		t.Fatalf("provisioned %+v", user)
+	}
+
+	identity, err := ta.repo.GetUserIdentity(context.Background(), mock.Issuer, "new")
+	if err != nil || identity.UserID != user.ID {
+		t.Fatalf("identity %+v: %v", identity, err)
+	}
+}
+
+func TestOIDCLinksExistingUser(t *testing.T) {
+	ta := newTestApp(t)
+	mock := ta.enableOIDC(t)
+	existing := ta.newTestUser(t, "linked@example.com", models.RoleEditor)
+	mock.SetUser(oidctest.User{Subject: "linked", Email: "linked@example.com", EmailVerified: true})
+
+	// the second login finds the account by its identity
+	for i := 0; i < 2; i++ {
+		rec := ta.oidcLogin(t, "")
+		if rec.Code != http.StatusFound {
+			t.Fatalf("login %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+
+	identity, err := ta.repo.GetUserIdentity(context.Background(), mock.Issuer, "linked")
+	if err != nil || identity.UserID != existing.ID {
+		t.Fatalf("identity %+v: %v", identity, err)
+	}
+
+	user, err := ta.repo.GetUserByID(context.Background(), existing.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != models.RoleEditor || user.Password != existing.Password {
+		t.Fatalf("linked user changed: %+v", user)
+	}
+}
+
+func TestOIDCRejectsUnverifiedEmail(t *testing.T) {
+	ta := newTestApp(t)
+	mock := ta.enableOIDC(t)
+	existing := ta.newTestUser(t, "victim@example.com", models.RoleAdmin)
+
+	// anyone can claim an address at some providers, it must not hand them the account
+	mock.SetUser(oidctest.User{Subject: "attacker", Email: "victim@example.com", EmailVerified: false})
+
+	rec := ta.oidcLogin(t, "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	_, err := ta.repo.GetUserIdentity(context.Background(), mock.Issuer, "attacker")
+	if err == nil {
+		t.Fatalf("account of %d linked", existing.ID)
+	}
+}
+
+func TestOIDCCallbackNeedsState(t *testing.T) {
+	ta := newTestApp(t)
+	ta.enableOIDC(t)
+
+	// a callback started in another browser, as in a login CSRF
+	rec := ta.oidcLogin(t, "another-state")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOIDCRejectsDisabledUser(t *testing.T) {
+	ta := newTestApp(t)
+	mock := ta.enableOIDC(t)
+	existing := ta.newTestUser(t, "disabled@example.com", models.RoleEditor)
+	mock.SetUser(oidctest.User{Subject: "disabled", Email: "disabled@example.com", EmailVerified: true})
+
+	now := time.Now()
+	err := ta.repo.SetUserDisabled(context.Background(), existing.ID, &now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ta.oidcLogin(t, "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	// refused before the account is linked
+	_, err = ta.repo.GetUserIdentity(context.Background(), mock.Issuer, "disabled")
+	if err == nil {
+		t.Fatal("account of a disabled user linked")
+	}
+}
+
+func TestOIDCNeedsSecondFactor(t *testing.T) {
+	ta := newTestApp(t)
+	mock := ta.enableOIDC(t)
+	secret := ta.newTwoFactorUser(t, "2fa@example.com")
+	mock.SetUser(oidctest.User{Subject: "2fa", Email: "2fa@example.com", EmailVerified: true})
+
+	rec := ta.oidcLogin(t, "")
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), ta.FrontendURL+"/login#") {
+		t.Fatalf("status %d, redirected to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == ta.auth.CookieName && c.Value != "" {
+			t.Fatal("refresh cookie set before the second factor")
+		}
+	}
+
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := ta.twoFactor(t, fragment.Get("challenge"), code); status != http.StatusAccepted {
+		t.Fatalf("second factor: status %d", status)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/repository"
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// revocationList is the revoked_tokens table held in memory, so authRequired does not query it on every request.
+// It is reloaded every interval, which is how revocations made by other instances of the API apply here too.
+type revocationList struct {
+	mu    sync.RWMutex
+	jtis  map[string]time.Time // jti -> when the token expires
+	users map[int]time.Time    // user id -> tokens issued before this second are revoked
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		jtis:  make(map[string]time.Time),
+		users: make(map[int]time.Time),
+	}
+}
+
+// Revoked tells whether the access token with claims was revoked
+func (l *revocationList) Revoked(claims *Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.jtis[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+
+	userID, _ := strconv.Atoi(claims.Subject)
+	before, ok := l.users[userID]
+	if !ok {
+		return false
+	}
+
+	// iat only has a precision of a second, before is truncated to it: a token issued in the second of the
+	// revocation is kept, so the user can log in again right away, at the cost of one issued earlier in that second
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(before)
+}
+
+// add an entry right away, without waiting for the next reload
+func (l *revocationList) add(token models.RevokedToken) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.addLocked(token)
+}
+
+func (l *revocationList) addLocked(token models.RevokedToken) {
+	if token.JTI != "" {
+		l.jtis[token.JTI] = token.ExpiresAt
+		return
+	}
+
+	before := token.IssuedBefore.Truncate(time.Second)
+	if current, ok := l.users[token.UserID]; !ok || before.After(current) {
+		l.users[token.UserID] = before
+	}
+}
+
+// load replaces the list with the entries of the database still in effect
+func (l *revocationList) load(ctx context.Context, repo repository.DatabaseRepo) error {
+	tokens, err := repo.RevokedTokens(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.jtis = make(map[string]time.Time, len(tokens))
+	l.users = make(map[int]time.Time)
+	for _, token := range tokens {
+		l.addLocked(*token)
+	}
+	return nil
+}
+
+// Run drops the expired entries from the database and reloads the list every interval, until stop is closed
+func (l *revocationList) Run(repo repository.DatabaseRepo, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+
+			_, err := repo.DeleteExpiredRevokedTokens(ctx, time.Now())
+			if err != nil {
+				log.Println("revoked tokens:", err)
+			}
+
+			err = l.load(ctx, repo)
+			if err != nil {
+				log.Println("revoked tokens:", err)
+			}
+		}
+	}
+}
+
+// revoke one access token. Its expiry is not known from the jti alone, so the entry lasts as long as a new token.
+// The revocation is only in the database of repo: apply adds it to the list held in memory, and is called
+// once repo is committed, so a transaction rolled back does not leave a token revoked here.
+func (app *application) revokeAccessToken(ctx context.Context, repo repository.DatabaseRepo, jti string, expiresAt time.Time) (apply func(), err error) {
+	token := models.RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+		RevokedAt: time.Now(),
+	}
+
+	err = repo.InsertRevokedToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { app.revoked.add(token) }, nil
+}
+
+// use up a single-use token, such as a two-factor challenge, sql.ErrNoRows when it was used already
+func (app *application) consumeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	token := models.RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+		RevokedAt: time.Now(),
+	}
+
+	err := app.DB.ConsumeToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	app.revoked.add(token)
+	return nil
+}
+
+// revoke every access token issued to a user until now, apply is called once repo is committed
+func (app *application) revokeUserAccessTokens(ctx context.Context, repo repository.DatabaseRepo, userID int) (apply func(), err error) {
+	now := time.Now()
+	token := models.RevokedToken{
+		UserID:       userID,
+		IssuedBefore: &now,
+		ExpiresAt:    now.Add(app.auth.TokenExpiry),
+		RevokedAt:    now,
+	}
+
+	err = repo.InsertRevokedToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { app.revoked.add(token) }, nil
+}
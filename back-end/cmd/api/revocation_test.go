@@ -0,0 +1,87 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/repository"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestRevokeAppliedAfterCommit(t *testing.T) {
+	ta := newTestApp(t)
+	user := ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+
+	claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:  strconv.Itoa(user.ID),
+		IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}}
+
+	rollback := errors.New("rollback")
+	var revoke func()
+	err := ta.DB.WithTx(context.Background(), func(repo repository.DatabaseRepo) error {
+		var err error
+		revoke, err = ta.revokeUserAccessTokens(context.Background(), repo, user.ID)
+		if err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("got %v, want the rollback", err)
+	}
+	if ta.revoked.Revoked(claims) {
+		t.Fatal("revoked by a transaction rolled back")
+	}
+
+	// what the handlers do once the transaction is committed
+	revoke()
+	if !ta.revoked.Revoked(claims) {
+		t.Fatal("not revoked once applied")
+	}
+}
+
+func TestRevokedInTheSecondOfTheRevocation(t *testing.T) {
+	l := newRevocationList()
+	now := time.Now()
+	l.add(models.RevokedToken{UserID: 1, IssuedBefore: &now, RevokedAt: now})
+
+	issued := func(at time.Time) *Claims {
+		return &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "1", IssuedAt: jwt.NewNumericDate(at)}}
+	}
+
+	if !l.Revoked(issued(now.Add(-time.Second))) {
+		t.Fatal("token of the second before not revoked")
+	}
+	if l.Revoked(issued(now)) {
+		t.Fatal("token of the second of the revocation revoked, as a login right after it")
+	}
+	if l.Revoked(issued(now.Add(time.Second))) {
+		t.Fatal("token issued after revoked")
+	}
+	if !l.Revoked(&Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}}) {
+		t.Fatal("token without iat not revoked")
+	}
+}
+
+func TestLoginRightAfterRevocation(t *testing.T) {
+	ta := newTestApp(t)
+	user := ta.newTestUser(t, "viewer@example.com", models.RoleViewer)
+
+	revoke, err := ta.revokeUserAccessTokens(context.Background(), ta.DB, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoke()
+
+	// as after a password reset: the new session works at once
+	token := ta.logIn(t, "viewer@example.com")
+	if rec := ta.request(t, http.MethodGet, "/admin/movies", nil, bearer(token)...); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -12,15 +12,43 @@ func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	mux.Use(middleware.Recoverer)
+	mux.Use(app.realIP)
 	//mux.Use(app.enableCORS)
 
 	mux.Get("/", app.Home)
 
 	mux.Post("/auth", app.authenticate)
+	mux.Post("/auth/register", app.register)
+	mux.Get("/auth/verify-email", app.verifyEmail)
+	mux.Post("/auth/verify-email/resend", app.resendVerification)
+	mux.Post("/auth/forgot-password", app.forgotPassword)
+	mux.Post("/auth/reset-password", app.resetPassword)
+	mux.Post("/auth/magic-link", app.magicLink)
+	mux.Get("/auth/magic-link/verify", app.verifyMagicLink)
+	mux.Post("/auth/2fa", app.twoFactorLogin)
+	mux.Post("/auth/webauthn/login/begin", app.beginWebAuthnLogin)
+	mux.Post("/auth/webauthn/login/finish", app.finishWebAuthnLogin)
+	mux.Get("/auth/oidc/login", app.oidcLogin)
+	mux.Get("/auth/oidc/callback", app.oidcCallback)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.authRequired)
+
+		mux.Post("/auth/2fa/setup", app.setupTwoFactor)
+		mux.Post("/auth/2fa/confirm", app.confirmTwoFactor)
+		mux.Post("/auth/2fa/disable", app.disableTwoFactor)
+
+		mux.Post("/auth/webauthn/register/begin", app.beginWebAuthnRegistration)
+		mux.Post("/auth/webauthn/register/finish", app.finishWebAuthnRegistration)
+		mux.Get("/auth/webauthn/credentials", app.webAuthnCredentials)
+		mux.Delete("/auth/webauthn/credentials/{id}", app.deleteWebAuthnCredential)
+	})
 	mux.Get("/refresh", app.refreshToken)
 	mux.Get("/logout", app.logout)
+	mux.Get("/.well-known/jwks.json", app.JWKS)
 
 	mux.Get("/movies", app.AllMovies)
+	mux.Get("/movies/search", app.SearchMovies)
+	mux.Get("/movies/suggest", app.SuggestMovies)
 	mux.Get("/movies/{id}", app.GetMovie)
 	mux.Get("/genres", app.AllGenres)
 	mux.Get("/movies/genres/{id}", app.AllMoviesByGenre)
@@ -30,13 +58,58 @@ func (app *application) routes() http.Handler {
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.authRequired)
 
-		mux.Get("/movies", app.MovieCatalog)
+		// every route checks its own permission, see the roles_permissions table
+		read := app.requirePermission("movies:read")
+		write := app.requirePermission("movies:write")
+		del := app.requirePermission("movies:delete")
+
+		mux.With(read).Get("/movies", app.MovieCatalog)
+
+		mux.With(read).Get("/movies/trash", app.MovieTrash)
+		mux.With(del).Delete("/movies/trash", app.PurgeTrash)
+		mux.With(write).Post("/movies/{id}/restore", app.RestoreMovie)
+
+		mux.With(read).Get("/movies/{id}/revisions", app.MovieRevisions)
+		mux.With(read).Get("/movies/{id}/revisions/diff", app.MovieRevisionDiff)
+		mux.With(write).Post("/movies/{id}/revisions/{revision}/rollback", app.RollbackMovie)
+
+		mux.With(read).Get("/movies/{id}", app.MovieForEdit)
+
+		mux.With(write).Put("/movies/0", app.InsertMovie)
+		mux.With(write).Patch("/movies/{id}", app.UpdateMovie)
+		mux.With(del).Delete("/movies/{id}", app.DeleteMovie)
+
+		genres := app.requirePermission("genres:write")
+
+		mux.With(genres).Post("/genres", app.InsertGenre)
+		mux.With(genres).Patch("/genres/{id}", app.RenameGenre)
+		mux.With(genres).Post("/genres/{id}/merge", app.MergeGenre)
+		mux.With(genres).Delete("/genres/{id}", app.DeleteGenre)
+
+		usersRead := app.requirePermission("users:read")
+		usersWrite := app.requirePermission("users:write")
+
+		mux.With(usersRead).Get("/roles", app.AllRoles)
+
+		mux.With(usersRead).Get("/users", app.AllUsers)
+		mux.With(usersWrite).Post("/users", app.InsertUser)
+		mux.With(usersRead).Get("/users/{id}", app.GetUser)
+		mux.With(usersWrite).Patch("/users/{id}", app.UpdateUser)
+		mux.With(usersWrite).Put("/users/{id}/role", app.SetUserRole)
+		mux.With(usersWrite).Post("/users/{id}/disable", app.DisableUser)
+		mux.With(usersWrite).Post("/users/{id}/enable", app.EnableUser)
+		mux.With(usersWrite).Delete("/users/{id}", app.DeleteUser)
+		mux.With(usersRead).Get("/users/{id}/events", app.UserAuthEvents)
+		mux.With(usersWrite).Delete("/users/{id}/2fa", app.ResetUserTwoFactor)
+		mux.With(usersWrite).Post("/users/{id}/revoke-tokens", app.RevokeUserTokens)
+		mux.With(usersWrite).Post("/tokens/{jti}/revoke", app.RevokeToken)
 
-		mux.Get("/movies/{id}", app.MovieForEdit)
+		mux.With(usersRead).Get("/lockouts", app.LoginLockouts)
+		mux.With(usersWrite).Delete("/lockouts/{id}", app.ClearLoginLockout)
 
-		mux.Put("/movies/0", app.InsertMovie)
-		mux.Patch("/movies/{id}", app.UpdateMovie)
-		mux.Delete("/movies/{id}", app.DeleteMovie)
+		mux.With(usersRead).Get("/api-keys", app.AllAPIKeys)
+		mux.With(usersWrite).Post("/api-keys", app.InsertAPIKey)
+		mux.With(usersWrite).Delete("/api-keys/{id}", app.RevokeAPIKey)
 
 	})
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"backend/internal/models"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failed logins are forgotten after this long without another
+const loginFailureWindow = 24 * time.Hour
+
+// first wait between two tries once the free failures are spent, doubled at each failure
+const loginBackoffBase = time.Second
+
+var errLoginThrottled = errors.New("too many failed logins, try again later")
+
+// how many failed logins a key is allowed before it has to wait, and before it is locked out
+type loginPolicy struct {
+	FreeFailures int
+	MaxFailures  int
+	Lockout      time.Duration
+}
+
+// how long a key has to wait after its nth failure: nothing for the free failures,
+// then 1s, 2s, 4s... and the lockout from MaxFailures on
+func (p loginPolicy) backoff(failures int) time.Duration {
+	switch {
+	case failures >= p.MaxFailures:
+		return p.Lockout
+	case failures <= p.FreeFailures:
+		return 0
+	}
+
+	// compared before the conversion, a long backoff would overflow a Duration
+	wait := float64(loginBackoffBase) * math.Pow(2, float64(failures-p.FreeFailures-1))
+	if wait > float64(p.Lockout) {
+		return p.Lockout
+	}
+	return time.Duration(wait)
+}
+
+// the policy of a kind of key. Many users can share a client address, behind a company proxy,
+// so an address gets half of its failures free
+func (app *application) loginPolicy(kind string) loginPolicy {
+	if kind == models.LoginThrottleIP {
+		return loginPolicy{FreeFailures: app.LoginMaxIPFailures / 2, MaxFailures: app.LoginMaxIPFailures, Lockout: app.LoginLockout}
+	}
+	return loginPolicy{FreeFailures: 3, MaxFailures: app.LoginMaxFailures, Lockout: app.LoginLockout}
+}
+
+// the key of the failed logins of an email, whether an account has it or not
+func loginAccountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// how long until the email and the client address can try to log in again, 0 when they can now
+func (app *application) loginRetryAfter(ctx context.Context, email string, ip string) (time.Duration, error) {
+	throttles, err := app.DB.LoginThrottles(ctx, loginAccountKey(email), ip)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, throttle := range throttles {
+		if throttle.LockedUntil != nil && throttle.LockedUntil.Sub(now) > wait {
+			wait = throttle.LockedUntil.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+// answer 429 with a Retry-After header when the email or the client address has to wait, telling whether it did
+func (app *application) loginThrottled(w http.ResponseWriter, r *http.Request, email string, ip string) bool {
+	wait, err := app.loginRetryAfter(r.Context(), email, ip)
+	if err != nil {
+		app.errorJSON(w, err)
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	app.errorJSON(w, errLoginThrottled, http.StatusTooManyRequests)
+	return true
+}
+
+// count a failed login against the email and the client address, and make them wait
+func (app *application) recordLoginFailure(ctx context.Context, email string, ip string) error {
+	now := time.Now()
+
+	for _, key := range []struct{ kind, value string }{
+		{models.LoginThrottleAccount, loginAccountKey(email)},
+		{models.LoginThrottleIP, ip},
+	} {
+		throttle, err := app.DB.RecordLoginFailure(ctx, key.kind, key.value, now, now.Add(-loginFailureWindow))
+		if err != nil {
+			return err
+		}
+
+		wait := app.loginPolicy(key.kind).backoff(throttle.Failures)
+		if wait > 0 {
+			err = app.DB.LockLogin(ctx, throttle.ID, now.Add(wait))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
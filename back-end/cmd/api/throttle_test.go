@@ -0,0 +1,159 @@
+package main
+
+import (
+	"backend/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	p := loginPolicy{FreeFailures: 3, MaxFailures: 10, Lockout: 15 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, 15 * time.Minute},
+		{50, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := p.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff after %d failures: %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// the backoff never waits longer than the lockout
+	p.MaxFailures = 100
+	if got := p.backoff(40); got != p.Lockout {
+		t.Errorf("backoff after 40 failures: %v, want %v", got, p.Lockout)
+	}
+}
+
+func (ta *testApp) authenticate(t *testing.T, email, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	return ta.request(t, http.MethodPost, "/auth", map[string]string{"email": email, "password": password})
+}
+
+func TestLoginLockout(t *testing.T) {
+	ta := newTestApp(t)
+	ta.LoginMaxFailures = 4
+	ta.newTestUser(t, "locked@example.com", models.RoleViewer)
+	ta.newTestUser(t, "admin@test.example", models.RoleAdmin)
+	admin := ta.logIn(t, "admin@test.example")
+
+	for i := 0; i < ta.LoginMaxFailures; i++ {
+		if rec := ta.authenticate(t, "locked@example.com", "wrong"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("wrong password %d: status %d", i+1, rec.Code)
+		}
+	}
+
+	// locked out for the whole lockout, the right password included
+	rec := ta.authenticate(t, "locked@example.com", testPassword)
+	retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if rec.Code != http.StatusTooManyRequests || retryAfter < int((ta.LoginLockout-time.Minute).Seconds()) {
+		t.Fatalf("right password after the failures: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = ta.request(t, http.MethodGet, "/admin/lockouts", nil, bearer(admin)...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing lockouts: status %d: %s", rec.Code, rec.Body)
+	}
+	var lockouts struct {
+		Data []models.LoginThrottle `json:"data"`
+	}
+	decode(t, rec, &lockouts)
+	if len(lockouts.Data) != 1 || lockouts.Data[0].Kind != models.LoginThrottleAccount || lockouts.Data[0].Key != "locked@example.com" {
+		t.Fatalf("lockouts %+v", lockouts.Data)
+	}
+
+	rec = ta.request(t, http.MethodDelete, "/admin/lockouts/"+strconv.Itoa(lockouts.Data[0].ID), nil, bearer(admin)...)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("clearing the lockout: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := ta.authenticate(t, "locked@example.com", testPassword); rec.Code != http.StatusAccepted {
+		t.Fatalf("login after the lockout was cleared: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = ta.request(t, http.MethodDelete, "/admin/lockouts/"+strconv.Itoa(lockouts.Data[0].ID), nil, bearer(admin)...)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("clearing it again: status %d", rec.Code)
+	}
+}
+
+func TestLoginUnknownEmailSameAnswer(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "known@example.com", models.RoleViewer)
+
+	// nothing in the answer tells whether an account has the email
+	wrong := ta.authenticate(t, "known@example.com", "wrong")
+	unknown := ta.authenticate(t, "unknown@example.com", "wrong")
+	if wrong.Code != unknown.Code || wrong.Body.String() != unknown.Body.String() {
+		t.Fatalf("wrong password: %d %s, unknown email: %d %s", wrong.Code, wrong.Body, unknown.Code, unknown.Body)
+	}
+
+	// and both make the email wait once the free failures are spent
+	for _, email := range []string{"known@example.com", "unknown@example.com"} {
+		for i := 1; i < 4; i++ {
+			ta.authenticate(t, email, "wrong")
+		}
+		if rec := ta.authenticate(t, email, "wrong"); rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s after the failures: status %d", email, rec.Code)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	ta := newTestApp(t)
+
+	var err error
+	ta.trustedProxies, err = parseTrustedProxies("192.0.2.0/24, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"trusted proxy", "192.0.2.1:1234", "203.0.113.9", "203.0.113.9"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:1234", "203.0.113.9", "203.0.113.9"},
+		{"address made up by the client", "192.0.2.1:1234", "198.51.100.1, 203.0.113.9", "203.0.113.9"},
+		{"chain of trusted proxies", "192.0.2.1:1234", "203.0.113.9, 192.0.2.7", "203.0.113.9"},
+		{"not an address", "192.0.2.1:1234", "unknown", "192.0.2.1"},
+		{"no header", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted client", "198.51.100.1:1234", "203.0.113.9", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := ta.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Fatalf("client %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/repository"
+	"backend/internal/totp"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// codes of the step before or after the current one are accepted too, for clocks that drift
+const totpSkew = 1
+
+// time to type the code after the password was checked
+const challengeExpiry = 5 * time.Minute
+
+// recovery codes handed out when two-factor authentication is enabled,
+// 80 random bits each shown as xxxx-xxxx-xxxx-xxxx
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10
+)
+
+var ErrTwoFactorCode = errors.New("invalid code")
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generate the recovery codes of a user, returning them with their hashes
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeBytes)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// a code as typed by the user, without the dashes and spaces and in lower case
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// check a code of the authenticator app, or else a recovery code, and use it up so it is not accepted again.
+// It tells whether it was a recovery code, and fails with ErrTwoFactorCode when the code is not valid.
+func (app *application) useTwoFactorCode(r *http.Request, repo repository.DatabaseRepo, user *models.User, code string) (bool, error) {
+	code = normalizeCode(code)
+	if code == "" || user.TOTPSecret == "" {
+		return false, ErrTwoFactorCode
+	}
+
+	now := time.Now()
+
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(user.TOTPSecret, code, now, totpSkew)
+		if !ok {
+			return false, ErrTwoFactorCode
+		}
+
+		err := repo.UseTOTPStep(r.Context(), user.ID, step)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the code, or a later one, was accepted already
+			return false, ErrTwoFactorCode
+		}
+		return false, err
+	}
+
+	err := repo.UseRecoveryCode(r.Context(), user.ID, hashToken(code), now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrTwoFactorCode
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = repo.InsertAuthEvent(r.Context(), models.AuthEvent{
+		UserID:    user.ID,
+		Event:     models.AuthEventRecoveryCodeUsed,
+		IP:        clientIP(r),
+		CreatedAt: now,
+	})
+	return true, err
+}
+
+// the user calling with an access token. Two-factor authentication is managed by the user themselves,
+// not with an API key acting on behalf of its creator.
+func (app *application) sessionUser(r *http.Request) (*models.User, error) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok || claims.TokenType != accessTokenType {
+		return nil, errors.New("only available to users logged in")
+	}
+
+	return app.DB.GetUserByID(r.Context(), app.currentUserID(r))
+}
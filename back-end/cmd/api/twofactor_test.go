@@ -0,0 +1,151 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/totp"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTwoFactorUser creates a user with two-factor authentication enabled and returns its secret
+func (ta *testApp) newTwoFactorUser(t *testing.T, email string) string {
+	t.Helper()
+
+	user := ta.newTestUser(t, email, models.RoleViewer)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ta.repo.SetTOTPSecret(context.Background(), user.ID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ta.repo.EnableTOTP(context.Background(), user.ID, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// challenge logs in with the password and returns the challenge to send with a code
+func (ta *testApp) challenge(t *testing.T, email string) string {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodPost, "/auth", map[string]string{"email": email, "password": testPassword})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login of %s: %d %s", email, rec.Code, rec.Body)
+	}
+
+	var res struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	decode(t, rec, &res)
+	if res.ChallengeToken == "" {
+		t.Fatalf("no challenge for %s: %s", email, rec.Body)
+	}
+	return res.ChallengeToken
+}
+
+func (ta *testApp) twoFactor(t *testing.T, challenge, code string) int {
+	t.Helper()
+	return ta.request(t, http.MethodPost, "/auth/2fa", map[string]string{"challenge_token": challenge, "code": code}).Code
+}
+
+func TestTwoFactorChallengeUsedOnce(t *testing.T) {
+	ta := newTestApp(t)
+	secret := ta.newTwoFactorUser(t, "2fa@example.com")
+	challenge := ta.challenge(t, "2fa@example.com")
+
+	if code := ta.twoFactor(t, challenge, "000000"); code != http.StatusBadRequest {
+		t.Fatalf("wrong code: status %d", code)
+	}
+
+	// as another instance of the API would see it, before its revocation list is reloaded
+	ta.revoked = newRevocationList()
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := ta.twoFactor(t, challenge, code); status != http.StatusBadRequest {
+		t.Fatalf("challenge used twice: status %d", status)
+	}
+
+	if status := ta.twoFactor(t, ta.challenge(t, "2fa@example.com"), code); status != http.StatusAccepted {
+		t.Fatalf("new challenge: status %d", status)
+	}
+}
+
+func TestTwoFactorCodesThrottled(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTwoFactorUser(t, "2fa@example.com")
+
+	// taken before the failures, to check /auth/2fa enforces the wait on its own
+	kept := ta.challenge(t, "2fa@example.com")
+
+	// the right password does not clear the failures of the codes, the fourth one has to wait
+	for i := 0; i < 4; i++ {
+		if code := ta.twoFactor(t, ta.challenge(t, "2fa@example.com"), "000000"); code != http.StatusBadRequest {
+			t.Fatalf("wrong code %d: status %d", i+1, code)
+		}
+	}
+
+	rec := ta.request(t, http.MethodPost, "/auth/2fa", map[string]string{"challenge_token": kept, "code": "000000"})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("code after the failures: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = ta.request(t, http.MethodPost, "/auth", map[string]string{"email": "2fa@example.com", "password": testPassword})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("password after the failures: status %d", rec.Code)
+	}
+}
+
+func TestDisableTwoFactorThrottled(t *testing.T) {
+	ta := newTestApp(t)
+	secret := ta.newTwoFactorUser(t, "2fa@example.com")
+
+	// a session, as a stolen access token would give
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := ta.request(t, http.MethodPost, "/auth/2fa", map[string]string{"challenge_token": ta.challenge(t, "2fa@example.com"), "code": code})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	var tokens TokenPairs
+	decode(t, rec, &tokens)
+
+	disable := func(code string) *httptest.ResponseRecorder {
+		return ta.request(t, http.MethodPost, "/auth/2fa/disable", map[string]string{"code": code}, bearer(tokens.Token)...)
+	}
+
+	for i := 0; i < 4; i++ {
+		if rec := disable("000000"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("wrong code %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+
+	// even the right code waits now
+	code, err = totp.Code(secret, totp.Step(time.Now())+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = disable(code)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("code after the failures: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	user, err := ta.repo.GetUserByEmail(context.Background(), "2fa@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TOTPEnabledAt == nil {
+		t.Fatal("two-factor authentication disabled")
+	}
+}
@@ -1,16 +1,31 @@
 package main
 
 import (
+	"backend/internal/repository"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type JSONResponse struct {
 	Error   bool        `json:"error"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data"`
+	Meta    interface{} `json:"meta,omitempty"`
+}
+
+// pagination metadata sent in JSONResponse.Meta with a page of results
+type PageMeta struct {
+	Total      int    `json:"total"`
+	Page       int    `json:"page,omitempty"` // only for offset pagination
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
 }
 
 // interface{} means that data can take any kind of type
@@ -89,3 +104,126 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 	// write error in JSON to the response
 	return app.writeJSON(w, statusCode, payload)
 }
+
+// helper function to read the paging, sorting and filtering query parameters of a movie list, e.g.
+// ?page=2&limit=20 or ?cursor=...&sort=release_date&order=desc&genre=1&genre=5&rating=PG-13&year_from=1980&runtime_max=120
+func (app *application) readMovieListOptions(r *http.Request) (repository.MovieListOptions, error) {
+	q := r.URL.Query()
+	var opts repository.MovieListOptions
+
+	// read an optional integer parameter
+	intParam := func(name string, dst *int) error {
+		if q.Get(name) == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a positive number", name)
+		}
+		*dst = n
+		return nil
+	}
+
+	for name, dst := range map[string]*int{
+		"page":        &opts.Page,
+		"limit":       &opts.Limit,
+		"year_from":   &opts.YearFrom,
+		"year_to":     &opts.YearTo,
+		"runtime_min": &opts.RuntimeMin,
+		"runtime_max": &opts.RuntimeMax,
+	} {
+		err := intParam(name, dst)
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	opts.Cursor = q.Get("cursor")
+	opts.Sort = q.Get("sort")
+
+	switch strings.ToLower(q.Get("order")) {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+
+	// both ?genre=1&genre=2 and ?genre=1,2 are accepted
+	for _, value := range splitParams(q["genre"]) {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid genre %q", value)
+		}
+		opts.Genres = append(opts.Genres, id)
+	}
+	opts.MPAARatings = splitParams(q["rating"])
+
+	return opts, opts.Normalize()
+}
+
+// split comma separated query values and drop empty ones
+func splitParams(values []string) []string {
+	var out []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// address of the client, without the port. Behind a proxy it is the address of the proxy,
+// unless realIP took the one of the client from X-Forwarded-For
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR ranges
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q: not an address", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustedProxy tells if the address is one of the proxies of -trusted-proxies
+func (app *application) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range app.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// reasons a token is rejected, every error returned by VerifyToken wraps one of them
+var (
+	ErrTokenMissing     = errors.New("no auth header")
+	ErrAuthHeader       = errors.New("invalid auth header")
+	ErrTokenMalformed   = errors.New("malformed token")
+	ErrTokenAlgorithm   = errors.New("unexpected signing method")
+	ErrTokenKey         = errors.New("unknown signing key")
+	ErrTokenSignature   = errors.New("invalid signature")
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrTokenIssuer      = errors.New("invalid issuer")
+	ErrTokenAudience    = errors.New("invalid audience")
+	ErrTokenType        = errors.New("wrong token type")
+	ErrTokenRevoked     = errors.New("token has been revoked")
+)
+
+// VerifyToken checks the signature of a token, that we issued it for our audience,
+// that it is valid now give or take ClockSkew, and that its typ claim is tokenType
+func (j *Auth) VerifyToken(token string, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+
+	// the time claims are checked below, with the clock skew the parser does not know about
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+
+	_, err := parser.ParseWithClaims(token, claims, j.keyFunc)
+	if err != nil {
+		return nil, parseError(err)
+	}
+
+	now := time.Now()
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: no expiry", ErrTokenMalformed)
+	}
+	if now.After(claims.ExpiresAt.Add(j.ClockSkew)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != nil && now.Before(claims.NotBefore.Add(-j.ClockSkew)) {
+		return nil, ErrTokenNotYetValid
+	}
+	if claims.IssuedAt != nil && now.Before(claims.IssuedAt.Add(-j.ClockSkew)) {
+		return nil, ErrTokenNotYetValid
+	}
+
+	// check if this token is issued by us, for us
+	if claims.Issuer != j.Issuer {
+		return nil, ErrTokenIssuer
+	}
+	if !claims.VerifyAudience(j.Audience, true) {
+		return nil, ErrTokenAudience
+	}
+
+	// a refresh token is only good for /refresh, and an access token not at all there
+	if claims.TokenType != tokenType {
+		return nil, ErrTokenType
+	}
+	if tokenType == refreshTokenType && claims.ID == "" {
+		return nil, fmt.Errorf("%w: no jti", ErrTokenMalformed)
+	}
+
+	return claims, nil
+}
+
+// the error of the parser as one of ours
+func parseError(err error) error {
+	if errors.Is(err, ErrTokenAlgorithm) || errors.Is(err, ErrTokenKey) {
+		// returned by keyFunc, with the details
+		return err
+	}
+
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return ErrTokenMalformed
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		// the alg of the header is not one the library knows
+		return ErrTokenAlgorithm
+	default:
+		return ErrTokenSignature
+	}
+}
+
+// Challenge is the WWW-Authenticate header to reject a request with because of err,
+// and the status that goes with it (RFC 6750 section 3)
+func (j *Auth) Challenge(err error) (string, int) {
+	challenge := fmt.Sprintf("Bearer realm=%q", j.Audience)
+
+	switch {
+	case errors.Is(err, ErrTokenMissing):
+		// no error code when the client did not try to authenticate
+		return challenge, http.StatusUnauthorized
+	case errors.Is(err, ErrAuthHeader):
+		return challenge + `, error="invalid_request", error_description="` + ErrAuthHeader.Error() + `"`, http.StatusBadRequest
+	default:
+		return challenge + `, error="invalid_token", error_description="` + tokenReason(err).Error() + `"`, http.StatusUnauthorized
+	}
+}
+
+// the reason err wraps, without the details that may quote parts of the token (such as its kid)
+func tokenReason(err error) error {
+	reasons := []error{
+		ErrTokenMissing, ErrAuthHeader, ErrTokenMalformed, ErrTokenAlgorithm, ErrTokenKey, ErrTokenSignature, ErrTokenExpired,
+		ErrTokenNotYetValid, ErrTokenIssuer, ErrTokenAudience, ErrTokenType, ErrTokenRevoked,
+	}
+	for _, reason := range reasons {
+		if errors.Is(err, reason) {
+			return reason
+		}
+	}
+	return errors.New("invalid token")
+}
+
+// InsufficientScope is the WWW-Authenticate header of a valid token lacking permission, answered with a 403
+func (j *Auth) InsufficientScope(permission string) string {
+	return fmt.Sprintf(`Bearer realm=%q, error="insufficient_scope", scope=%q`, j.Audience, permission)
+}
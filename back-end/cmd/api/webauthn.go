@@ -0,0 +1,43 @@
+package main
+
+import (
+	"backend/internal/webauthn"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// time to answer the passkey prompt of the browser, and how long the challenge of a ceremony lasts
+const webauthnTimeout = 5 * time.Minute
+
+// the relying party of the passkeys, the front-end unless -webauthn-origin says otherwise
+func (app *application) newRelyingParty() (*webauthn.RelyingParty, error) {
+	origin := app.WebAuthnOrigin
+	if origin == "" {
+		origin = app.FrontendURL
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid webauthn origin %q", origin)
+	}
+
+	rpID := app.WebAuthnRPID
+	if rpID == "" {
+		rpID = u.Hostname()
+	}
+
+	// browsers send the origin alone, scheme and host
+	return &webauthn.RelyingParty{
+		ID:      rpID,
+		Name:    siteName,
+		Origin:  u.Scheme + "://" + u.Host,
+		Timeout: webauthnTimeout,
+	}, nil
+}
+
+// the user handle of a user's passkeys, what the authenticator returns at login to say whose passkey it is
+func webauthnUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"backend/internal/models"
+	"backend/internal/webauthn"
+	"backend/internal/webauthn/webauthntest"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the answer to a challenge unknown, used already or expired
+var errPasskeyPrompt = errors.New("the passkey prompt has expired")
+
+// registerPasskey registers a passkey of authenticator for the user of token through the routes
+func (ta *testApp) registerPasskey(t *testing.T, authenticator *webauthntest.Authenticator, token string) {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodPost, "/auth/webauthn/register/begin", nil, bearer(token)...)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("register begin: status %d: %s", rec.Code, rec.Body)
+	}
+	var begin struct {
+		Data webauthn.CreationOptions `json:"data"`
+	}
+	decode(t, rec, &begin)
+
+	res, err := authenticator.Create(begin.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = ta.request(t, http.MethodPost, "/auth/webauthn/register/finish", map[string]interface{}{
+		"name":       "laptop",
+		"credential": res,
+	}, bearer(token)...)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("register finish: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// beginPasskeyLogin returns the options of a new passkey login
+func (ta *testApp) beginPasskeyLogin(t *testing.T) webauthn.RequestOptions {
+	t.Helper()
+
+	rec := ta.request(t, http.MethodPost, "/auth/webauthn/login/begin", nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("login begin: status %d: %s", rec.Code, rec.Body)
+	}
+	var begin struct {
+		Data webauthn.RequestOptions `json:"data"`
+	}
+	decode(t, rec, &begin)
+	return begin.Data
+}
+
+func (ta *testApp) finishPasskeyLogin(t *testing.T, authenticator *webauthntest.Authenticator, opts webauthn.RequestOptions) *httptest.ResponseRecorder {
+	t.Helper()
+
+	res, err := authenticator.Get(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ta.request(t, http.MethodPost, "/auth/webauthn/login/finish", res)
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	ta := newTestApp(t)
+	ta.newTestUser(t, "passkey@example.com", models.RoleViewer)
+	authenticator := webauthntest.New(ta.FrontendURL)
+	ta.registerPasskey(t, authenticator, ta.logIn(t, "passkey@example.com"))
+
+	for i := 0; i < 2; i++ {
+		rec := ta.finishPasskeyLogin(t, authenticator, ta.beginPasskeyLogin(t))
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("login %d: status %d: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+
+	// a challenge is taken by the first login that answers it
+	opts := ta.beginPasskeyLogin(t)
+	ta.finishPasskeyLogin(t, authenticator, opts)
+	if rec := ta.finishPasskeyLogin(t, authenticator, opts); rec.Code != http.StatusBadRequest {
+		t.Fatalf("challenge used twice: status %d", rec.Code)
+	}
+}
+
+func TestPasskeyLoginRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		want  error // the reason of the rejection
+		setup func(t *testing.T, ta *testApp, authenticator *webauthntest.Authenticator, opts *webauthn.RequestOptions)
+	}{
+		{"other origin", webauthn.ErrOrigin, func(t *testing.T, ta *testApp, authenticator *webauthntest.Authenticator, opts *webauthn.RequestOptions) {
+			authenticator.Origin = "http://evil.test"
+		}},
+		{"unknown challenge", errPasskeyPrompt, func(t *testing.T, ta *testApp, authenticator *webauthntest.Authenticator, opts *webauthn.RequestOptions) {
+			opts.Challenge = webauthn.Encoding.EncodeToString([]byte("a challenge never given"))
+		}},
+		{"expired challenge", errPasskeyPrompt, func(t *testing.T, ta *testApp, authenticator *webauthntest.Authenticator, opts *webauthn.RequestOptions) {
+			challenge, err := webauthn.NewChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ta.repo.InsertWebAuthnChallenge(context.Background(), models.WebAuthnChallenge{
+				Challenge: challenge,
+				Ceremony:  models.WebAuthnLogin,
+				ExpiresAt: time.Now().Add(-time.Second),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.Challenge = challenge
+		}},
+		{"sign count going backwards", webauthn.ErrSignCount, func(t *testing.T, ta *testApp, authenticator *webauthntest.Authenticator, opts *webauthn.RequestOptions) {
+			// as after logins with a clone of the authenticator
+			creds, err := ta.repo.UserWebAuthnCredentials(context.Background(), ta.userID(t, "passkey@example.com"))
+			if err != nil || len(creds) != 1 {
+				t.Fatalf("%d passkeys: %v", len(creds), err)
+			}
+			err = ta.repo.UseWebAuthnCredential(context.Background(), creds[0].ID, 100, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			ta.newTestUser(t, "passkey@example.com", models.RoleViewer)
+			authenticator := webauthntest.New(ta.FrontendURL)
+			ta.registerPasskey(t, authenticator, ta.logIn(t, "passkey@example.com"))
+
+			opts := ta.beginPasskeyLogin(t)
+			tt.setup(t, ta, authenticator, &opts)
+
+			rec := ta.finishPasskeyLogin(t, authenticator, opts)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want.Error()) {
+				t.Fatalf("status %d, want 400 for %q: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func (ta *testApp) userID(t *testing.T, email string) int {
+	t.Helper()
+
+	user, err := ta.repo.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
@@ -0,0 +1,92 @@
+// Package cache is a small in-process key/value cache with expiring entries.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache keeps up to MaxEntries values for TTL each. It is safe for concurrent use.
+type Cache[V any] struct {
+	TTL        time.Duration
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]entry[V]
+}
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Factory method to create an empty cache
+func New[V any](ttl time.Duration, maxEntries int) *Cache[V] {
+	return &Cache[V]{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		entries:    make(map[string]entry[V]),
+	}
+}
+
+// Get returns the value stored under key, if it has not expired yet
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		var zero V
+		return zero, false
+	}
+
+	return e.value, true
+}
+
+// Set stores value under key for TTL
+func (c *Cache[V]) Set(key string, value V) {
+	c.SetWithTTL(key, value, c.TTL)
+}
+
+// SetWithTTL stores value under key for ttl instead of the default TTL
+func (c *Cache[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if _, ok := c.entries[key]; !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		// make room: drop what expired, and if that is not enough the entry closest to expiring
+		var oldest string
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.MaxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[key] = entry[V]{value: value, expires: now.Add(ttl)}
+}
+
+// Delete removes key from the cache
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// Clear removes every entry
+func (c *Cache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]entry[V])
+}
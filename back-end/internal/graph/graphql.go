@@ -12,6 +12,7 @@ import (
 type Graph struct {
 	Movies      []*models.Movie
 	QueryString string
+	Search      func(query string) ([]*models.Movie, error) // full text search, best matches first
 	Config      graphql.SchemaConfig
 	fields      graphql.Fields
 	movieType   *graphql.Object
@@ -19,6 +20,7 @@ type Graph struct {
 
 // Factory method to create a new instance of the Graph type from the list of movies
 func New(movies []*models.Movie) *Graph {
+	g := &Graph{Movies: movies}
 
 	//Define the object for our movie. The fields match database field names
 	var movieType = graphql.NewObject(
@@ -68,7 +70,7 @@ func New(movies []*models.Movie) *Graph {
 
 		"search": &graphql.Field{
 			Type:        graphql.NewList(movieType),
-			Description: "Search movies by title",
+			Description: "Search movies by title and description",
 			Args: graphql.FieldConfigArgument{
 				"titleContains": &graphql.ArgumentConfig{
 					Type: graphql.String,
@@ -78,6 +80,17 @@ func New(movies []*models.Movie) *Graph {
 				//start with an empty list
 				var theList []*models.Movie
 				search, ok := p.Args["titleContains"].(string)
+				if ok && strings.TrimSpace(search) == "" {
+					// nothing typed yet, every movie matches
+					return movies, nil
+				}
+				if ok && g.Search != nil {
+					// match the last word as a prefix so results show up while typing
+					if !strings.HasSuffix(search, `"`) && !strings.HasSuffix(search, "*") {
+						search += "*"
+					}
+					return g.Search(search)
+				}
 				if ok {
 					for _, currentMovie := range movies {
 						if strings.Contains(strings.ToLower(currentMovie.Title), strings.ToLower(search)) {
@@ -112,11 +125,9 @@ func New(movies []*models.Movie) *Graph {
 	}
 
 	// finally return a pointer to the Graph type, populated with the correct information
-	return &Graph{
-		Movies:    movies,
-		fields:    fields,
-		movieType: movieType,
-	}
+	g.fields = fields
+	g.movieType = movieType
+	return g
 }
 
 func (g *Graph) Query() (*graphql.Result, error) {
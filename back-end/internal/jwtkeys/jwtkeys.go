@@ -0,0 +1,338 @@
+// Package jwtkeys manages the asymmetric keys that sign and verify JWTs.
+//
+// Keys are PEM files in a directory, the file name without .pem being the kid.
+// The newest key whose creation time (the file modification time) has passed signs
+// new tokens; older keys keep verifying until every token they signed has expired.
+// A key set can generate a new key on a schedule, which is how keys are rotated.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// supported algorithms
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Key is one signing key
+type Key struct {
+	ID        string // kid
+	Algorithm string // RS256, ES256 or EdDSA, given by the type of the key
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+// Method is the jwt signing method of the key
+func (k *Key) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Public is the key to verify signatures with
+func (k *Key) Public() crypto.PublicKey {
+	return k.Private.Public()
+}
+
+// KeySet is every key of a directory. It is safe for concurrent use.
+type KeySet struct {
+	Dir       string
+	Algorithm string // algorithm of the keys it generates
+
+	// a new key is generated when the signing key is older than Rotation, 0 never rotates
+	Rotation time.Duration
+	// how long a replaced key keeps verifying, the lifetime of the longest lived token
+	MaxTokenLifetime time.Duration
+
+	mu   sync.RWMutex
+	keys []*Key // oldest first
+}
+
+// Factory method to load the keys of dir, a first key is generated if there is none
+func New(dir, algorithm string, rotation, maxTokenLifetime time.Duration) (*KeySet, error) {
+	switch algorithm {
+	case RS256, ES256, EdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q, use %s, %s or %s", algorithm, RS256, ES256, EdDSA)
+	}
+
+	s := &KeySet{
+		Dir:              dir,
+		Algorithm:        algorithm,
+		Rotation:         rotation,
+		MaxTokenLifetime: maxTokenLifetime,
+	}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads the keys of the directory again, so keys added or removed by hand are picked up
+func (s *KeySet) Reload() error {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	var keys []*Key
+	for _, file := range files {
+		key, err := readKey(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+// a rotated key is published this long before it starts signing, longer than clients cache the JWKS
+const publishAhead = 10 * time.Minute
+
+// Rotate generates a new key when there is none, or when the signing key is about to be older than Rotation.
+// The new key only starts signing once the current one is Rotation old. It tells whether a key was generated.
+func (s *KeySet) Rotate(now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	createdAt := now
+
+	current := s.signing(now)
+	if current != nil {
+		if s.Rotation <= 0 || s.keys[len(s.keys)-1] != current {
+			// never rotates, or the next key is already scheduled
+			return false, nil
+		}
+
+		createdAt = current.CreatedAt.Add(s.Rotation)
+		if now.Before(createdAt.Add(-publishAhead)) {
+			return false, nil
+		}
+		if createdAt.Before(now) {
+			createdAt = now
+		}
+	}
+
+	private, err := generateKey(s.Algorithm)
+	if err != nil {
+		return false, err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return false, err
+	}
+
+	key := &Key{
+		ID:        createdAt.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix),
+		Algorithm: s.Algorithm,
+		Private:   private,
+		CreatedAt: createdAt,
+	}
+
+	err = writeKey(filepath.Join(s.Dir, key.ID+".pem"), key)
+	if err != nil {
+		return false, err
+	}
+
+	s.keys = append(s.keys, key)
+	return true, nil
+}
+
+// Run reloads the directory and rotates the keys every interval, until stop is closed
+func (s *KeySet) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := s.Reload()
+			if err != nil {
+				log.Println("jwt keys:", err)
+				continue
+			}
+
+			rotated, err := s.Rotate(time.Now())
+			if err != nil {
+				log.Println("jwt keys:", err)
+			}
+			if rotated {
+				log.Println("jwt keys: generated the next signing key")
+			}
+		}
+	}
+}
+
+// Signing returns the key new tokens are signed with
+func (s *KeySet) Signing() (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := s.signing(time.Now())
+	if key == nil {
+		return nil, errors.New("no signing key")
+	}
+	return key, nil
+}
+
+// newest key already created, caller must hold the lock
+func (s *KeySet) signing(now time.Time) *Key {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if !s.keys[i].CreatedAt.After(now) {
+			return s.keys[i]
+		}
+	}
+	return nil
+}
+
+// Verifying returns the key a token with kid has to be verified with,
+// as long as tokens signed by it may still be valid
+func (s *KeySet) Verifying(kid string) (*Key, bool) {
+	for _, key := range s.Published() {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Published returns the keys that may have signed a token still valid, plus the keys scheduled to sign next
+func (s *KeySet) Published() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+
+	var keys []*Key
+	for i, key := range s.keys {
+		// a key stops signing when the next one starts, its tokens expire MaxTokenLifetime later
+		if i+1 < len(s.keys) && now.After(s.keys[i+1].CreatedAt.Add(s.MaxTokenLifetime)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q, use %s, %s or %s", algorithm, RS256, ES256, EdDSA)
+	}
+}
+
+// read a PEM private key, PKCS#8, PKCS#1 (RSA) or SEC 1 (EC)
+func readKey(file string) (*Key, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		ID:        strings.TrimSuffix(filepath.Base(file), ".pem"),
+		CreatedAt: info.ModTime(),
+	}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Private = RS256, k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		key.Algorithm, key.Private = ES256, k
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Private = EdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	return key, nil
+}
+
+// write a key as PKCS#8 PEM, readable by its owner only
+func writeKey(file string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+
+	// the modification time is the creation time of the key
+	return os.Chtimes(file, key.CreatedAt, key.CreatedAt)
+}
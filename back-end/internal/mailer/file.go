@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes every message to a .eml file of Dir, or to the log when Dir is empty.
+// It is meant for local development, where the links sent by email are read from there.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	content := msg.bytes(m.From, now)
+
+	if m.Dir == "" {
+		log.Printf("mail to %s:\n%s", msg.To, content)
+		return nil
+	}
+
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	name := now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return os.WriteFile(filepath.Join(m.Dir, name), content, 0600)
+}
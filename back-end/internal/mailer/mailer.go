@@ -0,0 +1,43 @@
+// Package mailer sends the emails of the api, such as the links to verify an email address.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages. Send returns once the message is handed over, not delivered.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format the message as RFC 5322 text, ready to be sent or written to a file
+func (msg Message) bytes(from string, date time.Time) []byte {
+	var b strings.Builder
+
+	// a header value with a line break would let the caller add headers of their own
+	header := func(name, value string) {
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", msg.Subject)
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends messages through an SMTP server, with STARTTLS when the server offers it
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string // no authentication when empty
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// the envelope takes the bare address, the From header may carry a name too
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{msg.To}, msg.bytes(m.From, time.Now()))
+}
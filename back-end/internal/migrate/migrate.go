@@ -0,0 +1,368 @@
+// Package migrate applies the versioned SQL migrations embedded in the binary.
+//
+// Each migration is a pair of files named NNNN_name.up.sql and NNNN_name.down.sql.
+// Applied versions are recorded in the schema_migrations table together with a
+// checksum of their up file, so editing a migration after it ran is detected.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// arbitrary key for pg_advisory_lock, shared by every instance of the api
+const lockKey = 7242351
+
+// matches 0001_create_tables.up.sql
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one schema change
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // sha256 of Up
+}
+
+// Status of one migration as reported by Migrator.Status
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool // the embedded up file differs from the one that was applied
+}
+
+// Migrator runs migrations against a Postgres database
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// Factory method to create a Migrator with the migrations embedded in the binary
+func New(db *sql.DB) (*Migrator, error) {
+	migrations, err := Load(embedded, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// Load reads the migrations in dir, ordered by version
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		parts := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || parts == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, parts[2])
+		}
+
+		if parts[3] == "up" {
+			m.Up = string(content)
+			m.Checksum = checksum(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Up applies every pending migration in order and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.verify(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			err := apply(ctx, conn, migration)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.verify(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.Migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", migration.Version, migration.Name)
+			}
+
+			err := revert(ctx, conn, migration)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Status reports every known migration and whether it has been applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.Migrations {
+			s := Status{Migration: migration}
+			if row, ok := applied[migration.Version]; ok {
+				s.Applied = true
+				s.AppliedAt = row.appliedAt
+				s.Modified = row.checksum != migration.Checksum
+			}
+			statuses = append(statuses, s)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Create writes an empty pair of migration files to dir, numbered after the highest existing version
+func Create(dir, name string) (up string, down string, err error) {
+	migrations, err := Load(os.DirFS(dir), ".")
+	if err != nil {
+		return "", "", err
+	}
+
+	next := int64(1)
+	if len(migrations) > 0 {
+		next = migrations[len(migrations)-1].Version + 1
+	}
+
+	base := fmt.Sprintf("%04d_%s", next, name)
+	if !fileName.MatchString(base + ".up.sql") {
+		return "", "", fmt.Errorf("invalid migration name %q, use lowercase letters, digits and underscores", name)
+	}
+
+	up = filepath.Join(dir, base+".up.sql")
+	down = filepath.Join(dir, base+".down.sql")
+
+	err = os.WriteFile(up, []byte("-- "+name+"\n"), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = os.WriteFile(down, []byte("-- revert "+name+"\n"), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	return up, down, nil
+}
+
+// run fn on a single connection holding the migration advisory lock,
+// so two instances starting at the same time never migrate concurrently
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	// advisory locks belong to a session, so everything has to run on the same connection
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		create table if not exists schema_migrations (
+			version bigint primary key,
+			name text not null,
+			checksum text not null,
+			applied_at timestamp with time zone not null default now()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+type appliedRow struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int64]appliedRow, error) {
+	rows, err := conn.QueryContext(ctx, `select version, checksum, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]appliedRow)
+	for rows.Next() {
+		var version int64
+		var row appliedRow
+		err := rows.Scan(&version, &row.checksum, &row.appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = row
+	}
+
+	return applied, rows.Err()
+}
+
+// load the applied migrations and make sure they still match the embedded files
+func (m *Migrator) verify(ctx context.Context, conn *sql.Conn) (map[int64]appliedRow, error) {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int64]Migration)
+	for _, migration := range m.Migrations {
+		known[migration.Version] = migration
+	}
+
+	for version, row := range applied {
+		migration, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("database has migration %d applied, which this binary does not know about", version)
+		}
+		if row.checksum != migration.Checksum {
+			return nil, fmt.Errorf("migration %d_%s was modified after it was applied", version, migration.Name)
+		}
+	}
+
+	return applied, nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, migration.Up)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, checksum) values ($1, $2, $3)`,
+			migration.Version, migration.Name, migration.Checksum)
+		return err
+	})
+}
+
+func revert(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, migration.Down)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, migration.Version)
+		return err
+	})
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
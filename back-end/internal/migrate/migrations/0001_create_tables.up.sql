@@ -0,0 +1,102 @@
+-- Initial schema, taken from the original create_tables.sql dump.
+-- Every statement is idempotent so this migration can also be applied to a
+-- database that was created from the dump before migrations existed.
+
+CREATE TABLE IF NOT EXISTS public.genres (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    genre character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.movies (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    title character varying(512),
+    release_date date,
+    runtime integer,
+    mpaa_rating character varying(10),
+    description text,
+    image character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.movies_genres (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    movie_id integer REFERENCES public.movies(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    genre_id integer REFERENCES public.genres(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS public.users (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    first_name character varying(255),
+    last_name character varying(255),
+    email character varying(255),
+    password character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+DO $$
+BEGIN
+    -- only seed an empty table
+    IF NOT EXISTS (SELECT 1 FROM public.genres) THEN
+        INSERT INTO public.genres (id, genre, created_at, updated_at) OVERRIDING SYSTEM VALUE VALUES
+            (1, 'Comedy', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (2, 'Sci-Fi', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (3, 'Horror', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (4, 'Romance', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (5, 'Action', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (6, 'Thriller', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (7, 'Drama', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (8, 'Mystery', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (9, 'Crime', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (10, 'Animation', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (11, 'Adventure', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (12, 'Fantasy', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (13, 'Superhero', '2022-09-23 00:00:00', '2022-09-23 00:00:00');
+    END IF;
+END
+$$;
+
+DO $$
+BEGIN
+    -- only seed an empty table
+    IF NOT EXISTS (SELECT 1 FROM public.movies) THEN
+        INSERT INTO public.movies (id, title, release_date, runtime, mpaa_rating, description, image, created_at, updated_at) OVERRIDING SYSTEM VALUE VALUES
+            (1, 'Highlander', '1986-03-07', 116, 'R', 'He fought his first battle on the Scottish Highlands in 1536. He will fight his greatest battle on the streets of New York City in 1986. His name is Connor MacLeod. He is immortal.', '/8Z8dptJEypuLoOQro1WugD855YE.jpg', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (2, 'Raiders of the Lost Ark', '1981-06-12', 115, 'PG-13', 'Archaeology professor Indiana Jones ventures to seize a biblical artefact known as the Ark of the Covenant. While doing so, he puts up a fight against Renee and a troop of Nazis.', '/ceG9VzoRAVGwivFU403Wc3AHRys.jpg', '2022-09-23 00:00:00', '2022-09-23 00:00:00'),
+            (3, 'The Godfather', '1972-03-24', 175, '18A', 'The aging patriarch of an organized crime dynasty in postwar New York City transfers control of his clandestine empire to his reluctant youngest son.', '/3bhkrj58Vtu7enYsRolD1fZdja1.jpg', '2022-09-23 00:00:00', '2022-09-23 00:00:00');
+    END IF;
+END
+$$;
+
+DO $$
+BEGIN
+    -- only seed an empty table
+    IF NOT EXISTS (SELECT 1 FROM public.movies_genres) THEN
+        INSERT INTO public.movies_genres (id, movie_id, genre_id) OVERRIDING SYSTEM VALUE VALUES
+            (1, 1, 5),
+            (2, 1, 12),
+            (3, 2, 5),
+            (4, 2, 11),
+            (5, 3, 9),
+            (6, 3, 7);
+    END IF;
+END
+$$;
+
+DO $$
+BEGIN
+    -- only seed an empty table
+    IF NOT EXISTS (SELECT 1 FROM public.users) THEN
+        INSERT INTO public.users (id, first_name, last_name, email, password, created_at, updated_at) OVERRIDING SYSTEM VALUE VALUES
+            (1, 'Admin', 'User', 'admin@example.com', '$2a$14$wVsaPvJnJJsomWArouWCtusem6S/.Gauq/GjOIEHpyh2DAMmso1wy', '2022-09-23 00:00:00', '2022-09-23 00:00:00');
+    END IF;
+END
+$$;
+
+SELECT setval(pg_get_serial_sequence('public.genres', 'id'), (SELECT max(id) FROM public.genres));
+SELECT setval(pg_get_serial_sequence('public.movies', 'id'), (SELECT max(id) FROM public.movies));
+SELECT setval(pg_get_serial_sequence('public.movies_genres', 'id'), (SELECT max(id) FROM public.movies_genres));
+SELECT setval(pg_get_serial_sequence('public.users', 'id'), (SELECT max(id) FROM public.users));
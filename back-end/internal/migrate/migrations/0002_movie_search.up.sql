@@ -0,0 +1,7 @@
+-- Full text search over movies: the title weighs more (A) than the description (B).
+ALTER TABLE public.movies ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english'::regconfig, coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('english'::regconfig, coalesce(description, '')), 'B')
+) STORED;
+
+CREATE INDEX movies_search_vector_idx ON public.movies USING gin (search_vector);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.movies_title_trgm_idx;
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,4 @@
+-- Trigram index for typo tolerant title suggestions (similarity, word_similarity and ilike).
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX movies_title_trgm_idx ON public.movies USING gin (title gin_trgm_ops);
@@ -0,0 +1,3 @@
+-- Movies still in the trash become visible again.
+DROP INDEX IF EXISTS public.movies_deleted_at_idx;
+ALTER TABLE public.movies DROP COLUMN IF EXISTS deleted_at;
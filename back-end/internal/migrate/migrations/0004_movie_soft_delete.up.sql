@@ -0,0 +1,5 @@
+-- Deleted movies go to the trash first: deleted_at is set and their genre links are kept,
+-- so they can be restored until they are purged.
+ALTER TABLE public.movies ADD COLUMN deleted_at timestamp without time zone;
+
+CREATE INDEX movies_deleted_at_idx ON public.movies (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.movie_revisions;
+DROP FUNCTION IF EXISTS public.movie_revisions_immutable();
@@ -0,0 +1,24 @@
+-- Every change made to a movie through the admin api is kept as a full snapshot.
+-- There is no foreign key to movies on purpose: the history outlives a purged movie.
+CREATE TABLE public.movie_revisions (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    movie_id integer NOT NULL,
+    revision integer NOT NULL,
+    action character varying(20) NOT NULL,
+    snapshot jsonb NOT NULL,
+    user_id integer NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    UNIQUE (movie_id, revision)
+);
+
+-- revisions are immutable
+CREATE FUNCTION public.movie_revisions_immutable() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    RAISE EXCEPTION 'movie revisions cannot be changed';
+END
+$$;
+
+CREATE TRIGGER movie_revisions_immutable
+    BEFORE UPDATE OR DELETE ON public.movie_revisions
+    FOR EACH ROW EXECUTE FUNCTION public.movie_revisions_immutable();
@@ -0,0 +1 @@
+ALTER TABLE public.movies DROP COLUMN IF EXISTS version;
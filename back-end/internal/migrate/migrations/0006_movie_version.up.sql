@@ -0,0 +1,3 @@
+-- Every change to a movie bumps its version. Admin edits send back the version they
+-- started from (If-Match) and are refused when someone else saved in between.
+ALTER TABLE public.movies ADD COLUMN version integer NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS public.genres_genre_key;
@@ -0,0 +1,5 @@
+-- Genres are now managed from the admin pages: their timestamps are filled in
+-- and two genres can no longer share a name, whatever the case.
+UPDATE public.genres SET created_at = coalesce(created_at, now()), updated_at = coalesce(updated_at, now());
+
+CREATE UNIQUE INDEX genres_genre_key ON public.genres (lower(genre));
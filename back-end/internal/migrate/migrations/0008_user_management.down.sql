@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.users_email_key;
+ALTER TABLE public.users DROP COLUMN IF EXISTS disabled_at;
@@ -0,0 +1,5 @@
+-- Users are now managed from the admin pages: they can be disabled without
+-- being deleted, and two accounts can no longer share an email, whatever the case.
+ALTER TABLE public.users ADD COLUMN disabled_at timestamp without time zone;
+
+CREATE UNIQUE INDEX users_email_key ON public.users (lower(email));
@@ -0,0 +1,4 @@
+ALTER TABLE public.users DROP COLUMN IF EXISTS role;
+DROP TABLE IF EXISTS public.roles_permissions;
+DROP TABLE IF EXISTS public.permissions;
+DROP TABLE IF EXISTS public.roles;
@@ -0,0 +1,48 @@
+-- Role based access control. Every user has one role, every role a set of
+-- permissions; the permissions of a user are copied into their access token.
+CREATE TABLE public.roles (
+    name character varying(50) PRIMARY KEY,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE public.permissions (
+    name character varying(100) PRIMARY KEY,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE public.roles_permissions (
+    role character varying(50) NOT NULL REFERENCES public.roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission character varying(100) NOT NULL REFERENCES public.permissions(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO public.roles (name, description) VALUES
+    ('viewer', 'can browse the admin catalogue'),
+    ('editor', 'can add and edit movies and genres'),
+    ('admin', 'can do everything, including deleting movies and managing users');
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('movies:read', 'read the admin catalogue, the trash and the revisions'),
+    ('movies:write', 'add, edit, restore and roll back movies'),
+    ('movies:delete', 'move movies to the trash and purge it'),
+    ('genres:write', 'create, rename, merge and delete genres'),
+    ('users:read', 'list users and roles'),
+    ('users:write', 'create, edit, disable and delete users and change their role');
+
+INSERT INTO public.roles_permissions (role, permission) VALUES
+    ('viewer', 'movies:read'),
+    ('editor', 'movies:read'),
+    ('editor', 'movies:write'),
+    ('editor', 'genres:write'),
+    ('admin', 'movies:read'),
+    ('admin', 'movies:write'),
+    ('admin', 'movies:delete'),
+    ('admin', 'genres:write'),
+    ('admin', 'users:read'),
+    ('admin', 'users:write');
+
+-- everybody was an admin so far, new users start as viewers
+ALTER TABLE public.users ADD COLUMN role character varying(50) REFERENCES public.roles(name) ON UPDATE CASCADE;
+UPDATE public.users SET role = 'admin';
+ALTER TABLE public.users ALTER COLUMN role SET NOT NULL;
+ALTER TABLE public.users ALTER COLUMN role SET DEFAULT 'viewer';
@@ -0,0 +1,16 @@
+-- Refresh tokens are remembered by their jti so they can be rotated and revoked.
+-- Tokens rotated from the same login share a family_id: presenting a token that
+-- was already used revokes the whole family, since it has probably been stolen.
+CREATE TABLE public.refresh_tokens (
+    id character varying(64) PRIMARY KEY,
+    family_id character varying(64) NOT NULL,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    issued_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    replaced_by character varying(64),
+    revoked_at timestamp without time zone
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON public.refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_user_id_idx ON public.refresh_tokens (user_id);
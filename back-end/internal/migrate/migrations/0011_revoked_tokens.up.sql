@@ -0,0 +1,14 @@
+-- Access tokens are not stored, so revoking them before they expire needs a list of the revoked ones:
+-- either one token by its jti, or every token of a user issued before issued_before.
+-- There is no foreign key to users, the tokens of a deleted user must stay revoked.
+CREATE TABLE public.revoked_tokens (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    jti character varying(64) UNIQUE,
+    user_id integer,
+    issued_before timestamp without time zone,
+    expires_at timestamp without time zone NOT NULL,
+    revoked_at timestamp without time zone NOT NULL,
+    CHECK (jti IS NOT NULL OR (user_id IS NOT NULL AND issued_before IS NOT NULL))
+);
+
+CREATE INDEX revoked_tokens_expires_at_idx ON public.revoked_tokens (expires_at);
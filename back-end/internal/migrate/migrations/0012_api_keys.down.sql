@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.api_keys_scopes;
+DROP TABLE IF EXISTS public.api_keys;
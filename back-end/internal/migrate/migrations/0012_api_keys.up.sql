@@ -0,0 +1,20 @@
+-- API keys let scripts call the admin api without a user account.
+-- Only the sha256 of a key is stored; its prefix is unique and identifies the key
+-- in lists and logs. The scopes of a key are permissions, like the ones of a role.
+CREATE TABLE public.api_keys (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(255) NOT NULL,
+    prefix character varying(16) NOT NULL UNIQUE,
+    key_hash character varying(64) NOT NULL,
+    created_by integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    revoked_at timestamp without time zone
+);
+
+CREATE TABLE public.api_keys_scopes (
+    api_key_id integer NOT NULL REFERENCES public.api_keys(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission character varying(100) NOT NULL REFERENCES public.permissions(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (api_key_id, permission)
+);
@@ -0,0 +1,5 @@
+-- Users can sign up themselves and have to verify their email before they can log in.
+-- Accounts created before, by the seed or by an admin, count as verified.
+ALTER TABLE public.users ADD COLUMN email_verified_at timestamp without time zone;
+
+UPDATE public.users SET email_verified_at = created_at;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.auth_events;
+DROP TABLE IF EXISTS public.password_resets;
@@ -0,0 +1,23 @@
+-- Tokens emailed to reset a forgotten password. Only their sha256 is stored,
+-- and each works once, before expires_at.
+CREATE TABLE public.password_resets (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone
+);
+
+CREATE INDEX password_resets_user_id_idx ON public.password_resets (user_id);
+
+-- What happened to the credentials of an account, such as a password reset, newest last.
+CREATE TABLE public.auth_events (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    event character varying(50) NOT NULL,
+    ip character varying(45) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX auth_events_user_id_idx ON public.auth_events (user_id);
@@ -0,0 +1,15 @@
+-- Optional TOTP two-factor authentication. totp_secret is set when enrollment starts
+-- and only required at login once totp_enabled_at is set, after the user confirmed a code.
+-- totp_last_step is the time step of the last code accepted, so a code works once.
+ALTER TABLE public.users ADD COLUMN totp_secret character varying(64);
+ALTER TABLE public.users ADD COLUMN totp_enabled_at timestamp without time zone;
+ALTER TABLE public.users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+-- One-time codes to log in without the authenticator, stored as their sha256.
+CREATE TABLE public.recovery_codes (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash character varying(64) NOT NULL,
+    used_at timestamp without time zone,
+    UNIQUE (user_id, code_hash)
+);
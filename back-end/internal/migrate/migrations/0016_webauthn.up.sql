@@ -0,0 +1,26 @@
+-- Passkeys, the WebAuthn credentials users log in with instead of a password.
+-- credential_id is base64url, public_key the COSE_Key of the authenticator.
+CREATE TABLE public.webauthn_credentials (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    credential_id character varying(1400) NOT NULL UNIQUE,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    name character varying(255) NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    last_used_at timestamp without time zone
+);
+
+CREATE INDEX webauthn_credentials_user_id_idx ON public.webauthn_credentials (user_id);
+
+-- Challenges of the ceremonies started and not finished yet, each answered once before expires_at.
+-- user_id is null for a login, where the user is only known from the passkey they pick.
+CREATE TABLE public.webauthn_challenges (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    challenge character varying(64) NOT NULL UNIQUE,
+    ceremony character varying(16) NOT NULL,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    expires_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX webauthn_challenges_expires_at_idx ON public.webauthn_challenges (expires_at);
@@ -0,0 +1,16 @@
+-- Login links asked for by email. Every request is kept, for an address with an account or not,
+-- which is what the number of links an address can ask for per hour is counted from.
+-- Only the links sent have a user and the sha256 of their token, and each works once, before expires_at.
+CREATE TABLE public.magic_links (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    email character varying(255) NOT NULL,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    token_hash character varying(64) UNIQUE,
+    ip character varying(45) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone
+);
+
+CREATE INDEX magic_links_email_idx ON public.magic_links (lower(email), created_at);
+CREATE INDEX magic_links_user_id_idx ON public.magic_links (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.user_identities;
+DROP TABLE IF EXISTS public.oidc_logins;
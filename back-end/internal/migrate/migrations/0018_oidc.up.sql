@@ -0,0 +1,26 @@
+-- Logins sent to the OpenID Connect provider and not back yet, each finished once before expires_at
+-- by the callback bringing back their state. The nonce and the PKCE code_verifier never leave the server.
+CREATE TABLE public.oidc_logins (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    state character varying(64) NOT NULL UNIQUE,
+    nonce character varying(64) NOT NULL,
+    code_verifier character varying(128) NOT NULL,
+    expires_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX oidc_logins_expires_at_idx ON public.oidc_logins (expires_at);
+
+-- The accounts of a provider linked to users, found again by the subject the provider gives them.
+-- email is the one the provider last sent, which may differ from the email of the user.
+CREATE TABLE public.user_identities (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    issuer character varying(255) NOT NULL,
+    subject character varying(255) NOT NULL,
+    email character varying(255) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL,
+    last_login_at timestamp without time zone,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON public.user_identities (user_id);
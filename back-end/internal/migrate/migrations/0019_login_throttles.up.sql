@@ -0,0 +1,14 @@
+-- Failed logins counted per email address (kind 'account', whether an account has it or not)
+-- and per client address (kind 'ip'). No login is tried for a key before locked_until.
+-- The count starts again after a day without failures, and at a successful login for an account.
+CREATE TABLE public.login_throttles (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    kind character varying(16) NOT NULL,
+    key character varying(255) NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp without time zone NOT NULL,
+    locked_until timestamp without time zone,
+    UNIQUE (kind, key)
+);
+
+CREATE INDEX login_throttles_locked_until_idx ON public.login_throttles (locked_until);
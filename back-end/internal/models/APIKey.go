@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// an API key a script authenticates with instead of a user, only its hash is stored
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // the part of the key shown in lists, to tell keys apart
+	Hash       string     `json:"-"`      // sha256 of the whole key
+	Scopes     []string   `json:"scopes"` // permissions granted to the key
+	CreatedBy  int        `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
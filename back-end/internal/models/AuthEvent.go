@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// events recorded in the auth_events table
+const (
+	AuthEventPasswordResetRequested = "password_reset_requested"
+	AuthEventPasswordReset          = "password_reset"
+	AuthEventTwoFactorEnabled       = "2fa_enabled"
+	AuthEventTwoFactorDisabled      = "2fa_disabled"
+	AuthEventRecoveryCodeUsed       = "recovery_code_used"
+	AuthEventPasskeyAdded           = "passkey_added"
+	AuthEventPasskeyRemoved         = "passkey_removed"
+	AuthEventMagicLinkRequested     = "magic_link_requested"
+	AuthEventMagicLinkUsed          = "magic_link_used"
+	AuthEventSSOProvisioned         = "sso_provisioned"
+	AuthEventSSOLinked              = "sso_linked"
+)
+
+// something that happened to the credentials of a user
+type AuthEvent struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Event     string    `json:"event"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
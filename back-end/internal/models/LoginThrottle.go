@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// what failed logins are counted by
+const (
+	LoginThrottleAccount = "account" // the email typed, lower case
+	LoginThrottleIP      = "ip"      // the address of the client
+)
+
+// the failed logins of an email or a client address
+type LoginThrottle struct {
+	ID            int        `json:"id"`
+	Kind          string     `json:"kind"`
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"` // no login is tried before
+}
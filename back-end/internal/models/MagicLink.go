@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// a login link asked for by email, sent when the address has an account
+type MagicLink struct {
+	ID        int        `json:"id"`
+	Email     string     `json:"email"`
+	UserID    int        `json:"user_id,omitempty"` // 0 when no account has the address, nothing was sent
+	TokenHash string     `json:"-"`
+	IP        string     `json:"ip"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
@@ -3,23 +3,43 @@ package models
 import "time"
 
 type Movie struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	ReleaseDate time.Time `json:"release_date"`
-	RunTime     int       `json:"runtime"`
-	MPAARating  string    `json:"mpaa_rating"`
-	Description string    `json:"description"`
-	Image       string    `json:"image"`
-	CreateAt    time.Time `json:"-"`
-	UpdatedAt   time.Time `json:"-"`
-	Genres      []*Genre  `json:"genres,omitempty"`
-	GenresArray []int     `json:"genres_array,omitempty"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	ReleaseDate time.Time  `json:"release_date"`
+	RunTime     int        `json:"runtime"`
+	MPAARating  string     `json:"mpaa_rating"`
+	Description string     `json:"description"`
+	Image       string     `json:"image"`
+	CreateAt    time.Time  `json:"-"`
+	UpdatedAt   time.Time  `json:"-"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // set while the movie is in the trash
+	Version     int        `json:"version"`              // bumped by every change, sent as the ETag of the admin endpoints
+	Genres      []*Genre   `json:"genres,omitempty"`
+	GenresArray []int      `json:"genres_array,omitempty"`
 }
 
 //"-" means that dont include in JSON
 
+// one result of a full text search, the movie fields are inlined in JSON
+type MovieSearchResult struct {
+	*Movie
+	Rank           float64 `json:"rank"`
+	TitleHighlight string  `json:"title_highlight"` // title with the matches wrapped in <b></b>
+	Snippet        string  `json:"snippet"`         // best part of the description, matches wrapped in <b></b>
+}
+
+// a title suggested while the user types
+type MovieSuggestion struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Year  int    `json:"year"`
+	Image string `json:"image"`
+}
+
 type Genre struct {
-	ID      int    `json:"id"`
-	Genre   string `json:"genre"`
-	Checked bool   `json:"checked"`
+	ID        int       `json:"id"`
+	Genre     string    `json:"genre"`
+	Checked   bool      `json:"checked"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 }
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// actions recorded in the revision history
+const (
+	RevisionInsert   = "insert"
+	RevisionUpdate   = "update"
+	RevisionDelete   = "delete"
+	RevisionRestore  = "restore"
+	RevisionRollback = "rollback"
+)
+
+// one immutable entry of the history of a movie
+type MovieRevision struct {
+	ID        int       `json:"id"`
+	MovieID   int       `json:"movie_id"`
+	Revision  int       `json:"revision"` // 1, 2, 3... per movie
+	Action    string    `json:"action"`
+	Snapshot  Movie     `json:"snapshot"` // the movie right after the change, genres in GenresArray
+	UserID    int       `json:"user_id"`  // who made the change
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// one field that differs between two snapshots
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// DiffMovies lists, field by field, what changed from a to b
+func DiffMovies(a, b Movie) []FieldChange {
+	changes := []FieldChange{}
+
+	add := func(field string, from, to interface{}, equal bool) {
+		if !equal {
+			changes = append(changes, FieldChange{Field: field, From: from, To: to})
+		}
+	}
+
+	add("title", a.Title, b.Title, a.Title == b.Title)
+	add("release_date", a.ReleaseDate.Format("2006-01-02"), b.ReleaseDate.Format("2006-01-02"), a.ReleaseDate.Equal(b.ReleaseDate))
+	add("runtime", a.RunTime, b.RunTime, a.RunTime == b.RunTime)
+	add("mpaa_rating", a.MPAARating, b.MPAARating, a.MPAARating == b.MPAARating)
+	add("description", a.Description, b.Description, a.Description == b.Description)
+	add("image", a.Image, b.Image, a.Image == b.Image)
+
+	genresA, genresB := sortedInts(a.GenresArray), sortedInts(b.GenresArray)
+	add("genres", genresA, genresB, equalInts(genresA, genresB))
+
+	add("deleted", a.DeletedAt != nil, b.DeletedAt != nil, (a.DeletedAt != nil) == (b.DeletedAt != nil))
+
+	return changes
+}
+
+func sortedInts(list []int) []int {
+	out := append([]int{}, list...)
+	sort.Ints(out)
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// a one-time code to log in without the authenticator app, stored as its sha256
+type RecoveryCode struct {
+	ID       int        `json:"id"`
+	UserID   int        `json:"user_id"`
+	CodeHash string     `json:"-"`
+	UsedAt   *time.Time `json:"used_at,omitempty"`
+}
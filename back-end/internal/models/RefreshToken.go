@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// a refresh token handed to a client, identified by the jti of the JWT
+type RefreshToken struct {
+	ID         string     `json:"id"`
+	FamilyID   string     `json:"family_id"` // id of the first token of the login it was rotated from
+	UserID     int        `json:"user_id"`
+	IssuedAt   time.Time  `json:"issued_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`     // set when it was exchanged for a new one
+	ReplacedBy string     `json:"replaced_by,omitempty"` // id of that new one
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
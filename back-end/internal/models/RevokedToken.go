@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// a revoked access token, or with an empty JTI every access token of UserID issued before IssuedBefore
+type RevokedToken struct {
+	ID           int        `json:"id"`
+	JTI          string     `json:"jti,omitempty"`
+	UserID       int        `json:"user_id,omitempty"`
+	IssuedBefore *time.Time `json:"issued_before,omitempty"`
+	ExpiresAt    time.Time  `json:"expires_at"` // every token it matches has expired by then, so it can be forgotten
+	RevokedAt    time.Time  `json:"revoked_at"`
+}
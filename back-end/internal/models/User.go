@@ -8,13 +8,45 @@ import (
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	Lastname  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdateAt  time.Time `json:"-"`
+	ID         int        `json:"id"`
+	FirstName  string     `json:"first_name"`
+	Lastname   string     `json:"last_name"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	Password   string     `json:"-"` // bcrypt hash, never sent to clients
+	CreatedAt  time.Time  `json:"-"`
+	UpdateAt   time.Time  `json:"-"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"` // a disabled user can not log in
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"` // a user can not log in before verifying their email
+
+	// two-factor authentication, required at login once enabled
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at,omitempty"`
+	TOTPLastStep  int64      `json:"-"` // time step of the last code accepted
+}
+
+// cost of the bcrypt hashes, same as the seeded users
+const passwordCost = 14
+
+// SetPassword replaces the password of the user with the bcrypt hash of plainText
+func (u *User) SetPassword(plainText string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainText), passwordCost)
+	if err != nil {
+		return err
+	}
+
+	u.Password = string(hash)
+	return nil
+}
+
+// hash of a random password nobody knows, with the cost of passwordCost
+const nobodysPassword = "$2a$14$N/Lzibu7nj2zswlu9AMiP.HdUKN93oSIySUZWtsoT8Byn9NQ7d/Z2"
+
+// PasswordMatchesNobody takes the time of PasswordMatches and never matches, to answer a login
+// for an unknown email or a user without a password as slowly as one with a wrong password
+func PasswordMatchesNobody(plainText string) {
+	_ = bcrypt.CompareHashAndPassword([]byte(nobodysPassword), []byte(plainText))
 }
 
 func (u *User) PasswordMatches(plainText string) (bool, error) {
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// an account of an OpenID Connect provider, linked to a user
+type UserIdentity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email"` // as last sent by the provider
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// a login sent to an OpenID Connect provider, waiting for its callback
+type OIDCLogin struct {
+	ID           int       `json:"id"`
+	State        string    `json:"-"`
+	Nonce        string    `json:"-"`
+	CodeVerifier string    `json:"-"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
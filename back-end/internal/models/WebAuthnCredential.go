@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// a passkey registered by a user to log in without a password
+type WebAuthnCredential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	CredentialID string     `json:"credential_id"` // base64url
+	PublicKey    []byte     `json:"-"`             // COSE_Key
+	SignCount    int64      `json:"-"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// the ceremonies a challenge is issued for
+const (
+	WebAuthnRegistration = "registration"
+	WebAuthnLogin        = "login"
+)
+
+// the challenge of a WebAuthn ceremony started and not finished yet
+type WebAuthnChallenge struct {
+	ID        int       `json:"id"`
+	Challenge string    `json:"challenge"` // base64url
+	Ceremony  string    `json:"ceremony"`
+	UserID    int       `json:"user_id,omitempty"` // 0 for a login, the user is known from the passkey
+	ExpiresAt time.Time `json:"expires_at"`
+}
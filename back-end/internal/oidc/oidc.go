@@ -0,0 +1,344 @@
+// Package oidc logs users in with an OpenID Connect provider, such as a company SSO.
+//
+// It runs the authorization code flow with PKCE (RFC 7636): the endpoints of the provider
+// come from its discovery document, and the ID token it returns is verified with the keys
+// of its JWKS, which is fetched again when a token is signed with a key not seen yet.
+package oidc
+
+import (
+	"backend/internal/jwtkeys"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signing algorithms accepted for ID tokens, when the provider supports them.
+// Tokens signed with the client secret (HS256) are not accepted.
+var supportedAlgorithms = []string{"RS256", "ES256", "EdDSA", "PS256"}
+
+// largest response read from the provider
+const maxResponseSize = 1 << 20
+
+var (
+	ErrIDTokenInvalid = errors.New("invalid ID token")
+	ErrIDTokenExpired = errors.New("ID token is expired")
+	ErrNonce          = errors.New("ID token is for another login")
+)
+
+// Config is what the provider knows about us, the client
+type Config struct {
+	Issuer       string // URL of the provider, its discovery document is under /.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string // empty for a public client, PKCE alone then protects the code
+	RedirectURL  string // our callback, registered with the provider
+	Scopes       []string
+	ClockSkew    time.Duration // leeway on the exp and iat claims
+
+	HTTPClient *http.Client // http.DefaultClient when nil
+}
+
+// Provider is an OpenID Connect provider. It is safe for concurrent use.
+type Provider struct {
+	Config
+
+	authURL    string
+	tokenURL   string
+	jwksURL    string
+	algorithms []string
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey // kid -> key
+}
+
+// the fields of the discovery document we use
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	IDTokenSigningAlgs    []string `json:"id_token_signing_alg_values_supported"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// Factory method to read the discovery document of the provider of config
+func New(ctx context.Context, config Config) (*Provider, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	p := &Provider{Config: config}
+
+	var doc discovery
+	err := p.getJSON(ctx, strings.TrimSuffix(config.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+
+	// the issuer of the document must be the one configured, or tokens would be accepted from anyone it names
+	if doc.Issuer != config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", doc.Issuer, config.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	if len(doc.CodeChallengeMethods) > 0 && !contains(doc.CodeChallengeMethods, "S256") {
+		return nil, errors.New("discovery: the provider does not support PKCE with S256")
+	}
+
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+
+	// RS256 is the algorithm every provider must support
+	advertised := doc.IDTokenSigningAlgs
+	if len(advertised) == 0 {
+		advertised = []string{"RS256"}
+	}
+	for _, alg := range supportedAlgorithms {
+		if contains(advertised, alg) {
+			p.algorithms = append(p.algorithms, alg)
+		}
+	}
+	if len(p.algorithms) == 0 {
+		return nil, fmt.Errorf("discovery: no supported ID token algorithm in %v", advertised)
+	}
+
+	return p, nil
+}
+
+// Random returns a random value for a state, a nonce or a PKCE code verifier
+func Random() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL is where to send the browser to log in. The state comes back with the code,
+// the nonce in the ID token, and the verifier has to be sent with the code to get the tokens.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(p.authURL, "?") {
+		separator = "&"
+	}
+	return p.authURL + separator + query.Encode()
+}
+
+// Exchange trades the code of the callback for the tokens of the user, and returns the ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic, the default authentication method of clients
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(&tokens)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s without an ID token", res.Status)
+	}
+
+	return tokens.IDToken, nil
+}
+
+// Claims are the claims of an ID token about the user
+type Claims struct {
+	Email           string `json:"email"`
+	EmailVerified   flag   `json:"email_verified"`
+	Name            string `json:"name"`
+	GivenName       string `json:"given_name"`
+	FamilyName      string `json:"family_name"`
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// a boolean claim, which some providers send as a string
+type flag bool
+
+func (f *flag) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*f = true
+	case "false", `"false"`, "null":
+		*f = false
+	default:
+		return errors.New("invalid boolean claim")
+	}
+	return nil
+}
+
+// VerifyIDToken checks the ID token was signed by the provider for us, for the login that sent nonce,
+// and returns its claims
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(p.algorithms), jwt.WithoutClaimsValidation())
+
+	var claims Claims
+	_, err := parser.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDTokenInvalid, err)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrIDTokenInvalid, claims.Issuer)
+	case !contains(claims.Audience, p.ClientID):
+		return nil, fmt.Errorf("%w: issued for another client", ErrIDTokenInvalid)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return nil, fmt.Errorf("%w: issued for another client", ErrIDTokenInvalid)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrIDTokenInvalid)
+	case claims.ExpiresAt == nil || !now.Before(claims.ExpiresAt.Add(p.ClockSkew)):
+		return nil, ErrIDTokenExpired
+	case claims.IssuedAt != nil && now.Add(p.ClockSkew).Before(claims.IssuedAt.Time):
+		return nil, fmt.Errorf("%w: issued in the future", ErrIDTokenInvalid)
+	case claims.Nonce == "" || claims.Nonce != nonce:
+		return nil, ErrNonce
+	}
+
+	return &claims, nil
+}
+
+// the key with kid, fetching the JWKS again when it is not known yet
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.lookup(kid)
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// a kid never seen is a key the provider rotated in. ID tokens come from the token endpoint,
+	// not from the browser, so nobody can make us fetch the JWKS for every request.
+	// The lock is not held during the fetch, a slow provider must not hold up the logins with known keys.
+	var set jwtkeys.JWKS
+	err := p.getJSON(ctx, p.jwksURL, &set)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// one key we can not read does not make the others unusable
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// logins fetching at the same time all get the set of the provider, the last one is kept
+	p.keys = keys
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// caller must hold the lock. A token without kid is only accepted when there is a single key.
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(dst)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package oidc_test
+
+import (
+	"backend/internal/oidc"
+	"backend/internal/oidc/oidctest"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const redirectURL = "http://client.test/callback"
+
+// start a mock provider and the client of it
+func start(t *testing.T) (*oidctest.Provider, *oidc.Provider) {
+	t.Helper()
+
+	mock, err := oidctest.Start("movies", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mock.Close)
+
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:       mock.Issuer,
+		ClientID:     "movies",
+		ClientSecret: "secret",
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		ClockSkew:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock, p
+}
+
+// authorize goes to the authorization URL as the browser would, and returns the query of the callback
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("authorize: %s, no redirect: %v", res.Status, err)
+	}
+	if !strings.HasPrefix(location.String(), redirectURL+"?") {
+		t.Fatalf("redirected to %s", location)
+	}
+	return location.Query()
+}
+
+func random(t *testing.T) string {
+	t.Helper()
+
+	value, err := oidc.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestLoginRoundTrip(t *testing.T) {
+	_, p := start(t)
+	state, nonce, verifier := random(t), random(t), random(t)
+
+	callback := authorize(t, p.AuthCodeURL(state, nonce, verifier))
+	if callback.Get("state") != state || callback.Get("code") == "" {
+		t.Fatalf("callback %v for state %s", callback, state)
+	}
+
+	idToken, err := p.Exchange(context.Background(), callback.Get("code"), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.VerifyIDToken(context.Background(), idToken, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "user@example.com" || !bool(claims.EmailVerified) || claims.Subject != "1" {
+		t.Fatalf("claims %+v", claims)
+	}
+
+	// a code is traded once
+	_, err = p.Exchange(context.Background(), callback.Get("code"), verifier)
+	if err == nil {
+		t.Fatal("code traded twice")
+	}
+}
+
+func TestExchangeNeedsVerifier(t *testing.T) {
+	_, p := start(t)
+
+	callback := authorize(t, p.AuthCodeURL(random(t), random(t), random(t)))
+
+	// a code stolen on its way to the callback is useless without the verifier of the login
+	_, err := p.Exchange(context.Background(), callback.Get("code"), random(t))
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("got %v, want invalid_grant", err)
+	}
+}
+
+func TestVerifyIDTokenRejected(t *testing.T) {
+	mock, p := start(t)
+
+	other, err := oidctest.New(mock.Issuer, "movies", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func() jwt.MapClaims {
+		now := time.Now()
+		return jwt.MapClaims{
+			"iss":   mock.Issuer,
+			"aud":   "movies",
+			"sub":   "1",
+			"email": "user@example.com",
+			"nonce": "nonce",
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+		}
+	}
+
+	// the claims as they are make a good token, each case below breaks one thing
+	token, err := mock.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.VerifyIDToken(context.Background(), token, "nonce")
+	if err != nil {
+		t.Fatalf("good token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() (string, error)
+		want  error
+	}{
+		{"signed by another key", func() (string, error) {
+			return other.Sign(claims())
+		}, oidc.ErrIDTokenInvalid},
+		{"payload changed after signing", func() (string, error) {
+			token, err := mock.Sign(claims())
+			if err != nil {
+				return "", err
+			}
+			forged := claims()
+			forged["sub"] = "2"
+			unsigned, err := jwt.NewWithClaims(jwt.SigningMethodRS256, forged).SigningString()
+			if err != nil {
+				return "", err
+			}
+
+			// the header and signature of the token, around the payload of forged
+			parts := strings.Split(token, ".")
+			parts[1] = strings.Split(unsigned, ".")[1]
+			return strings.Join(parts, "."), nil
+		}, oidc.ErrIDTokenInvalid},
+		{"other issuer", func() (string, error) {
+			c := claims()
+			c["iss"] = "https://evil.test"
+			return mock.Sign(c)
+		}, oidc.ErrIDTokenInvalid},
+		{"other audience", func() (string, error) {
+			c := claims()
+			c["aud"] = "another-client"
+			return mock.Sign(c)
+		}, oidc.ErrIDTokenInvalid},
+		{"other nonce", func() (string, error) {
+			c := claims()
+			c["nonce"] = "another login"
+			return mock.Sign(c)
+		}, oidc.ErrNonce},
+		{"expired", func() (string, error) {
+			c := claims()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return mock.Sign(c)
+		}, oidc.ErrIDTokenExpired},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.VerifyIDToken(context.Background(), token, "nonce")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestKeyFetchDoesNotBlockKnownKeys(t *testing.T) {
+	mock, err := oidctest.Start("movies", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mock.Close)
+
+	// the JWKS requests wait for release once blocked is closed
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/jwks" {
+			select {
+			case <-blocked:
+				<-release
+			default:
+			}
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:      mock.Issuer,
+		ClientID:    "movies",
+		RedirectURL: redirectURL,
+		ClockSkew:   time.Minute,
+		HTTPClient:  &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func() string {
+		now := time.Now()
+		token, err := mock.Sign(jwt.MapClaims{
+			"iss": mock.Issuer, "aud": "movies", "sub": "1", "nonce": "nonce",
+			"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	known := sign()
+	_, err = p.VerifyIDToken(context.Background(), known, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token of a key rotated in makes the provider fetch the JWKS again, slowly
+	err = mock.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := sign()
+	close(blocked)
+	done := make(chan error)
+	go func() {
+		_, err := p.VerifyIDToken(context.Background(), rotated, "nonce")
+		done <- err
+	}()
+
+	verified := make(chan error)
+	go func() {
+		// give the fetch a moment to start
+		time.Sleep(50 * time.Millisecond)
+		_, err := p.VerifyIDToken(context.Background(), known, "nonce")
+		verified <- err
+	}()
+
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Fatalf("known key during the fetch: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a token of a known key waited for the JWKS fetch")
+	}
+
+	once.Do(func() { close(release) })
+	if err := <-done; err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Package oidctest is an OpenID Connect provider that logs in a configured user without asking,
+// to run the login of a client without a real provider, such as in tests or on a laptop.
+package oidctest
+
+import (
+	"backend/internal/jwtkeys"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// how long the ID tokens issued are valid
+const idTokenExpiry = 5 * time.Minute
+
+// User is who logs in at the provider
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// Provider serves the discovery document, JWKS, authorization and token endpoints
+// of an issuer, and signs its ID tokens with an RS256 key. It is safe for concurrent use.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for a public client
+
+	mu     sync.Mutex
+	user   User
+	key    *rsa.PrivateKey
+	keyID  string
+	codes  map[string]authorization // code -> login it was issued for
+	server *httptest.Server
+}
+
+// what the authorization endpoint was asked, checked when its code is exchanged
+type authorization struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	user        User
+}
+
+// New returns a provider for issuer, which must be the URL it is served at
+func New(issuer, clientID, clientSecret string) (*Provider, error) {
+	p := &Provider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		user:         User{Subject: "1", Email: "user@example.com", EmailVerified: true, GivenName: "Test", FamilyName: "User"},
+		codes:        make(map[string]authorization),
+	}
+
+	err := p.RotateKey()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start serves a new provider on a local port, its issuer is the URL of the server
+func Start(clientID, clientSecret string) (*Provider, error) {
+	p, err := New("", clientID, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	p.server = httptest.NewServer(p)
+	p.Issuer = p.server.URL
+	return p, nil
+}
+
+// Close stops the server of a provider returned by Start
+func (p *Provider) Close() {
+	if p.server != nil {
+		p.server.Close()
+	}
+}
+
+// SetUser changes who the next logins are for
+func (p *Provider) SetUser(user User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+// RotateKey replaces the signing key by a new one, with a new kid
+func (p *Provider) RotateKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	kid, err := random(8)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key, p.keyID = key, kid
+	return nil
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		p.discovery(w)
+	case "/jwks":
+		p.jwks(w)
+	case "/authorize":
+		p.authorize(w, r)
+	case "/token":
+		p.token(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	enc := base64.RawURLEncoding
+	writeJSON(w, http.StatusOK, jwtkeys.JWKS{Keys: []jwtkeys.JWK{{
+		KeyType:   "RSA",
+		Use:       "sig",
+		KeyID:     p.keyID,
+		Algorithm: "RS256",
+		N:         enc.EncodeToString(p.key.N.Bytes()),
+		E:         enc.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+// logs the user in at once and sends the browser back to the client with a code
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("response_type") != "code" || query.Get("client_id") != p.ClientID || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	code, err := random(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.mu.Lock()
+	p.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		user:        p.user,
+	}
+	p.mu.Unlock()
+
+	callback := url.Values{"code": {code}, "state": {query.Get("state")}}
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+callback.Encode(), http.StatusFound)
+}
+
+// trades a code, once, for an ID token
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	code := r.PostForm.Get("code")
+	auth, ok := p.codes[code]
+	delete(p.codes, code)
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || auth.redirectURI != r.PostForm.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.Issuer,
+		"aud":            p.ClientID,
+		"sub":            auth.user.Subject,
+		"email":          auth.user.Email,
+		"email_verified": auth.user.EmailVerified,
+		"given_name":     auth.user.GivenName,
+		"family_name":    auth.user.FamilyName,
+		"iat":            now.Unix(),
+		"exp":            now.Add(idTokenExpiry).Unix(),
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "not-used",
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenExpiry.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// Sign signs claims with the key of the provider, such as an ID token it would never issue,
+// to check a client rejects it
+func (p *Provider) Sign(claims jwt.MapClaims) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sign(claims)
+}
+
+// caller must hold the lock
+func (p *Provider) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.keyID
+	return token.SignedString(p.key)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,2485 @@
+package dbrepo
+
+import (
+	"backend/internal/models"
+	"backend/internal/repository"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MemoryDBRepo is an implementation of DatabaseRepo that keeps every table in memory.
+// It is meant for local development (no Docker/Postgres needed) and for tests.
+// All methods are safe for concurrent use and fail with ctx.Err() once the caller's context is done.
+type MemoryDBRepo struct {
+	mu *sync.RWMutex
+	*memoryData
+
+	inTx bool // true on the copy handed to WithTx callbacks, which already holds mu
+}
+
+// memoryData holds the tables, it is copied as a whole to run a transaction
+type memoryData struct {
+	movies      map[int]models.Movie
+	genres      map[int]models.Genre
+	users       map[int]models.User
+	roles       map[string]models.Role         // role name -> role and its permissions
+	refresh     map[string]models.RefreshToken // jti -> refresh token
+	revoked     []models.RevokedToken          // the access token revocation list, oldest first
+	apiKeys     map[int]models.APIKey
+	resets      []models.PasswordReset
+	authEvents  []models.AuthEvent            // oldest first
+	magicLinks  []models.MagicLink            // oldest first
+	recovery    map[int][]models.RecoveryCode // user id -> recovery codes
+	passkeys    map[int]models.WebAuthnCredential
+	challenges  map[string]models.WebAuthnChallenge // challenge -> ceremony waiting for it
+	oidcLogins  map[string]models.OIDCLogin         // state -> login waiting for its callback
+	identities  map[int]models.UserIdentity
+	throttles   map[int]models.LoginThrottle
+	movieGenres map[int][]int                  // movie id -> genre ids (the movies_genres table)
+	revisions   map[int][]models.MovieRevision // movie id -> history, oldest first
+
+	nextMovieID        int
+	nextGenreID        int
+	nextUserID         int
+	nextRevokedTokenID int
+	nextAPIKeyID       int
+	nextResetID        int
+	nextAuthEventID    int
+	nextPasskeyID      int
+	nextChallengeID    int
+	nextMagicLinkID    int
+	nextOIDCLoginID    int
+	nextIdentityID     int
+	nextThrottleID     int
+}
+
+// the roles created by the 0009_roles migration
+var defaultRoles = []models.Role{
+	{Name: models.RoleViewer, Description: "can browse the admin catalogue",
+		Permissions: []string{"movies:read"}},
+	{Name: models.RoleEditor, Description: "can add and edit movies and genres",
+		Permissions: []string{"genres:write", "movies:read", "movies:write"}},
+	{Name: models.RoleAdmin, Description: "can do everything, including deleting movies and managing users",
+		Permissions: []string{"genres:write", "movies:delete", "movies:read", "movies:write", "users:read", "users:write"}},
+}
+
+// Factory method to create an in-memory repository without movies or users
+func NewMemoryDBRepo() *MemoryDBRepo {
+	roles := make(map[string]models.Role)
+	for _, role := range defaultRoles {
+		roles[role.Name] = role
+	}
+
+	return &MemoryDBRepo{
+		mu: &sync.RWMutex{},
+		memoryData: &memoryData{
+			movies:             make(map[int]models.Movie),
+			genres:             make(map[int]models.Genre),
+			users:              make(map[int]models.User),
+			roles:              roles,
+			refresh:            make(map[string]models.RefreshToken),
+			apiKeys:            make(map[int]models.APIKey),
+			recovery:           make(map[int][]models.RecoveryCode),
+			passkeys:           make(map[int]models.WebAuthnCredential),
+			challenges:         make(map[string]models.WebAuthnChallenge),
+			oidcLogins:         make(map[string]models.OIDCLogin),
+			identities:         make(map[int]models.UserIdentity),
+			throttles:          make(map[int]models.LoginThrottle),
+			movieGenres:        make(map[int][]int),
+			revisions:          make(map[int][]models.MovieRevision),
+			nextMovieID:        1,
+			nextGenreID:        1,
+			nextUserID:         1,
+			nextRevokedTokenID: 1,
+			nextAPIKeyID:       1,
+			nextResetID:        1,
+			nextAuthEventID:    1,
+		},
+	}
+}
+
+// deep copy of every table
+func (d *memoryData) clone() *memoryData {
+	c := *d
+
+	c.movies = make(map[int]models.Movie, len(d.movies))
+	for k, v := range d.movies {
+		c.movies[k] = v
+	}
+	c.genres = make(map[int]models.Genre, len(d.genres))
+	for k, v := range d.genres {
+		c.genres[k] = v
+	}
+	c.users = make(map[int]models.User, len(d.users))
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+	c.roles = make(map[string]models.Role, len(d.roles))
+	for k, v := range d.roles {
+		v.Permissions = append([]string(nil), v.Permissions...)
+		c.roles[k] = v
+	}
+	c.refresh = make(map[string]models.RefreshToken, len(d.refresh))
+	for k, v := range d.refresh {
+		c.refresh[k] = v
+	}
+	c.revoked = append([]models.RevokedToken(nil), d.revoked...)
+	c.resets = append([]models.PasswordReset(nil), d.resets...)
+	c.authEvents = append([]models.AuthEvent(nil), d.authEvents...)
+	c.magicLinks = append([]models.MagicLink(nil), d.magicLinks...)
+	c.passkeys = make(map[int]models.WebAuthnCredential, len(d.passkeys))
+	for k, v := range d.passkeys {
+		c.passkeys[k] = v
+	}
+	c.challenges = make(map[string]models.WebAuthnChallenge, len(d.challenges))
+	for k, v := range d.challenges {
+		c.challenges[k] = v
+	}
+	c.oidcLogins = make(map[string]models.OIDCLogin, len(d.oidcLogins))
+	for k, v := range d.oidcLogins {
+		c.oidcLogins[k] = v
+	}
+	c.identities = make(map[int]models.UserIdentity, len(d.identities))
+	for k, v := range d.identities {
+		c.identities[k] = v
+	}
+	c.throttles = make(map[int]models.LoginThrottle, len(d.throttles))
+	for k, v := range d.throttles {
+		c.throttles[k] = v
+	}
+	c.recovery = make(map[int][]models.RecoveryCode, len(d.recovery))
+	for k, v := range d.recovery {
+		c.recovery[k] = append([]models.RecoveryCode(nil), v...)
+	}
+	c.apiKeys = make(map[int]models.APIKey, len(d.apiKeys))
+	for k, v := range d.apiKeys {
+		v.Scopes = append([]string(nil), v.Scopes...)
+		c.apiKeys[k] = v
+	}
+	c.movieGenres = make(map[int][]int, len(d.movieGenres))
+	for k, v := range d.movieGenres {
+		c.movieGenres[k] = append([]int(nil), v...)
+	}
+
+	// revisions are never modified, copying the slices is enough
+	c.revisions = make(map[int][]models.MovieRevision, len(d.revisions))
+	for k, v := range d.revisions {
+		c.revisions[k] = append([]models.MovieRevision(nil), v...)
+	}
+
+	return &c
+}
+
+// take the write lock, unless we run inside WithTx which already holds it
+func (m *MemoryDBRepo) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// take the read lock, unless we run inside WithTx which already holds the write lock
+func (m *MemoryDBRepo) rlock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.RLock()
+	return m.mu.RUnlock
+}
+
+// WithTx runs fn against a private copy of the tables and publishes the copy only if fn returns nil.
+// Transactions are serialized with every other access to the repository.
+func (m *MemoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := &MemoryDBRepo{mu: m.mu, memoryData: m.memoryData.clone(), inTx: true}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	*m.memoryData = *tx.memoryData
+	return nil
+}
+
+// fixture is the layout of the JSON seed file, one list per table.
+// It has its own json tags so it does not depend on how models are serialized to clients.
+type fixture struct {
+	Genres []struct {
+		ID    int    `json:"id"`
+		Genre string `json:"genre"`
+	} `json:"genres"`
+	Movies []struct {
+		ID          int    `json:"id"`
+		Title       string `json:"title"`
+		ReleaseDate string `json:"release_date"` // formatted as 2006-01-02
+		RunTime     int    `json:"runtime"`
+		MPAARating  string `json:"mpaa_rating"`
+		Description string `json:"description"`
+		Image       string `json:"image"`
+		Genres      []int  `json:"genres"` // rows of movies_genres for this movie
+	} `json:"movies"`
+	Users []struct {
+		ID        int    `json:"id"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"` // bcrypt hash
+		Role      string `json:"role"`     // viewer when empty
+	} `json:"users"`
+}
+
+// LoadFixture seeds the repository from a JSON fixture file
+func (m *MemoryDBRepo) LoadFixture(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return m.Seed(f)
+}
+
+// Seed reads a JSON fixture from r and adds its rows to the repository
+func (m *MemoryDBRepo) Seed(r io.Reader) error {
+	var data fixture
+	err := json.NewDecoder(r).Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	now := time.Now()
+
+	for _, g := range data.Genres {
+		m.genres[g.ID] = models.Genre{ID: g.ID, Genre: g.Genre, CreatedAt: now, UpdatedAt: now}
+		if g.ID >= m.nextGenreID {
+			m.nextGenreID = g.ID + 1
+		}
+	}
+
+	for _, mv := range data.Movies {
+		releaseDate, err := time.Parse("2006-01-02", mv.ReleaseDate)
+		if err != nil {
+			return fmt.Errorf("movie %d: invalid release_date: %w", mv.ID, err)
+		}
+
+		for _, genreID := range mv.Genres {
+			if _, ok := m.genres[genreID]; !ok {
+				return fmt.Errorf("movie %d: genre %d does not exist", mv.ID, genreID)
+			}
+		}
+
+		m.movies[mv.ID] = models.Movie{
+			ID:          mv.ID,
+			Title:       mv.Title,
+			ReleaseDate: releaseDate,
+			RunTime:     mv.RunTime,
+			MPAARating:  mv.MPAARating,
+			Description: mv.Description,
+			Image:       mv.Image,
+			CreateAt:    now,
+			UpdatedAt:   now,
+			Version:     1,
+		}
+		m.movieGenres[mv.ID] = append([]int(nil), mv.Genres...)
+		if mv.ID >= m.nextMovieID {
+			m.nextMovieID = mv.ID + 1
+		}
+	}
+
+	for _, u := range data.Users {
+		if u.Role == "" {
+			u.Role = models.RoleViewer
+		}
+		if _, ok := m.roles[u.Role]; !ok {
+			return fmt.Errorf("user %d: role %s does not exist", u.ID, u.Role)
+		}
+
+		m.users[u.ID] = models.User{
+			ID:        u.ID,
+			FirstName: u.FirstName,
+			Lastname:  u.LastName,
+			Email:     u.Email,
+			Password:  u.Password,
+			Role:      u.Role,
+			CreatedAt: now,
+			UpdateAt:  now,
+
+			// like the users existing before the 0013_email_verification migration
+			EmailVerifiedAt: &now,
+		}
+		if u.ID >= m.nextUserID {
+			m.nextUserID = u.ID + 1
+		}
+	}
+
+	return nil
+}
+
+// there is no SQL database behind this repository
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+func (m *MemoryDBRepo) AllMovies(ctx context.Context, genre ...int) ([]*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var movies []*models.Movie
+
+	for _, movie := range m.movies {
+		//movies in the trash are never listed
+		if movie.DeletedAt != nil {
+			continue
+		}
+		if len(genre) > 0 && !containsInt(m.movieGenres[movie.ID], genre[0]) {
+			continue
+		}
+
+		//copy the movie so callers never share memory with the store
+		movie := movie
+		movies = append(movies, &movie)
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		return movies[i].Title < movies[j].Title
+	})
+
+	return movies, nil
+}
+
+func (m *MemoryDBRepo) ListMovies(ctx context.Context, opts repository.MovieListOptions) (*repository.MovieList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *repository.MovieCursor
+	var pivot *models.Movie
+	if opts.Cursor != "" {
+		c, err := repository.DecodeMovieCursor(opts.Cursor, opts)
+		if err != nil {
+			return nil, err
+		}
+		pivot, err = c.Movie()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &c
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var movies []*models.Movie
+	for _, movie := range m.movies {
+		if !m.matches(movie, opts) {
+			continue
+		}
+		movie := movie
+		movies = append(movies, &movie)
+	}
+	total := len(movies)
+
+	// a cursor to the previous page walks the list backwards
+	descending := opts.Descending
+	if cursor != nil && cursor.Before {
+		descending = !descending
+	}
+
+	// order of the walk, negative when a comes first
+	order := func(a, b *models.Movie) int {
+		c := repository.CompareMovies(a, b, opts.Sort)
+		if descending {
+			return -c
+		}
+		return c
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		return order(movies[i], movies[j]) < 0
+	})
+
+	start := 0
+	if cursor != nil {
+		// skip up to and including the cursor position
+		for start < len(movies) && order(movies[start], pivot) <= 0 {
+			start++
+		}
+	} else {
+		start = (opts.Page - 1) * opts.Limit
+	}
+
+	end := start + opts.Limit + 1
+	if start > len(movies) {
+		start = len(movies)
+	}
+	if end > len(movies) {
+		end = len(movies)
+	}
+
+	return repository.PageMovies(movies[start:end], total, opts, cursor), nil
+}
+
+// whether movie passes the filters of opts, caller must hold the lock
+func (m *MemoryDBRepo) matches(movie models.Movie, opts repository.MovieListOptions) bool {
+	//movies in the trash are never listed
+	if movie.DeletedAt != nil {
+		return false
+	}
+
+	if len(opts.Genres) > 0 {
+		found := false
+		for _, genreID := range opts.Genres {
+			if containsInt(m.movieGenres[movie.ID], genreID) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(opts.MPAARatings) > 0 {
+		found := false
+		for _, rating := range opts.MPAARatings {
+			if movie.MPAARating == rating {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	year := movie.ReleaseDate.Year()
+	if opts.YearFrom > 0 && year < opts.YearFrom {
+		return false
+	}
+	if opts.YearTo > 0 && year > opts.YearTo {
+		return false
+	}
+
+	if opts.RuntimeMin > 0 && movie.RunTime < opts.RuntimeMin {
+		return false
+	}
+	if opts.RuntimeMax > 0 && movie.RunTime > opts.RuntimeMax {
+		return false
+	}
+
+	return true
+}
+
+// SearchMovies matches whole words (no stemming) and ranks title matches above description matches,
+// close enough to the Postgres full text search for development
+func (m *MemoryDBRepo) SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	terms, err := repository.ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var results []*models.MovieSearchResult
+
+	for _, movie := range m.movies {
+		if movie.DeletedAt != nil {
+			continue
+		}
+
+		title := wordSpans(movie.Title)
+		description := wordSpans(movie.Description)
+
+		rank := 0.0
+		matched := true
+		for _, term := range terms {
+			inTitle := markMatches(title, term)
+			inDescription := markMatches(description, term)
+			if inTitle+inDescription == 0 {
+				matched = false
+				break
+			}
+			rank += float64(inTitle) + 0.4*float64(inDescription)
+		}
+		if !matched {
+			continue
+		}
+
+		movie := movie
+		results = append(results, &models.MovieSearchResult{
+			Movie:          &movie,
+			Rank:           rank,
+			TitleHighlight: highlight(movie.Title, title),
+			Snippet:        highlight(movie.Description, description),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Title < results[j].Title
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// SuggestMovies mimics the Postgres version with a Go port of the pg_trgm similarity
+func (m *MemoryDBRepo) SuggestMovies(ctx context.Context, prefix string, limit int) ([]*models.MovieSuggestion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return nil, repository.ErrEmptySearch
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	type candidate struct {
+		movie     models.Movie
+		startsAt  bool // title starts with the prefix
+		wordStart bool // a word of the title starts with the prefix
+		score     float64
+	}
+
+	var candidates []candidate
+
+	for _, movie := range m.movies {
+		if movie.DeletedAt != nil {
+			continue
+		}
+
+		title := strings.ToLower(movie.Title)
+		c := candidate{
+			movie:     movie,
+			startsAt:  strings.HasPrefix(title, prefix),
+			wordStart: strings.Contains(title, " "+prefix),
+		}
+
+		similarity := trigramSimilarity(title, prefix)
+		wordSimilarity := bestWindowSimilarity(title, prefix)
+		c.score = similarity
+		if wordSimilarity > c.score {
+			c.score = wordSimilarity
+		}
+
+		// same thresholds as pg_trgm: 0.3 for %, 0.6 for <%
+		if c.startsAt || c.wordStart || similarity >= 0.3 || wordSimilarity >= 0.6 {
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.startsAt != b.startsAt {
+			return a.startsAt
+		}
+		if a.wordStart != b.wordStart {
+			return a.wordStart
+		}
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return a.movie.Title < b.movie.Title
+	})
+
+	var suggestions []*models.MovieSuggestion
+	for _, c := range candidates {
+		if limit > 0 && len(suggestions) == limit {
+			break
+		}
+		suggestions = append(suggestions, &models.MovieSuggestion{
+			ID:    c.movie.ID,
+			Title: c.movie.Title,
+			Year:  c.movie.ReleaseDate.Year(),
+			Image: c.movie.Image,
+		})
+	}
+
+	return suggestions, nil
+}
+
+// trigrams of s the way pg_trgm builds them: per word, padded with two spaces in front and one behind
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range repository.SearchWords(s) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// shared trigrams over all distinct trigrams, between 0 and 1
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// best similarity between query and any run of as many consecutive words of text,
+// an approximation of word_similarity
+func bestWindowSimilarity(text, query string) float64 {
+	words := repository.SearchWords(text)
+	n := len(repository.SearchWords(query))
+	if n == 0 {
+		return 0
+	}
+
+	best := 0.0
+	for i := 0; i+n <= len(words); i++ {
+		similarity := trigramSimilarity(strings.Join(words[i:i+n], " "), query)
+		if similarity > best {
+			best = similarity
+		}
+	}
+	return best
+}
+
+// a word of a text and where it is
+type wordSpan struct {
+	start, end int
+	word       string // lowercased
+	matched    bool
+}
+
+func wordSpans(text string) []wordSpan {
+	var spans []wordSpan
+
+	start := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			spans = append(spans, wordSpan{start: start, end: i, word: strings.ToLower(text[start:i])})
+			start = -1
+		}
+	}
+
+	return spans
+}
+
+// flag the words matching term and return how many times it matched
+func markMatches(spans []wordSpan, term repository.SearchTerm) int {
+	count := 0
+	for i := 0; i+len(term.Words) <= len(spans); i++ {
+		ok := true
+		for k, w := range term.Words {
+			word := spans[i+k].word
+			if k == len(term.Words)-1 && term.Prefix {
+				ok = ok && strings.HasPrefix(word, w)
+			} else {
+				ok = ok && word == w
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		count++
+		for k := range term.Words {
+			spans[i+k].matched = true
+		}
+	}
+	return count
+}
+
+// wrap the matched words of text in <b></b>, like ts_headline does
+func highlight(text string, spans []wordSpan) string {
+	var b strings.Builder
+	last := 0
+	for _, span := range spans {
+		if !span.matched {
+			continue
+		}
+		b.WriteString(text[last:span.start])
+		b.WriteString("<b>" + text[span.start:span.end] + "</b>")
+		last = span.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (m *MemoryDBRepo) OneMovie(ctx context.Context, id int) (*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	movie, ok := m.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	movie.Genres = m.genresOf(id)
+	return &movie, nil
+}
+
+func (m *MemoryDBRepo) OneMovieForEdit(ctx context.Context, id int) (*models.Movie, []*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	movie, ok := m.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	genres := m.genresOf(id)
+
+	var genresArray []int
+	for _, g := range genres {
+		genresArray = append(genresArray, g.ID)
+	}
+
+	movie.Genres = genres
+	movie.GenresArray = genresArray
+
+	return &movie, m.sortedGenres(), nil
+}
+
+func (m *MemoryDBRepo) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	for _, user := range m.users {
+		if strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) GetUserByID(ctx context.Context, id int) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+func (m *MemoryDBRepo) ListUsers(ctx context.Context, search string) ([]*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	search = strings.ToLower(strings.TrimSpace(search))
+
+	var users []*models.User
+	for _, user := range m.users {
+		name := strings.ToLower(user.FirstName + " " + user.Lastname)
+		if !strings.Contains(strings.ToLower(user.Email), search) && !strings.Contains(name, search) {
+			continue
+		}
+		user := user
+		users = append(users, &user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		if a.Lastname != b.Lastname {
+			return a.Lastname < b.Lastname
+		}
+		if a.FirstName != b.FirstName {
+			return a.FirstName < b.FirstName
+		}
+		return a.ID < b.ID
+	})
+
+	return users, nil
+}
+
+func (m *MemoryDBRepo) InsertUser(ctx context.Context, user models.User) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return 0, repository.ErrDuplicateEmail
+	}
+
+	newID := m.nextUserID
+	m.nextUserID++
+
+	user.ID = newID
+	user.DisabledAt = nil
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+	if _, ok := m.roles[user.Role]; !ok {
+		return 0, repository.ErrUnknownRole
+	}
+	m.users[newID] = user
+
+	return newID, nil
+}
+
+func (m *MemoryDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.emailTaken(user.Email, user.ID) {
+		return repository.ErrDuplicateEmail
+	}
+
+	existing.Email = user.Email
+	existing.FirstName = user.FirstName
+	existing.Lastname = user.Lastname
+	existing.UpdateAt = user.UpdateAt
+	m.users[user.ID] = existing
+
+	return nil
+}
+
+// mirror the unique index on lower(email), caller must hold the lock
+func (m *MemoryDBRepo) emailTaken(email string, exceptID int) bool {
+	for id, user := range m.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryDBRepo) SetUserDisabled(ctx context.Context, id int, disabledAt *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.DisabledAt = disabledAt
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryDBRepo) SetEmailVerified(ctx context.Context, id int, verifiedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if user.EmailVerifiedAt == nil {
+		user.EmailVerifiedAt = &verifiedAt
+		m.users[id] = user
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) SetUserPassword(ctx context.Context, id int, hash string, updatedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Password = hash
+	user.UpdateAt = updatedAt
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// mirror the foreign key to users and the unique hash
+	if _, ok := m.users[reset.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", reset.UserID)
+	}
+	for _, existing := range m.resets {
+		if existing.TokenHash == reset.TokenHash {
+			return fmt.Errorf("password reset token already exists")
+		}
+	}
+
+	reset.ID = m.nextResetID
+	m.nextResetID++
+	reset.UsedAt = nil
+	m.resets = append(m.resets, reset)
+	return nil
+}
+
+func (m *MemoryDBRepo) GetPasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	for _, reset := range m.resets {
+		if reset.TokenHash == tokenHash {
+			return &reset, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) UsePasswordReset(ctx context.Context, tokenHash string, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	userID := 0
+	for _, reset := range m.resets {
+		if reset.TokenHash == tokenHash && reset.UsedAt == nil && reset.ExpiresAt.After(usedAt) {
+			userID = reset.UserID
+		}
+	}
+	if userID == 0 {
+		return sql.ErrNoRows
+	}
+
+	for i, reset := range m.resets {
+		if reset.UserID == userID && reset.UsedAt == nil {
+			m.resets[i].UsedAt = &usedAt
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) InsertAuthEvent(ctx context.Context, event models.AuthEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.users[event.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", event.UserID)
+	}
+
+	event.ID = m.nextAuthEventID
+	m.nextAuthEventID++
+	m.authEvents = append(m.authEvents, event)
+	return nil
+}
+
+func (m *MemoryDBRepo) UserAuthEvents(ctx context.Context, userID int) ([]*models.AuthEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var events []*models.AuthEvent
+	for i := len(m.authEvents) - 1; i >= 0; i-- {
+		if m.authEvents[i].UserID == userID {
+			event := m.authEvents[i]
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryDBRepo) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.TOTPSecret, user.TOTPEnabledAt, user.TOTPLastStep = secret, nil, 0
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryDBRepo) EnableTOTP(ctx context.Context, id int, enabledAt time.Time, codeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok || user.TOTPSecret == "" {
+		return sql.ErrNoRows
+	}
+
+	user.TOTPEnabledAt = &enabledAt
+	m.users[id] = user
+
+	var codes []models.RecoveryCode
+	for _, hash := range codeHashes {
+		codes = append(codes, models.RecoveryCode{UserID: id, CodeHash: hash})
+	}
+	m.recovery[id] = codes
+	return nil
+}
+
+func (m *MemoryDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.TOTPSecret, user.TOTPEnabledAt, user.TOTPLastStep = "", nil, 0
+	m.users[id] = user
+	delete(m.recovery, id)
+	return nil
+}
+
+func (m *MemoryDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	user, ok := m.users[id]
+	if !ok || user.TOTPLastStep >= step {
+		return sql.ErrNoRows
+	}
+
+	user.TOTPLastStep = step
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	for i, code := range m.recovery[userID] {
+		if code.CodeHash == codeHash && code.UsedAt == nil {
+			m.recovery[userID][i].UsedAt = &usedAt
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) UserWebAuthnCredentials(ctx context.Context, userID int) ([]*models.WebAuthnCredential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var creds []*models.WebAuthnCredential
+	for _, cred := range m.passkeys {
+		if cred.UserID == userID {
+			cred := cred
+			creds = append(creds, &cred)
+		}
+	}
+
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].ID < creds[j].ID
+	})
+	return creds, nil
+}
+
+func (m *MemoryDBRepo) GetWebAuthnCredential(ctx context.Context, credentialID string) (*models.WebAuthnCredential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	for _, cred := range m.passkeys {
+		if cred.CredentialID == credentialID {
+			return &cred, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) InsertWebAuthnCredential(ctx context.Context, cred models.WebAuthnCredential) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	for _, existing := range m.passkeys {
+		if existing.CredentialID == cred.CredentialID {
+			return 0, repository.ErrDuplicateCredential
+		}
+	}
+
+	m.nextPasskeyID++
+	cred.ID = m.nextPasskeyID
+	m.passkeys[cred.ID] = cred
+	return cred.ID, nil
+}
+
+func (m *MemoryDBRepo) UseWebAuthnCredential(ctx context.Context, id int, signCount int64, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	cred, ok := m.passkeys[id]
+	if !ok || !(cred.SignCount < signCount || signCount == 0 && cred.SignCount == 0) {
+		return sql.ErrNoRows
+	}
+
+	cred.SignCount, cred.LastUsedAt = signCount, &usedAt
+	m.passkeys[id] = cred
+	return nil
+}
+
+func (m *MemoryDBRepo) DeleteWebAuthnCredential(ctx context.Context, userID int, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	cred, ok := m.passkeys[id]
+	if !ok || cred.UserID != userID {
+		return sql.ErrNoRows
+	}
+
+	delete(m.passkeys, id)
+	return nil
+}
+
+func (m *MemoryDBRepo) InsertWebAuthnChallenge(ctx context.Context, challenge models.WebAuthnChallenge) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	now := time.Now()
+	for key, c := range m.challenges {
+		if !c.ExpiresAt.After(now) {
+			delete(m.challenges, key)
+		}
+	}
+
+	if _, ok := m.challenges[challenge.Challenge]; ok {
+		return fmt.Errorf("duplicate challenge")
+	}
+
+	m.nextChallengeID++
+	challenge.ID = m.nextChallengeID
+	m.challenges[challenge.Challenge] = challenge
+	return nil
+}
+
+func (m *MemoryDBRepo) UseWebAuthnChallenge(ctx context.Context, challenge string, ceremony string, now time.Time) (*models.WebAuthnChallenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	c, ok := m.challenges[challenge]
+	if !ok || c.Ceremony != ceremony || !c.ExpiresAt.After(now) {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(m.challenges, challenge)
+	return &c, nil
+}
+
+func (m *MemoryDBRepo) CountMagicLinks(ctx context.Context, email string, since time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	count := 0
+	for _, link := range m.magicLinks {
+		if strings.EqualFold(link.Email, email) && link.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryDBRepo) InsertMagicLink(ctx context.Context, link models.MagicLink) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if link.UserID != 0 {
+		if _, ok := m.users[link.UserID]; !ok {
+			return fmt.Errorf("user %d does not exist", link.UserID)
+		}
+	}
+
+	// a day of requests is more than the rate limit looks at
+	var links []models.MagicLink
+	for _, existing := range m.magicLinks {
+		if !existing.CreatedAt.Before(link.CreatedAt.Add(-24 * time.Hour)) {
+			links = append(links, existing)
+		}
+	}
+
+	m.nextMagicLinkID++
+	link.ID = m.nextMagicLinkID
+	m.magicLinks = append(links, link)
+	return nil
+}
+
+func (m *MemoryDBRepo) UseMagicLink(ctx context.Context, tokenHash string, usedAt time.Time) (*models.MagicLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	found := -1
+	for i, link := range m.magicLinks {
+		if tokenHash != "" && link.TokenHash == tokenHash && link.UsedAt == nil && link.ExpiresAt.After(usedAt) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	// the other links sent to the user stop working too
+	link := m.magicLinks[found]
+	for i, other := range m.magicLinks {
+		if other.UserID == link.UserID && other.UsedAt == nil {
+			m.magicLinks[i].UsedAt = &usedAt
+		}
+	}
+
+	link.UsedAt = &usedAt
+	return &link, nil
+}
+
+func (m *MemoryDBRepo) InsertOIDCLogin(ctx context.Context, login models.OIDCLogin) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	now := time.Now()
+	for state, l := range m.oidcLogins {
+		if !l.ExpiresAt.After(now) {
+			delete(m.oidcLogins, state)
+		}
+	}
+
+	if _, ok := m.oidcLogins[login.State]; ok {
+		return fmt.Errorf("duplicate state")
+	}
+
+	m.nextOIDCLoginID++
+	login.ID = m.nextOIDCLoginID
+	m.oidcLogins[login.State] = login
+	return nil
+}
+
+func (m *MemoryDBRepo) UseOIDCLogin(ctx context.Context, state string, now time.Time) (*models.OIDCLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	login, ok := m.oidcLogins[state]
+	if !ok || !login.ExpiresAt.After(now) {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(m.oidcLogins, state)
+	return &login, nil
+}
+
+func (m *MemoryDBRepo) GetUserIdentity(ctx context.Context, issuer string, subject string) (*models.UserIdentity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	for _, identity := range m.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) InsertUserIdentity(ctx context.Context, identity models.UserIdentity) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.users[identity.UserID]; !ok {
+		return 0, fmt.Errorf("user %d does not exist", identity.UserID)
+	}
+	for _, existing := range m.identities {
+		if existing.Issuer == identity.Issuer && existing.Subject == identity.Subject {
+			return 0, fmt.Errorf("duplicate identity")
+		}
+	}
+
+	m.nextIdentityID++
+	identity.ID = m.nextIdentityID
+	m.identities[identity.ID] = identity
+	return identity.ID, nil
+}
+
+func (m *MemoryDBRepo) RecordIdentityLogin(ctx context.Context, id int, email string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	identity, ok := m.identities[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	identity.Email = email
+	identity.LastLoginAt = &at
+	m.identities[id] = identity
+	return nil
+}
+
+func (m *MemoryDBRepo) LoginThrottles(ctx context.Context, email string, ip string) ([]*models.LoginThrottle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var throttles []*models.LoginThrottle
+	for _, throttle := range m.throttles {
+		if (throttle.Kind == models.LoginThrottleAccount && throttle.Key == strings.ToLower(email)) ||
+			(throttle.Kind == models.LoginThrottleIP && throttle.Key == ip) {
+			throttle := throttle
+			throttles = append(throttles, &throttle)
+		}
+	}
+	return throttles, nil
+}
+
+func (m *MemoryDBRepo) RecordLoginFailure(ctx context.Context, kind string, key string, at time.Time, since time.Time) (*models.LoginThrottle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// every email typed gets a row, forget those nobody tried for a while
+	for id, throttle := range m.throttles {
+		if throttle.LastFailureAt.Before(since) && (throttle.LockedUntil == nil || throttle.LockedUntil.Before(at)) {
+			delete(m.throttles, id)
+		}
+	}
+
+	key = strings.ToLower(key)
+	for id, throttle := range m.throttles {
+		if throttle.Kind == kind && throttle.Key == key {
+			if throttle.LastFailureAt.Before(since) {
+				throttle.Failures = 0
+			}
+			throttle.Failures++
+			throttle.LastFailureAt = at
+			m.throttles[id] = throttle
+			return &throttle, nil
+		}
+	}
+
+	m.nextThrottleID++
+	throttle := models.LoginThrottle{ID: m.nextThrottleID, Kind: kind, Key: key, Failures: 1, LastFailureAt: at}
+	m.throttles[throttle.ID] = throttle
+	return &throttle, nil
+}
+
+func (m *MemoryDBRepo) LockLogin(ctx context.Context, id int, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	throttle, ok := m.throttles[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if throttle.LockedUntil == nil || throttle.LockedUntil.Before(until) {
+		throttle.LockedUntil = &until
+		m.throttles[id] = throttle
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) ClearLoginFailures(ctx context.Context, kind string, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	for id, throttle := range m.throttles {
+		if throttle.Kind == kind && throttle.Key == strings.ToLower(key) {
+			delete(m.throttles, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) LoginLockouts(ctx context.Context, now time.Time) ([]*models.LoginThrottle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var throttles []*models.LoginThrottle
+	for _, throttle := range m.throttles {
+		if throttle.LockedUntil != nil && throttle.LockedUntil.After(now) {
+			throttle := throttle
+			throttles = append(throttles, &throttle)
+		}
+	}
+
+	sort.Slice(throttles, func(i, j int) bool {
+		a, b := throttles[i], throttles[j]
+		if !a.LockedUntil.Equal(*b.LockedUntil) {
+			return a.LockedUntil.After(*b.LockedUntil)
+		}
+		return a.ID < b.ID
+	})
+
+	return throttles, nil
+}
+
+func (m *MemoryDBRepo) DeleteLoginThrottle(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.throttles[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(m.throttles, id)
+	return nil
+}
+
+func (m *MemoryDBRepo) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(m.users, id)
+
+	// mirror the on delete cascade of refresh_tokens
+	for jti, token := range m.refresh {
+		if token.UserID == id {
+			delete(m.refresh, jti)
+		}
+	}
+
+	// and of password_resets, auth_events, recovery_codes, magic_links, user_identities and the webauthn tables
+	delete(m.recovery, id)
+	var links []models.MagicLink
+	for _, link := range m.magicLinks {
+		if link.UserID != id {
+			links = append(links, link)
+		}
+	}
+	m.magicLinks = links
+	for passkeyID, cred := range m.passkeys {
+		if cred.UserID == id {
+			delete(m.passkeys, passkeyID)
+		}
+	}
+	for key, challenge := range m.challenges {
+		if challenge.UserID == id {
+			delete(m.challenges, key)
+		}
+	}
+	for identityID, identity := range m.identities {
+		if identity.UserID == id {
+			delete(m.identities, identityID)
+		}
+	}
+
+	var resets []models.PasswordReset
+	for _, reset := range m.resets {
+		if reset.UserID != id {
+			resets = append(resets, reset)
+		}
+	}
+	m.resets = resets
+
+	var events []models.AuthEvent
+	for _, event := range m.authEvents {
+		if event.UserID != id {
+			events = append(events, event)
+		}
+	}
+	m.authEvents = events
+
+	// and the on delete set null of api_keys
+	for keyID, key := range m.apiKeys {
+		if key.CreatedBy == id {
+			key.CreatedBy = 0
+			m.apiKeys[keyID] = key
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) AllRoles(ctx context.Context) ([]*models.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var roles []*models.Role
+	for _, role := range m.roles {
+		role := role
+		role.Permissions = append([]string{}, role.Permissions...)
+		roles = append(roles, &role)
+	}
+
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+
+	return roles, nil
+}
+
+func (m *MemoryDBRepo) RolePermissions(ctx context.Context, role string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	// permissions are kept sorted
+	return append([]string{}, m.roles[role].Permissions...), nil
+}
+
+func (m *MemoryDBRepo) SetUserRole(ctx context.Context, id int, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.roles[role]; !ok {
+		return repository.ErrUnknownRole
+	}
+
+	user, ok := m.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Role = role
+	user.UpdateAt = time.Now()
+	m.users[id] = user
+	return nil
+}
+
+func (m *MemoryDBRepo) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// mirror the primary key and the foreign key to users
+	if _, ok := m.refresh[token.ID]; ok {
+		return fmt.Errorf("refresh token %s already exists", token.ID)
+	}
+	if _, ok := m.users[token.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", token.UserID)
+	}
+
+	token.UsedAt, token.ReplacedBy, token.RevokedAt = nil, "", nil
+	m.refresh[token.ID] = token
+	return nil
+}
+
+func (m *MemoryDBRepo) GetRefreshToken(ctx context.Context, id string) (*models.RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	token, ok := m.refresh[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &token, nil
+}
+
+func (m *MemoryDBRepo) UseRefreshToken(ctx context.Context, id string, replacedBy string, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	token, ok := m.refresh[id]
+	if !ok || token.UsedAt != nil || token.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	token.UsedAt = &usedAt
+	token.ReplacedBy = replacedBy
+	m.refresh[id] = token
+	return nil
+}
+
+func (m *MemoryDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) (int, error) {
+	return m.revokeRefreshTokens(ctx, revokedAt, func(token models.RefreshToken) bool {
+		return token.FamilyID == familyID
+	})
+}
+
+func (m *MemoryDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int, revokedAt time.Time) (int, error) {
+	return m.revokeRefreshTokens(ctx, revokedAt, func(token models.RefreshToken) bool {
+		return token.UserID == userID
+	})
+}
+
+// revoke the tokens not revoked yet that match
+func (m *MemoryDBRepo) revokeRefreshTokens(ctx context.Context, revokedAt time.Time, match func(token models.RefreshToken) bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	revoked := 0
+	for id, token := range m.refresh {
+		if token.RevokedAt != nil || !match(token) {
+			continue
+		}
+		token.RevokedAt = &revokedAt
+		m.refresh[id] = token
+		revoked++
+	}
+
+	return revoked, nil
+}
+
+func (m *MemoryDBRepo) InsertRevokedToken(ctx context.Context, token models.RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// mirror the unique jti, a token revoked already stays as it was
+	for _, revoked := range m.revoked {
+		if token.JTI != "" && revoked.JTI == token.JTI {
+			return nil
+		}
+	}
+
+	token.ID = m.nextRevokedTokenID
+	m.nextRevokedTokenID++
+	m.revoked = append(m.revoked, token)
+	return nil
+}
+
+func (m *MemoryDBRepo) ConsumeToken(ctx context.Context, token models.RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	for _, revoked := range m.revoked {
+		if revoked.JTI == token.JTI {
+			return sql.ErrNoRows
+		}
+	}
+
+	token.ID = m.nextRevokedTokenID
+	m.nextRevokedTokenID++
+	m.revoked = append(m.revoked, token)
+	return nil
+}
+
+func (m *MemoryDBRepo) RevokedTokens(ctx context.Context, now time.Time) ([]*models.RevokedToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var tokens []*models.RevokedToken
+	for _, token := range m.revoked {
+		if token.ExpiresAt.After(now) {
+			token := token
+			tokens = append(tokens, &token)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *MemoryDBRepo) DeleteExpiredRevokedTokens(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	var kept []models.RevokedToken
+	for _, token := range m.revoked {
+		if token.ExpiresAt.After(now) {
+			kept = append(kept, token)
+		}
+	}
+
+	deleted := len(m.revoked) - len(kept)
+	m.revoked = kept
+	return deleted, nil
+}
+
+func (m *MemoryDBRepo) AllAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var keys []*models.APIKey
+	for _, key := range m.apiKeys {
+		key := key
+		key.Scopes = append([]string{}, key.Scopes...)
+		keys = append(keys, &key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID > keys[j].ID
+	})
+	return keys, nil
+}
+
+func (m *MemoryDBRepo) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	for _, key := range m.apiKeys {
+		if key.Prefix == prefix {
+			key.Scopes = append([]string{}, key.Scopes...)
+			return &key, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// mirror the unique prefix and the foreign key to permissions
+	for _, existing := range m.apiKeys {
+		if existing.Prefix == key.Prefix {
+			return 0, fmt.Errorf("api key prefix %s already exists", key.Prefix)
+		}
+	}
+	for _, permission := range key.Scopes {
+		if !m.permissionExists(permission) {
+			return 0, fmt.Errorf("permission %s does not exist", permission)
+		}
+	}
+
+	key.ID = m.nextAPIKeyID
+	m.nextAPIKeyID++
+
+	key.Scopes = append([]string{}, key.Scopes...)
+	sort.Strings(key.Scopes)
+	key.LastUsedAt, key.RevokedAt = nil, nil
+	m.apiKeys[key.ID] = key
+	return key.ID, nil
+}
+
+// whether a role grants permission, the memory repository has no permissions table of its own
+func (m *MemoryDBRepo) permissionExists(permission string) bool {
+	for _, role := range m.roles {
+		for _, p := range role.Permissions {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *MemoryDBRepo) RevokeAPIKey(ctx context.Context, id int, revokedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	key, ok := m.apiKeys[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if key.RevokedAt == nil {
+		key.RevokedAt = &revokedAt
+		m.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	key, ok := m.apiKeys[id]
+	if ok {
+		key.LastUsedAt = &usedAt
+		m.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (m *MemoryDBRepo) AllGenres(ctx context.Context) ([]*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	return m.sortedGenres(), nil
+}
+
+func (m *MemoryDBRepo) InsertGenre(ctx context.Context, genre models.Genre) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if m.genreNameTaken(genre.Genre, 0) {
+		return 0, repository.ErrDuplicateGenre
+	}
+
+	newID := m.nextGenreID
+	m.nextGenreID++
+
+	genre.ID = newID
+	genre.Checked = false
+	m.genres[newID] = genre
+
+	return newID, nil
+}
+
+func (m *MemoryDBRepo) UpdateGenre(ctx context.Context, genre models.Genre) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	existing, ok := m.genres[genre.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.genreNameTaken(genre.Genre, genre.ID) {
+		return repository.ErrDuplicateGenre
+	}
+
+	existing.Genre = genre.Genre
+	existing.UpdatedAt = genre.UpdatedAt
+	m.genres[genre.ID] = existing
+
+	return nil
+}
+
+// mirror the unique index on lower(genre), caller must hold the lock
+func (m *MemoryDBRepo) genreNameTaken(name string, exceptID int) bool {
+	for id, g := range m.genres {
+		if id != exceptID && strings.EqualFold(g.Genre, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryDBRepo) GenreMovieCount(ctx context.Context, id int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	count := 0
+	for _, genreIDs := range m.movieGenres {
+		if containsInt(genreIDs, id) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *MemoryDBRepo) MergeGenres(ctx context.Context, from int, into int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	_, okFrom := m.genres[from]
+	_, okInto := m.genres[into]
+	if !okFrom || !okInto {
+		return 0, sql.ErrNoRows
+	}
+
+	moved := 0
+	for movieID, genreIDs := range m.movieGenres {
+		if !containsInt(genreIDs, from) {
+			continue
+		}
+
+		// movies that already have both genres keep a single link
+		var merged []int
+		for _, genreID := range genreIDs {
+			if genreID != from {
+				merged = append(merged, genreID)
+			}
+		}
+		if !containsInt(merged, into) {
+			merged = append(merged, into)
+		}
+		m.movieGenres[movieID] = merged
+
+		m.bumpVersion(movieID)
+		moved++
+	}
+
+	delete(m.genres, from)
+	return moved, nil
+}
+
+func (m *MemoryDBRepo) DeleteGenre(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	if _, ok := m.genres[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	for movieID, genreIDs := range m.movieGenres {
+		if !containsInt(genreIDs, id) {
+			continue
+		}
+
+		var kept []int
+		for _, genreID := range genreIDs {
+			if genreID != id {
+				kept = append(kept, genreID)
+			}
+		}
+		m.movieGenres[movieID] = kept
+
+		m.bumpVersion(movieID)
+	}
+
+	delete(m.genres, id)
+	return nil
+}
+
+// a change to the genres of a movie makes edit forms opened before it stale, caller must hold the lock
+func (m *MemoryDBRepo) bumpVersion(movieID int) {
+	movie, ok := m.movies[movieID]
+	if !ok {
+		return
+	}
+	movie.Version++
+	m.movies[movieID] = movie
+}
+
+func (m *MemoryDBRepo) InsertMovie(ctx context.Context, movie models.Movie) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	newID := m.nextMovieID
+	m.nextMovieID++
+
+	//only the columns of the movies table are stored
+	movie.ID = newID
+	movie.Version = 1
+	movie.Genres = nil
+	movie.GenresArray = nil
+	m.movies[newID] = movie
+
+	return newID, nil
+}
+
+func (m *MemoryDBRepo) UpdateMovie(ctx context.Context, movie models.Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	existing, ok := m.movies[movie.ID]
+	if !ok || existing.DeletedAt != nil || existing.Version != movie.Version {
+		return repository.ErrVersionConflict
+	}
+
+	existing.Title = movie.Title
+	existing.Description = movie.Description
+	existing.ReleaseDate = movie.ReleaseDate
+	existing.RunTime = movie.RunTime
+	existing.MPAARating = movie.MPAARating
+	existing.UpdatedAt = movie.UpdatedAt
+	existing.Image = movie.Image
+	existing.Version++
+	m.movies[movie.ID] = existing
+
+	return nil
+}
+
+func (m *MemoryDBRepo) UpdateMovieGenres(ctx context.Context, id int, genreIDs []int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	// mirror the foreign keys of movies_genres
+	if _, ok := m.movies[id]; !ok {
+		return fmt.Errorf("movie %d does not exist", id)
+	}
+	for _, n := range genreIDs {
+		if _, ok := m.genres[n]; !ok {
+			return fmt.Errorf("genre %d does not exist", n)
+		}
+	}
+
+	m.movieGenres[id] = append([]int(nil), genreIDs...)
+	return nil
+}
+
+func (m *MemoryDBRepo) DeleteMovie(ctx context.Context, id int, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	movie, ok := m.movies[id]
+	if !ok || movie.DeletedAt != nil || movie.Version != version {
+		return repository.ErrVersionConflict
+	}
+
+	// the genre links stay so the movie can be restored
+	now := time.Now()
+	movie.DeletedAt = &now
+	movie.Version++
+	m.movies[id] = movie
+	return nil
+}
+
+func (m *MemoryDBRepo) TrashedMovies(ctx context.Context) ([]*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var movies []*models.Movie
+	for _, movie := range m.movies {
+		if movie.DeletedAt == nil {
+			continue
+		}
+		movie := movie
+		movies = append(movies, &movie)
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		return movies[i].DeletedAt.After(*movies[j].DeletedAt)
+	})
+
+	return movies, nil
+}
+
+func (m *MemoryDBRepo) RestoreMovie(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	movie, ok := m.movies[id]
+	if !ok || movie.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+
+	movie.DeletedAt = nil
+	movie.Version++
+	m.movies[id] = movie
+	return nil
+}
+
+func (m *MemoryDBRepo) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	purged := 0
+	for id, movie := range m.movies {
+		if movie.DeletedAt == nil || !movie.DeletedAt.Before(deletedBefore) {
+			continue
+		}
+		delete(m.movies, id)
+		delete(m.movieGenres, id)
+		purged++
+	}
+
+	return purged, nil
+}
+
+func (m *MemoryDBRepo) MovieSnapshot(ctx context.Context, id int) (*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	movie, ok := m.movies[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	movie.GenresArray = append([]int(nil), m.movieGenres[id]...)
+	sort.Ints(movie.GenresArray)
+	return &movie, nil
+}
+
+func (m *MemoryDBRepo) InsertMovieRevision(ctx context.Context, revision models.MovieRevision) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	unlock := m.lock()
+	defer unlock()
+
+	history := m.revisions[revision.MovieID]
+
+	revision.ID = 1
+	for _, h := range m.revisions {
+		revision.ID += len(h)
+	}
+	revision.Revision = len(history) + 1
+	revision.Snapshot.GenresArray = append([]int(nil), revision.Snapshot.GenresArray...)
+	revision.Snapshot.Genres = nil
+
+	m.revisions[revision.MovieID] = append(history, revision)
+	return revision.Revision, nil
+}
+
+func (m *MemoryDBRepo) MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	var revisions []*models.MovieRevision
+	history := m.revisions[movieID]
+	for i := len(history) - 1; i >= 0; i-- {
+		revisions = append(revisions, copyRevision(history[i]))
+	}
+
+	return revisions, nil
+}
+
+func (m *MemoryDBRepo) MovieRevision(ctx context.Context, movieID int, revision int) (*models.MovieRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock := m.rlock()
+	defer unlock()
+
+	history := m.revisions[movieID]
+	if revision < 1 || revision > len(history) {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyRevision(history[revision-1]), nil
+}
+
+// copy a stored revision so callers can not modify the history
+func copyRevision(revision models.MovieRevision) *models.MovieRevision {
+	revision.Snapshot.GenresArray = append([]int(nil), revision.Snapshot.GenresArray...)
+	return &revision
+}
+
+// genres linked to a movie ordered by name, caller must hold the lock
+func (m *MemoryDBRepo) genresOf(movieID int) []*models.Genre {
+	var genres []*models.Genre
+	for _, genreID := range m.movieGenres[movieID] {
+		g, ok := m.genres[genreID]
+		if !ok {
+			continue
+		}
+		genres = append(genres, &g)
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].Genre < genres[j].Genre
+	})
+
+	return genres
+}
+
+// every genre ordered by name, caller must hold the lock
+func (m *MemoryDBRepo) sortedGenres() []*models.Genre {
+	var genres []*models.Genre
+	for _, g := range m.genres {
+		g := g
+		genres = append(genres, &g)
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].Genre < genres[j].Genre
+	})
+
+	return genres
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
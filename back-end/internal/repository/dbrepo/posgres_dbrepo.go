@@ -2,32 +2,118 @@ package dbrepo
 
 import (
 	"backend/internal/models"
+	"backend/internal/repository"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgconn"
 )
 
 // declare a type PostgresDBRepo that inherits the interface DatabaseRepo
 type PostgresDBRepo struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
+
+	tx *sql.Tx // set on the copy of the repo handed to WithTx callbacks
+}
+
+// querier is what *sql.DB and *sql.Tx have in common
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // if users interact with the DB more than 3 seconds, time out
 const dbTimeOut = time.Second * 3
 
+// Timeouts limits how long a single repository call may run, per class of operation.
+// A zero value falls back to dbTimeOut.
+type Timeouts struct {
+	Read  time.Duration // public lookups (movies, genres, users)
+	Write time.Duration // inserts, updates and deletes
+	Admin time.Duration // heavier queries only used by the admin pages
+}
+
+// derive a context for a read query from the caller's context
+func (m *PostgresDBRepo) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, m.Timeouts.Read)
+}
+
+// derive a context for a write statement from the caller's context
+func (m *PostgresDBRepo) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, m.Timeouts.Write)
+}
+
+// derive a context for an admin query from the caller's context
+func (m *PostgresDBRepo) adminContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, m.Timeouts.Admin)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = dbTimeOut
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
-func (m *PostgresDBRepo) AllMovies(genre ...int) ([]*models.Movie, error) {
+// run queries on the open transaction if there is one, otherwise on the pool
+func (m *PostgresDBRepo) conn() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx runs fn inside a database transaction.
+// Everything fn does through the repo it receives is committed if fn returns nil and rolled back otherwise.
+// Calling WithTx on a repo that is already in a transaction just joins it.
+func (m *PostgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		return fn(tx)
+	})
+}
+
+func (m *PostgresDBRepo) inTx(ctx context.Context, fn func(tx *PostgresDBRepo) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	err = fn(&PostgresDBRepo{DB: m.DB, Timeouts: m.Timeouts, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *PostgresDBRepo) AllMovies(ctx context.Context, genre ...int) ([]*models.Movie, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.readContext(ctx)
 	defer cancel()
 
-	where := ""
+	//movies in the trash are never listed
+	where := "where deleted_at is null"
+	var args []interface{}
 	if len(genre) > 0 {
-		where = fmt.Sprintf("where id in (select movie_id from movies_genres where genre_id = %d)", genre[0])
+		where += " and id in (select movie_id from movies_genres where genre_id = $1)"
+		args = append(args, genre[0])
 	}
 
 	//coalesce(image, '') = return image if exists otherwise return ''
@@ -43,7 +129,7 @@ func (m *PostgresDBRepo) AllMovies(genre ...int) ([]*models.Movie, error) {
 			title
 	`, where)
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,16 +162,310 @@ func (m *PostgresDBRepo) AllMovies(genre ...int) ([]*models.Movie, error) {
 	return movies, nil
 }
 
-func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
+func (m *PostgresDBRepo) ListMovies(ctx context.Context, opts repository.MovieListOptions) (*repository.MovieList, error) {
+	err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *repository.MovieCursor
+	var pivot *models.Movie
+	if opts.Cursor != "" {
+		c, err := repository.DecodeMovieCursor(opts.Cursor, opts)
+		if err != nil {
+			return nil, err
+		}
+		pivot, err = c.Movie()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &c
+	}
+
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	conditions, args := movieListConditions(opts)
+
+	where := "where " + strings.Join(conditions, " and ")
+
+	var total int
+	err = m.conn().QueryRowContext(ctx, "select count(*) from movies "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	//the sort column comes from the whitelist checked by Normalize, never from the client directly
+	column := opts.Sort
+
+	// a cursor to the previous page walks the list backwards
+	descending := opts.Descending
+	if cursor != nil && cursor.Before {
+		descending = !descending
+	}
+
+	direction, compare := "asc", ">"
+	if descending {
+		direction, compare = "desc", "<"
+	}
+
+	if cursor != nil {
+		args = append(args, repository.MovieSortKey(pivot, column), pivot.ID)
+		key, id := len(args)-1, len(args)
+		conditions = append(conditions, fmt.Sprintf("(%s %s $%d or (%s = $%d and id %s $%d))",
+			column, compare, key, column, key, compare, id))
+	}
+
+	where = "where " + strings.Join(conditions, " and ")
+
+	// fetch one extra row to know whether there is another page
+	args = append(args, opts.Limit+1)
+	paging := fmt.Sprintf("limit $%d", len(args))
+	if cursor == nil {
+		args = append(args, (opts.Page-1)*opts.Limit)
+		paging += fmt.Sprintf(" offset $%d", len(args))
+	}
+
+	query := fmt.Sprintf(`
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''),
+			created_at, updated_at
+		from
+			movies %s
+		order by
+			%s %s, id %s
+		%s
+	`, where, column, direction, direction, paging)
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []*models.Movie
+
+	for rows.Next() {
+		var movie models.Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.RunTime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.CreateAt,
+			&movie.UpdatedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return repository.PageMovies(movies, total, opts, cursor), nil
+}
+
+// build the where conditions for the filters of a movie list, every value is a query argument
+func movieListConditions(opts repository.MovieListOptions) ([]string, []interface{}) {
+	//movies in the trash are never listed
+	conditions := []string{"deleted_at is null"}
+	var args []interface{}
+
+	// add a value to args and return its placeholder
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(opts.Genres) > 0 {
+		var placeholders []string
+		for _, id := range opts.Genres {
+			placeholders = append(placeholders, arg(id))
+		}
+		conditions = append(conditions, fmt.Sprintf(
+			"id in (select movie_id from movies_genres where genre_id in (%s))", strings.Join(placeholders, ", ")))
+	}
+
+	if len(opts.MPAARatings) > 0 {
+		var placeholders []string
+		for _, rating := range opts.MPAARatings {
+			placeholders = append(placeholders, arg(rating))
+		}
+		conditions = append(conditions, fmt.Sprintf("mpaa_rating in (%s)", strings.Join(placeholders, ", ")))
+	}
+
+	if opts.YearFrom > 0 {
+		conditions = append(conditions, "release_date >= "+arg(time.Date(opts.YearFrom, 1, 1, 0, 0, 0, 0, time.UTC)))
+	}
+	if opts.YearTo > 0 {
+		conditions = append(conditions, "release_date < "+arg(time.Date(opts.YearTo+1, 1, 1, 0, 0, 0, 0, time.UTC)))
+	}
+
+	if opts.RuntimeMin > 0 {
+		conditions = append(conditions, "runtime >= "+arg(opts.RuntimeMin))
+	}
+	if opts.RuntimeMax > 0 {
+		conditions = append(conditions, "runtime <= "+arg(opts.RuntimeMax))
+	}
+
+	return conditions, args
+}
+
+func (m *PostgresDBRepo) SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error) {
+	terms, err := repository.ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	//ts_rank weighs title matches (A) above description matches (B)
+	stmt := `
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''),
+			created_at, updated_at,
+			ts_rank(search_vector, q),
+			ts_headline('english', coalesce(title, ''), q, 'HighlightAll=true'),
+			ts_headline('english', coalesce(description, ''), q, 'MaxWords=35, MinWords=15')
+		from
+			movies, to_tsquery('english', $1) q
+		where
+			search_vector @@ q and deleted_at is null
+		order by
+			ts_rank(search_vector, q) desc, title
+		limit $2
+	`
+
+	rows, err := m.conn().QueryContext(ctx, stmt, tsQuery(terms), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*models.MovieSearchResult
+
+	for rows.Next() {
+		result := models.MovieSearchResult{Movie: &models.Movie{}}
+		err := rows.Scan(
+			&result.ID,
+			&result.Title,
+			&result.ReleaseDate,
+			&result.RunTime,
+			&result.MPAARating,
+			&result.Description,
+			&result.Image,
+			&result.CreateAt,
+			&result.UpdatedAt,
+			&result.Rank,
+			&result.TitleHighlight,
+			&result.Snippet,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, &result)
+	}
+
+	return results, rows.Err()
+}
+
+// turn parsed search terms into to_tsquery syntax: `"lost ark" indi*` becomes (lost <-> ark) & indi:*
+func tsQuery(terms []repository.SearchTerm) string {
+	var parts []string
+	for _, term := range terms {
+		words := append([]string(nil), term.Words...)
+		if term.Prefix {
+			words[len(words)-1] += ":*"
+		}
+		parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+	}
+	return strings.Join(parts, " & ")
+}
+
+func (m *PostgresDBRepo) SuggestMovies(ctx context.Context, prefix string, limit int) ([]*models.MovieSuggestion, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return nil, repository.ErrEmptySearch
+	}
+
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	// escape the like wildcards typed by the user
+	like := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+
+	// titles starting with the prefix come first, then titles with a word starting with it,
+	// then the closest trigram matches, which is what makes "godfahter" find The Godfather
+	query := `
+		select
+			id, title, release_date, coalesce(image, '')
+		from
+			movies
+		where
+			deleted_at is null and (title ilike $2 or title ilike $3 or title % $1 or $1 <% title)
+		order by
+			title ilike $2 desc,
+			title ilike $3 desc,
+			greatest(similarity(title, $1), word_similarity($1, title)) desc,
+			title
+		limit $4
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, prefix, like+"%", "% "+like+"%", limit)
+	if err != nil {
+		return nil, canceledQuery(err)
+	}
+	defer rows.Close()
+
+	var suggestions []*models.MovieSuggestion
+
+	for rows.Next() {
+		var suggestion models.MovieSuggestion
+		var releaseDate time.Time
+		err := rows.Scan(
+			&suggestion.ID,
+			&suggestion.Title,
+			&releaseDate,
+			&suggestion.Image,
+		)
+
+		if err != nil {
+			return nil, canceledQuery(err)
+		}
+
+		suggestion.Year = releaseDate.Year()
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	return suggestions, canceledQuery(rows.Err())
+}
+
+func (m *PostgresDBRepo) OneMovie(ctx context.Context, id int) (*models.Movie, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.readContext(ctx)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
-							description, coalesce(image, ''), created_at, updated_at
-							from movies where id = $1`
+							description, coalesce(image, ''), created_at, updated_at, version
+							from movies where id = $1 and deleted_at is null`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	var movie models.Movie
 
@@ -99,6 +479,7 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 		&movie.Image,
 		&movie.CreateAt,
 		&movie.UpdatedAt,
+		&movie.Version,
 	)
 
 	if err != nil {
@@ -111,7 +492,7 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 						where mg.movie_id = $1
 						order by g.genre`
 
-	rows, err := m.DB.QueryContext(ctx, query, id)
+	rows, err := m.conn().QueryContext(ctx, query, id)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -135,16 +516,16 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 	return &movie, nil
 }
 
-func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre, error) {
+func (m *PostgresDBRepo) OneMovieForEdit(ctx context.Context, id int) (*models.Movie, []*models.Genre, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.adminContext(ctx)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
-							description, coalesce(image, ''), created_at, updated_at
-							from movies where id = $1`
+							description, coalesce(image, ''), created_at, updated_at, version
+							from movies where id = $1 and deleted_at is null`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	var movie models.Movie
 
@@ -158,6 +539,7 @@ func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre
 		&movie.Image,
 		&movie.CreateAt,
 		&movie.UpdatedAt,
+		&movie.Version,
 	)
 
 	if err != nil {
@@ -170,7 +552,7 @@ func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre
 						where mg.movie_id = $1
 						order by g.genre`
 
-	rows, err := m.DB.QueryContext(ctx, query, id)
+	rows, err := m.conn().QueryContext(ctx, query, id)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, nil, err
 	}
@@ -199,7 +581,7 @@ func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre
 
 	query = "select id, genre from genres order by genre"
 
-	gRows, err := m.DB.QueryContext(ctx, query)
+	gRows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -219,16 +601,17 @@ func (m *PostgresDBRepo) OneMovieForEdit(id int) (*models.Movie, []*models.Genre
 	return &movie, allGenres, nil
 }
 
-func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
+func (m *PostgresDBRepo) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.readContext(ctx)
 	defer cancel()
 
 	query := `select id, email, first_name, last_name, password,
-						created_at, updated_at from users where email = $1`
+						created_at, updated_at, disabled_at, email_verified_at, role,
+						coalesce(totp_secret, ''), totp_enabled_at, totp_last_step from users where lower(email) = lower($1)`
 
 	var user models.User
-	row := m.DB.QueryRowContext(ctx, query, email)
+	row := m.conn().QueryRowContext(ctx, query, email)
 
 	err := row.Scan(
 		&user.ID,
@@ -238,6 +621,12 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdateAt,
+		&user.DisabledAt,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.TOTPLastStep,
 	)
 
 	if err != nil {
@@ -247,16 +636,17 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
-func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
+func (m *PostgresDBRepo) GetUserByID(ctx context.Context, id int) (*models.User, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.readContext(ctx)
 	defer cancel()
 
 	query := `select id, email, first_name, last_name, password,
-						created_at, updated_at from users where id = $1`
+						created_at, updated_at, disabled_at, email_verified_at, role,
+						coalesce(totp_secret, ''), totp_enabled_at, totp_last_step from users where id = $1`
 
 	var user models.User
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&user.ID,
@@ -266,6 +656,12 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdateAt,
+		&user.DisabledAt,
+		&user.EmailVerifiedAt,
+		&user.Role,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.TOTPLastStep,
 	)
 
 	if err != nil {
@@ -275,57 +671,92 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 	return &user, nil
 }
 
-func (m *PostgresDBRepo) AllGenres() ([]*models.Genre, error) {
+func (m *PostgresDBRepo) ListUsers(ctx context.Context, search string) ([]*models.User, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.adminContext(ctx)
 	defer cancel()
 
-	query := `select id, genre from genres order by genre`
+	// escape the like wildcards typed by the admin
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimSpace(search)) + "%"
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	query := `select id, email, first_name, last_name, password,
+						created_at, updated_at, disabled_at, email_verified_at, role,
+						coalesce(totp_secret, ''), totp_enabled_at, totp_last_step
+						from users
+						where email ilike $1 or first_name || ' ' || last_name ilike $1
+						order by last_name, first_name, id`
+
+	rows, err := m.conn().QueryContext(ctx, query, like)
 	if err != nil {
 		return nil, err
 	}
-
 	defer rows.Close()
 
-	var genres []*models.Genre
+	var users []*models.User
+
 	for rows.Next() {
-		var g models.Genre
+		var user models.User
 		err := rows.Scan(
-			&g.ID,
-			&g.Genre,
-			//&g.CreatedAt,
-			//&g.UpdateAt,
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.Lastname,
+			&user.Password,
+			&user.CreatedAt,
+			&user.UpdateAt,
+			&user.DisabledAt,
+			&user.EmailVerifiedAt,
+			&user.Role,
+			&user.TOTPSecret,
+			&user.TOTPEnabledAt,
+			&user.TOTPLastStep,
 		)
+
 		if err != nil {
 			return nil, err
 		}
-		genres = append(genres, &g)
+
+		users = append(users, &user)
 	}
-	return genres, nil
+
+	return users, rows.Err()
 }
 
-func (m *PostgresDBRepo) InsertMovie(movie models.Movie) (int, error) {
+func (m *PostgresDBRepo) InsertUser(ctx context.Context, user models.User) (int, error) {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.writeContext(ctx)
 	defer cancel()
 
-	stmt := `insert into movies (title, description, release_date, runtime,
-					mpaa_rating, created_at, updated_at, image)
+	taken, err := m.emailTaken(ctx, user.Email, 0)
+	if err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, repository.ErrDuplicateEmail
+	}
+
+	exists, err := m.roleExists(ctx, user.Role)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, repository.ErrUnknownRole
+	}
+
+	stmt := `insert into users (email, first_name, last_name, password, created_at, updated_at, role, email_verified_at)
 					values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
 	var newID int
 
-	err := m.DB.QueryRowContext(ctx, stmt,
-		movie.Title,
-		movie.Description,
-		movie.ReleaseDate,
-		movie.RunTime,
-		movie.MPAARating,
-		movie.CreateAt,
-		movie.UpdatedAt,
-		movie.Image,
+	err = m.conn().QueryRowContext(ctx, stmt,
+		user.Email,
+		user.FirstName,
+		user.Lastname,
+		user.Password,
+		user.CreatedAt,
+		user.UpdateAt,
+		user.Role,
+		user.EmailVerifiedAt,
 	).Scan(&newID)
 
 	if err != nil {
@@ -334,65 +765,1799 @@ func (m *PostgresDBRepo) InsertMovie(movie models.Movie) (int, error) {
 	return newID, nil
 }
 
-func (m *PostgresDBRepo) UpdateMovie(movie models.Movie) error {
+func (m *PostgresDBRepo) UpdateUser(ctx context.Context, user models.User) error {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.writeContext(ctx)
 	defer cancel()
 
-	stmt := `update movies set title = $1, description = $2, release_date = $3,
-						runtime = $4, mpaa_rating = $5, updated_at = $6, image = $7
-						where id = $8`
-	_, err := m.DB.ExecContext(ctx, stmt,
-		movie.Title,
-		movie.Description,
-		movie.ReleaseDate,
-		movie.RunTime,
-		movie.MPAARating,
-		movie.UpdatedAt,
-		movie.Image,
-		movie.ID,
-	)
+	taken, err := m.emailTaken(ctx, user.Email, user.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return repository.ErrDuplicateEmail
+	}
+
+	stmt := `update users set email = $1, first_name = $2, last_name = $3, updated_at = $4 where id = $5`
 
+	res, err := m.conn().ExecContext(ctx, stmt, user.Email, user.FirstName, user.Lastname, user.UpdateAt, user.ID)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return expectOneRow(res)
 }
 
-func (m *PostgresDBRepo) UpdateMovieGenres(id int, genreIDs []int) error {
+// whether another user than exceptID already has this email, ignoring case.
+// The unique index on lower(email) still catches two admins racing for the same email.
+func (m *PostgresDBRepo) emailTaken(ctx context.Context, email string, exceptID int) (bool, error) {
+	query := `select exists (select 1 from users where lower(email) = lower($1) and id <> $2)`
+
+	var taken bool
+	err := m.conn().QueryRowContext(ctx, query, email, exceptID).Scan(&taken)
+	return taken, err
+}
+
+func (m *PostgresDBRepo) SetUserDisabled(ctx context.Context, id int, disabledAt *time.Time) error {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.writeContext(ctx)
 	defer cancel()
 
-	stmt := `delete from movies_genres where movie_id = $1`
-
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	res, err := m.conn().ExecContext(ctx, `update users set disabled_at = $1 where id = $2`, disabledAt, id)
 	if err != nil {
 		return err
 	}
 
-	for _, n := range genreIDs {
-		stmt := `insert into movies_genres (movie_id, genre_id) values ($1, $2)`
-		_, err := m.DB.ExecContext(ctx, stmt, id, n)
-
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return expectOneRow(res)
 }
 
-func (m *PostgresDBRepo) DeleteMovie(id int) error {
+func (m *PostgresDBRepo) SetEmailVerified(ctx context.Context, id int, verifiedAt time.Time) error {
 	//you have a limited time with the context before time out
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	ctx, cancel := m.writeContext(ctx)
 	defer cancel()
 
-	stmt := `delete from movies where id = $1`
-
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	// verifying twice keeps the first time
+	stmt := `update users set email_verified_at = coalesce(email_verified_at, $1) where id = $2`
 
+	res, err := m.conn().ExecContext(ctx, stmt, verifiedAt, id)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) SetUserPassword(ctx context.Context, id int, hash string, updatedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, `update users set password = $1, updated_at = $2 where id = $3`, hash, updatedAt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into password_resets (user_id, token_hash, created_at, expires_at) values ($1, $2, $3, $4)`
+
+	_, err := m.conn().ExecContext(ctx, stmt, reset.UserID, reset.TokenHash, reset.CreatedAt, reset.ExpiresAt)
+	return err
+}
+
+func (m *PostgresDBRepo) GetPasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, created_at, expires_at, used_at from password_resets where token_hash = $1`
+
+	var reset models.PasswordReset
+
+	err := m.conn().QueryRowContext(ctx, query, tokenHash).Scan(
+		&reset.ID,
+		&reset.UserID,
+		&reset.TokenHash,
+		&reset.CreatedAt,
+		&reset.ExpiresAt,
+		&reset.UsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+func (m *PostgresDBRepo) UsePasswordReset(ctx context.Context, tokenHash string, usedAt time.Time) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// checking and marking in one statement, so two requests racing with the same token can not both win
+		stmt := `update password_resets set used_at = $1
+					where token_hash = $2 and used_at is null and expires_at > $1
+					returning user_id`
+
+		var userID int
+		err := tx.conn().QueryRowContext(ctx, stmt, usedAt, tokenHash).Scan(&userID)
+		if err != nil {
+			return err
+		}
+
+		// the other links sent to the user stop working too
+		_, err = tx.conn().ExecContext(ctx,
+			`update password_resets set used_at = $1 where user_id = $2 and used_at is null`, usedAt, userID)
+		return err
+	})
+}
+
+func (m *PostgresDBRepo) InsertAuthEvent(ctx context.Context, event models.AuthEvent) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into auth_events (user_id, event, ip, created_at) values ($1, $2, $3, $4)`
+
+	_, err := m.conn().ExecContext(ctx, stmt, event.UserID, event.Event, event.IP, event.CreatedAt)
+	return err
+}
+
+func (m *PostgresDBRepo) UserAuthEvents(ctx context.Context, userID int) ([]*models.AuthEvent, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, user_id, event, ip, created_at from auth_events
+				where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.AuthEvent
+
+	for rows.Next() {
+		var event models.AuthEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Event,
+			&event.IP,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func (m *PostgresDBRepo) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, totp_enabled_at = null, totp_last_step = 0 where id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, secret, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) EnableTOTP(ctx context.Context, id int, enabledAt time.Time, codeHashes []string) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		res, err := tx.conn().ExecContext(ctx,
+			`update users set totp_enabled_at = $1 where id = $2 and totp_secret is not null`, enabledAt, id)
+		if err != nil {
+			return err
+		}
+		err = expectOneRow(res)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.conn().ExecContext(ctx, `delete from recovery_codes where user_id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range codeHashes {
+			_, err := tx.conn().ExecContext(ctx,
+				`insert into recovery_codes (user_id, code_hash) values ($1, $2)`, id, hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *PostgresDBRepo) DisableTOTP(ctx context.Context, id int) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		stmt := `update users set totp_secret = null, totp_enabled_at = null, totp_last_step = 0 where id = $1`
+
+		res, err := tx.conn().ExecContext(ctx, stmt, id)
+		if err != nil {
+			return err
+		}
+		err = expectOneRow(res)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.conn().ExecContext(ctx, `delete from recovery_codes where user_id = $1`, id)
+		return err
+	})
+}
+
+func (m *PostgresDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// checking and recording in one statement, so two logins racing with the same code can not both win
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+
+	res, err := m.conn().ExecContext(ctx, stmt, step, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, usedAt, userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) UserWebAuthnCredentials(ctx context.Context, userID int) ([]*models.WebAuthnCredential, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+				from webauthn_credentials where user_id = $1 order by created_at, id`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*models.WebAuthnCredential
+	for rows.Next() {
+		cred, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+
+	return creds, rows.Err()
+}
+
+func (m *PostgresDBRepo) GetWebAuthnCredential(ctx context.Context, credentialID string) (*models.WebAuthnCredential, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+				from webauthn_credentials where credential_id = $1`
+
+	return scanWebAuthnCredential(m.conn().QueryRowContext(ctx, query, credentialID))
+}
+
+// scan the columns selected by UserWebAuthnCredentials and GetWebAuthnCredential
+func scanWebAuthnCredential(row interface {
+	Scan(dest ...interface{}) error
+}) (*models.WebAuthnCredential, error) {
+	var cred models.WebAuthnCredential
+	err := row.Scan(
+		&cred.ID,
+		&cred.UserID,
+		&cred.CredentialID,
+		&cred.PublicKey,
+		&cred.SignCount,
+		&cred.Name,
+		&cred.CreatedAt,
+		&cred.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+func (m *PostgresDBRepo) InsertWebAuthnCredential(ctx context.Context, cred models.WebAuthnCredential) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into webauthn_credentials (user_id, credential_id, public_key, sign_count, name, created_at)
+				values ($1, $2, $3, $4, $5, $6)
+				on conflict (credential_id) do nothing
+				returning id`
+
+	var id int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		cred.UserID,
+		cred.CredentialID,
+		cred.PublicKey,
+		cred.SignCount,
+		cred.Name,
+		cred.CreatedAt,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, repository.ErrDuplicateCredential
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (m *PostgresDBRepo) UseWebAuthnCredential(ctx context.Context, id int, signCount int64, usedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// checking and recording in one statement, so a counter value is not accepted twice
+	stmt := `update webauthn_credentials set sign_count = $1, last_used_at = $2
+				where id = $3 and (sign_count < $1 or ($1 = 0 and sign_count = 0))`
+
+	res, err := m.conn().ExecContext(ctx, stmt, signCount, usedAt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) DeleteWebAuthnCredential(ctx context.Context, userID int, id int) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, `delete from webauthn_credentials where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) InsertWebAuthnChallenge(ctx context.Context, challenge models.WebAuthnChallenge) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// ceremonies nobody finished are forgotten as new ones start
+		_, err := tx.conn().ExecContext(ctx, `delete from webauthn_challenges where expires_at <= $1`, time.Now())
+		if err != nil {
+			return err
+		}
+
+		stmt := `insert into webauthn_challenges (challenge, ceremony, user_id, expires_at)
+					values ($1, $2, nullif($3, 0), $4)`
+
+		_, err = tx.conn().ExecContext(ctx, stmt,
+			challenge.Challenge,
+			challenge.Ceremony,
+			challenge.UserID,
+			challenge.ExpiresAt,
+		)
+		return err
+	})
+}
+
+func (m *PostgresDBRepo) UseWebAuthnChallenge(ctx context.Context, challenge string, ceremony string, now time.Time) (*models.WebAuthnChallenge, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// deleting it is what makes a challenge single use
+	stmt := `delete from webauthn_challenges
+				where challenge = $1 and ceremony = $2 and expires_at > $3
+				returning id, challenge, ceremony, coalesce(user_id, 0), expires_at`
+
+	var c models.WebAuthnChallenge
+	err := m.conn().QueryRowContext(ctx, stmt, challenge, ceremony, now).Scan(
+		&c.ID,
+		&c.Challenge,
+		&c.Ceremony,
+		&c.UserID,
+		&c.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (m *PostgresDBRepo) CountMagicLinks(ctx context.Context, email string, since time.Time) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select count(*) from magic_links where lower(email) = lower($1) and created_at > $2`
+
+	var count int
+	err := m.conn().QueryRowContext(ctx, query, email, since).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (m *PostgresDBRepo) InsertMagicLink(ctx context.Context, link models.MagicLink) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// a day of requests is more than the rate limit looks at
+		_, err := tx.conn().ExecContext(ctx,
+			`delete from magic_links where created_at < $1`, link.CreatedAt.Add(-24*time.Hour))
+		if err != nil {
+			return err
+		}
+
+		// nullif keeps the user and the token null for the addresses without an account
+		stmt := `insert into magic_links (email, user_id, token_hash, ip, created_at, expires_at)
+					values ($1, nullif($2, 0), nullif($3, ''), $4, $5, $6)`
+
+		_, err = tx.conn().ExecContext(ctx, stmt,
+			link.Email,
+			link.UserID,
+			link.TokenHash,
+			link.IP,
+			link.CreatedAt,
+			link.ExpiresAt,
+		)
+		return err
+	})
+}
+
+func (m *PostgresDBRepo) UseMagicLink(ctx context.Context, tokenHash string, usedAt time.Time) (*models.MagicLink, error) {
+	var link models.MagicLink
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// checking and marking in one statement, so two requests racing with the same link can not both win
+		stmt := `update magic_links set used_at = $1
+					where token_hash = $2 and used_at is null and expires_at > $1
+					returning id, email, user_id, token_hash, ip, created_at, expires_at, used_at`
+
+		err := tx.conn().QueryRowContext(ctx, stmt, usedAt, tokenHash).Scan(
+			&link.ID,
+			&link.Email,
+			&link.UserID,
+			&link.TokenHash,
+			&link.IP,
+			&link.CreatedAt,
+			&link.ExpiresAt,
+			&link.UsedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		// the other links sent to the user stop working too
+		_, err = tx.conn().ExecContext(ctx,
+			`update magic_links set used_at = $1 where user_id = $2 and used_at is null`, usedAt, link.UserID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+func (m *PostgresDBRepo) InsertOIDCLogin(ctx context.Context, login models.OIDCLogin) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// logins nobody came back from are forgotten as new ones start
+		_, err := tx.conn().ExecContext(ctx, `delete from oidc_logins where expires_at <= $1`, time.Now())
+		if err != nil {
+			return err
+		}
+
+		stmt := `insert into oidc_logins (state, nonce, code_verifier, expires_at)
+					values ($1, $2, $3, $4)`
+
+		_, err = tx.conn().ExecContext(ctx, stmt,
+			login.State,
+			login.Nonce,
+			login.CodeVerifier,
+			login.ExpiresAt,
+		)
+		return err
+	})
+}
+
+func (m *PostgresDBRepo) UseOIDCLogin(ctx context.Context, state string, now time.Time) (*models.OIDCLogin, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// deleting it is what makes a state single use
+	stmt := `delete from oidc_logins
+				where state = $1 and expires_at > $2
+				returning id, state, nonce, code_verifier, expires_at`
+
+	var login models.OIDCLogin
+	err := m.conn().QueryRowContext(ctx, stmt, state, now).Scan(
+		&login.ID,
+		&login.State,
+		&login.Nonce,
+		&login.CodeVerifier,
+		&login.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &login, nil
+}
+
+func (m *PostgresDBRepo) GetUserIdentity(ctx context.Context, issuer string, subject string) (*models.UserIdentity, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, user_id, issuer, subject, email, created_at, last_login_at
+				from user_identities where issuer = $1 and subject = $2`
+
+	var identity models.UserIdentity
+	err := m.conn().QueryRowContext(ctx, query, issuer, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Issuer,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.LastLoginAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (m *PostgresDBRepo) InsertUserIdentity(ctx context.Context, identity models.UserIdentity) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into user_identities (user_id, issuer, subject, email, created_at, last_login_at)
+				values ($1, $2, $3, $4, $5, $6) returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		identity.UserID,
+		identity.Issuer,
+		identity.Subject,
+		identity.Email,
+		identity.CreatedAt,
+		identity.LastLoginAt,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) RecordIdentityLogin(ctx context.Context, id int, email string, at time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx,
+		`update user_identities set email = $1, last_login_at = $2 where id = $3`, email, at, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) LoginThrottles(ctx context.Context, email string, ip string) ([]*models.LoginThrottle, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, kind, key, failures, last_failure_at, locked_until
+				from login_throttles
+				where (kind = $1 and key = lower($2)) or (kind = $3 and key = $4)`
+
+	rows, err := m.conn().QueryContext(ctx, query, models.LoginThrottleAccount, email, models.LoginThrottleIP, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanLoginThrottles(rows)
+}
+
+func (m *PostgresDBRepo) RecordLoginFailure(ctx context.Context, kind string, key string, at time.Time, since time.Time) (*models.LoginThrottle, error) {
+	var throttle models.LoginThrottle
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// every email typed gets a row, forget those nobody tried for a while
+		_, err := tx.conn().ExecContext(ctx,
+			`delete from login_throttles where last_failure_at < $1 and (locked_until is null or locked_until < $2)`, since, at)
+		if err != nil {
+			return err
+		}
+
+		// counting in one statement, so failures racing each other are all counted
+		stmt := `insert into login_throttles (kind, key, failures, last_failure_at)
+					values ($1, lower($2), 1, $3)
+					on conflict (kind, key) do update set
+						failures = case when login_throttles.last_failure_at < $4 then 1 else login_throttles.failures + 1 end,
+						last_failure_at = excluded.last_failure_at
+					returning id, kind, key, failures, last_failure_at, locked_until`
+
+		return tx.conn().QueryRowContext(ctx, stmt, kind, key, at, since).Scan(
+			&throttle.ID,
+			&throttle.Kind,
+			&throttle.Key,
+			&throttle.Failures,
+			&throttle.LastFailureAt,
+			&throttle.LockedUntil,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle, nil
+}
+
+func (m *PostgresDBRepo) LockLogin(ctx context.Context, id int, until time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update login_throttles set locked_until = greatest(coalesce(locked_until, $1), $1) where id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, until, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) ClearLoginFailures(ctx context.Context, kind string, key string) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from login_throttles where kind = $1 and key = lower($2)`, kind, key)
+	return err
+}
+
+func (m *PostgresDBRepo) LoginLockouts(ctx context.Context, now time.Time) ([]*models.LoginThrottle, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	query := `select id, kind, key, failures, last_failure_at, locked_until
+				from login_throttles
+				where locked_until > $1
+				order by locked_until desc, id`
+
+	rows, err := m.conn().QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanLoginThrottles(rows)
+}
+
+func (m *PostgresDBRepo) DeleteLoginThrottle(ctx context.Context, id int) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, `delete from login_throttles where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+// scan the columns selected by LoginThrottles and LoginLockouts
+func scanLoginThrottles(rows *sql.Rows) ([]*models.LoginThrottle, error) {
+	var throttles []*models.LoginThrottle
+	for rows.Next() {
+		var throttle models.LoginThrottle
+		err := rows.Scan(
+			&throttle.ID,
+			&throttle.Kind,
+			&throttle.Key,
+			&throttle.Failures,
+			&throttle.LastFailureAt,
+			&throttle.LockedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		throttles = append(throttles, &throttle)
+	}
+
+	return throttles, rows.Err()
+}
+
+func (m *PostgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// revisions keep the id of a deleted user, they are history
+	res, err := m.conn().ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) AllRoles(ctx context.Context) ([]*models.Role, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select r.name, r.description, coalesce(rp.permission, '')
+				from roles r
+				left join roles_permissions rp on (rp.role = r.name)
+				order by r.name, rp.permission`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*models.Role
+
+	for rows.Next() {
+		var role models.Role
+		var permission string
+		err := rows.Scan(&role.Name, &role.Description, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		// one row per permission, a role without any has a single row with an empty one
+		if len(roles) == 0 || roles[len(roles)-1].Name != role.Name {
+			role.Permissions = []string{}
+			roles = append(roles, &role)
+		}
+		if permission != "" {
+			last := roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+func (m *PostgresDBRepo) RolePermissions(ctx context.Context, role string) ([]string, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	rows, err := m.conn().QueryContext(ctx,
+		`select permission from roles_permissions where role = $1 order by permission`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+func (m *PostgresDBRepo) roleExists(ctx context.Context, role string) (bool, error) {
+	var exists bool
+	err := m.conn().QueryRowContext(ctx, `select exists (select 1 from roles where name = $1)`, role).Scan(&exists)
+	return exists, err
+}
+
+func (m *PostgresDBRepo) SetUserRole(ctx context.Context, id int, role string) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	exists, err := m.roleExists(ctx, role)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return repository.ErrUnknownRole
+	}
+
+	res, err := m.conn().ExecContext(ctx, `update users set role = $1, updated_at = $2 where id = $3`, role, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into refresh_tokens (id, family_id, user_id, issued_at, expires_at)
+				values ($1, $2, $3, $4, $5)`
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		token.ID,
+		token.FamilyID,
+		token.UserID,
+		token.IssuedAt,
+		token.ExpiresAt,
+	)
+	return err
+}
+
+func (m *PostgresDBRepo) GetRefreshToken(ctx context.Context, id string) (*models.RefreshToken, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, family_id, user_id, issued_at, expires_at, used_at, coalesce(replaced_by, ''), revoked_at
+				from refresh_tokens where id = $1`
+
+	var token models.RefreshToken
+
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
+		&token.ID,
+		&token.FamilyID,
+		&token.UserID,
+		&token.IssuedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+		&token.ReplacedBy,
+		&token.RevokedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (m *PostgresDBRepo) UseRefreshToken(ctx context.Context, id string, replacedBy string, usedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// checking and marking in one statement, so two requests racing with the same token can not both win
+	stmt := `update refresh_tokens set used_at = $1, replaced_by = $2
+				where id = $3 and used_at is null and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, usedAt, replacedBy, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where family_id = $2 and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, revokedAt, familyID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *PostgresDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int, revokedAt time.Time) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, revokedAt, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *PostgresDBRepo) InsertRevokedToken(ctx context.Context, token models.RevokedToken) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// nullif keeps the unique jti and the optional user id null for the entries without them
+	stmt := `insert into revoked_tokens (jti, user_id, issued_before, expires_at, revoked_at)
+				values (nullif($1, ''), nullif($2, 0), $3, $4, $5)
+				on conflict (jti) do nothing`
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		token.JTI,
+		token.UserID,
+		token.IssuedBefore,
+		token.ExpiresAt,
+		token.RevokedAt,
+	)
+	return err
+}
+
+func (m *PostgresDBRepo) ConsumeToken(ctx context.Context, token models.RevokedToken) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// the unique jti decides: no row is inserted for a token used already
+	stmt := `insert into revoked_tokens (jti, expires_at, revoked_at)
+				values ($1, $2, $3)
+				on conflict (jti) do nothing`
+
+	res, err := m.conn().ExecContext(ctx, stmt,
+		token.JTI,
+		token.ExpiresAt,
+		token.RevokedAt,
+	)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) RevokedTokens(ctx context.Context, now time.Time) ([]*models.RevokedToken, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, coalesce(jti, ''), coalesce(user_id, 0), issued_before, expires_at, revoked_at
+				from revoked_tokens where expires_at > $1 order by id`
+
+	rows, err := m.conn().QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*models.RevokedToken
+
+	for rows.Next() {
+		var token models.RevokedToken
+		err := rows.Scan(
+			&token.ID,
+			&token.JTI,
+			&token.UserID,
+			&token.IssuedBefore,
+			&token.ExpiresAt,
+			&token.RevokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (m *PostgresDBRepo) DeleteExpiredRevokedTokens(ctx context.Context, now time.Time) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, `delete from revoked_tokens where expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (m *PostgresDBRepo) AllAPIKeys(ctx context.Context) ([]*models.APIKey, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, name, prefix, key_hash, coalesce(created_by, 0), created_at, expires_at, last_used_at, revoked_at
+				from api_keys order by created_at desc, id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*models.APIKey
+	byID := make(map[int]*models.APIKey)
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		byID[key.ID] = key
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the scopes of every key in one query
+	scopes, err := m.conn().QueryContext(ctx, `select api_key_id, permission from api_keys_scopes order by permission`)
+	if err != nil {
+		return nil, err
+	}
+	defer scopes.Close()
+
+	for scopes.Next() {
+		var id int
+		var permission string
+		err := scopes.Scan(&id, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		if key, ok := byID[id]; ok {
+			key.Scopes = append(key.Scopes, permission)
+		}
+	}
+
+	return keys, scopes.Err()
+}
+
+func (m *PostgresDBRepo) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, name, prefix, key_hash, coalesce(created_by, 0), created_at, expires_at, last_used_at, revoked_at
+				from api_keys where prefix = $1`
+
+	key, err := scanAPIKey(m.conn().QueryRowContext(ctx, query, prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.conn().QueryContext(ctx,
+		`select permission from api_keys_scopes where api_key_id = $1 order by permission`, key.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		key.Scopes = append(key.Scopes, permission)
+	}
+
+	return key, rows.Err()
+}
+
+// scan the columns selected by AllAPIKeys and GetAPIKeyByPrefix, the scopes are read apart
+func scanAPIKey(row interface {
+	Scan(dest ...interface{}) error
+}) (*models.APIKey, error) {
+	key := models.APIKey{Scopes: []string{}}
+
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		&key.CreatedBy,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (m *PostgresDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	var newID int
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		stmt := `insert into api_keys (name, prefix, key_hash, created_by, created_at, expires_at)
+					values ($1, $2, $3, nullif($4, 0), $5, $6) returning id`
+
+		err := tx.conn().QueryRowContext(ctx, stmt,
+			key.Name,
+			key.Prefix,
+			key.Hash,
+			key.CreatedBy,
+			key.CreatedAt,
+			key.ExpiresAt,
+		).Scan(&newID)
+		if err != nil {
+			return err
+		}
+
+		for _, permission := range key.Scopes {
+			_, err := tx.conn().ExecContext(ctx,
+				`insert into api_keys_scopes (api_key_id, permission) values ($1, $2)`, newID, permission)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) RevokeAPIKey(ctx context.Context, id int, revokedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = coalesce(revoked_at, $1) where id = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, revokedAt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, usedAt, id)
+	return err
+}
+
+func (m *PostgresDBRepo) AllGenres(ctx context.Context) ([]*models.Genre, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.readContext(ctx)
+	defer cancel()
+
+	query := `select id, genre from genres order by genre`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var genres []*models.Genre
+	for rows.Next() {
+		var g models.Genre
+		err := rows.Scan(
+			&g.ID,
+			&g.Genre,
+			//&g.CreatedAt,
+			//&g.UpdateAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &g)
+	}
+	return genres, nil
+}
+
+func (m *PostgresDBRepo) InsertGenre(ctx context.Context, genre models.Genre) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	taken, err := m.genreNameTaken(ctx, genre.Genre, 0)
+	if err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, repository.ErrDuplicateGenre
+	}
+
+	stmt := `insert into genres (genre, created_at, updated_at) values ($1, $2, $3) returning id`
+
+	var newID int
+	err = m.conn().QueryRowContext(ctx, stmt, genre.Genre, genre.CreatedAt, genre.UpdatedAt).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) UpdateGenre(ctx context.Context, genre models.Genre) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	taken, err := m.genreNameTaken(ctx, genre.Genre, genre.ID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return repository.ErrDuplicateGenre
+	}
+
+	stmt := `update genres set genre = $1, updated_at = $2 where id = $3`
+
+	res, err := m.conn().ExecContext(ctx, stmt, genre.Genre, genre.UpdatedAt, genre.ID)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+// whether another genre than exceptID already has this name, ignoring case.
+// The unique index on lower(genre) still catches two admins racing for the same name.
+func (m *PostgresDBRepo) genreNameTaken(ctx context.Context, name string, exceptID int) (bool, error) {
+	query := `select exists (select 1 from genres where lower(genre) = lower($1) and id <> $2)`
+
+	var taken bool
+	err := m.conn().QueryRowContext(ctx, query, name, exceptID).Scan(&taken)
+	return taken, err
+}
+
+func (m *PostgresDBRepo) GenreMovieCount(ctx context.Context, id int) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	var count int
+	err := m.conn().QueryRowContext(ctx,
+		`select count(distinct movie_id) from movies_genres where genre_id = $1`, id).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (m *PostgresDBRepo) MergeGenres(ctx context.Context, from int, into int) (int, error) {
+	var moved int
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.adminContext(ctx)
+		defer cancel()
+
+		var found int
+		err := tx.conn().QueryRowContext(ctx, `select count(*) from genres where id in ($1, $2)`, from, into).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != 2 {
+			return sql.ErrNoRows
+		}
+
+		// the genres of these movies change, so edit forms opened before the merge are stale
+		res, err := tx.conn().ExecContext(ctx,
+			`update movies set version = version + 1 where id in (select movie_id from movies_genres where genre_id = $1)`, from)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		moved = int(n)
+
+		// movies that already have both genres keep a single link
+		stmt := `delete from movies_genres where genre_id = $1 and movie_id in
+					(select movie_id from movies_genres where genre_id = $2)`
+
+		_, err = tx.conn().ExecContext(ctx, stmt, from, into)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.conn().ExecContext(ctx, `update movies_genres set genre_id = $1 where genre_id = $2`, into, from)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.conn().ExecContext(ctx, `delete from genres where id = $1`, from)
+		return err
+	})
+
+	return moved, err
+}
+
+func (m *PostgresDBRepo) DeleteGenre(ctx context.Context, id int) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		// the genres of these movies change, so edit forms opened before the delete are stale
+		_, err := tx.conn().ExecContext(ctx,
+			`update movies set version = version + 1 where id in (select movie_id from movies_genres where genre_id = $1)`, id)
+		if err != nil {
+			return err
+		}
+
+		// remove the movie links explicitly rather than rely on the foreign key cascade
+		_, err = tx.conn().ExecContext(ctx, `delete from movies_genres where genre_id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.conn().ExecContext(ctx, `delete from genres where id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		return expectOneRow(res)
+	})
+}
+
+func (m *PostgresDBRepo) InsertMovie(ctx context.Context, movie models.Movie) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `insert into movies (title, description, release_date, runtime,
+					mpaa_rating, created_at, updated_at, image)
+					values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	var newID int
+
+	err := m.conn().QueryRowContext(ctx, stmt,
+		movie.Title,
+		movie.Description,
+		movie.ReleaseDate,
+		movie.RunTime,
+		movie.MPAARating,
+		movie.CreateAt,
+		movie.UpdatedAt,
+		movie.Image,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) UpdateMovie(ctx context.Context, movie models.Movie) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	// the version check and the bump happen in the same statement, so two concurrent edits can not both win
+	stmt := `update movies set title = $1, description = $2, release_date = $3,
+						runtime = $4, mpaa_rating = $5, updated_at = $6, image = $7,
+						version = version + 1
+						where id = $8 and version = $9 and deleted_at is null`
+	res, err := m.conn().ExecContext(ctx, stmt,
+		movie.Title,
+		movie.Description,
+		movie.ReleaseDate,
+		movie.RunTime,
+		movie.MPAARating,
+		movie.UpdatedAt,
+		movie.Image,
+		movie.ID,
+		movie.Version,
+	)
+
+	if err != nil {
+		return err
+	}
+	return versionConflict(res)
+}
+
+func (m *PostgresDBRepo) UpdateMovieGenres(ctx context.Context, id int, genreIDs []int) error {
+	// delete and re-insert in one transaction so a movie never ends up without its genres
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.writeContext(ctx)
+		defer cancel()
+
+		stmt := `delete from movies_genres where movie_id = $1`
+
+		_, err := tx.conn().ExecContext(ctx, stmt, id)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range genreIDs {
+			stmt := `insert into movies_genres (movie_id, genre_id) values ($1, $2)`
+			_, err := tx.conn().ExecContext(ctx, stmt, id, n)
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteMovie moves a movie to the trash, its genre links are kept so it can be restored
+func (m *PostgresDBRepo) DeleteMovie(ctx context.Context, id int, version int) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update movies set deleted_at = $1, version = version + 1
+				where id = $2 and version = $3 and deleted_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), id, version)
+	if err != nil {
+		return err
+	}
+
+	return versionConflict(res)
+}
+
+func (m *PostgresDBRepo) TrashedMovies(ctx context.Context) ([]*models.Movie, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	query := `
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''),
+			created_at, updated_at, deleted_at
+		from
+			movies
+		where
+			deleted_at is not null
+		order by
+			deleted_at desc
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []*models.Movie
+
+	for rows.Next() {
+		var movie models.Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.RunTime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.CreateAt,
+			&movie.UpdatedAt,
+			&movie.DeletedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	return movies, rows.Err()
+}
+
+func (m *PostgresDBRepo) RestoreMovie(ctx context.Context, id int) error {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	stmt := `update movies set deleted_at = null, version = version + 1 where id = $1 and deleted_at is not null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func (m *PostgresDBRepo) PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error) {
+	var purged int
+
+	err := m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		//you have a limited time with the context before time out
+		ctx, cancel := tx.adminContext(ctx)
+		defer cancel()
+
+		// remove the genre links explicitly rather than rely on the foreign key cascade
+		stmt := `delete from movies_genres where movie_id in
+					(select id from movies where deleted_at < $1)`
+
+		_, err := tx.conn().ExecContext(ctx, stmt, deletedBefore)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.conn().ExecContext(ctx, `delete from movies where deleted_at < $1`, deletedBefore)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		purged = int(n)
+		return err
+	})
+
+	return purged, err
+}
+
+// turn a versioned update that matched nothing into ErrVersionConflict.
+// A movie that is missing or in the trash is reported the same way, the caller reloads it to find out.
+func versionConflict(res sql.Result) error {
+	err := expectOneRow(res)
+	if err == sql.ErrNoRows {
+		return repository.ErrVersionConflict
+	}
+	return err
+}
+
+// SQLSTATE of a statement cancelled by the server
+const queryCanceled = "57014"
+
+// turn a statement the server cancelled into context.DeadlineExceeded. When the context of a query
+// ends, the driver asks Postgres to cancel it, and may report the error of the server instead of the context.
+func canceledQuery(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == queryCanceled {
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+	}
+	return err
+}
+
+// turn an update or delete that matched nothing into sql.ErrNoRows
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *PostgresDBRepo) MovieSnapshot(ctx context.Context, id int) (*models.Movie, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	query := `select id, title, release_date, runtime, mpaa_rating,
+							description, coalesce(image, ''), created_at, updated_at, deleted_at, version
+							from movies where id = $1`
+
+	var movie models.Movie
+
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.Title,
+		&movie.ReleaseDate,
+		&movie.RunTime,
+		&movie.MPAARating,
+		&movie.Description,
+		&movie.Image,
+		&movie.CreateAt,
+		&movie.UpdatedAt,
+		&movie.DeletedAt,
+		&movie.Version,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.conn().QueryContext(ctx, `select genre_id from movies_genres where movie_id = $1 order by genre_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var genreID int
+		err := rows.Scan(&genreID)
+		if err != nil {
+			return nil, err
+		}
+		movie.GenresArray = append(movie.GenresArray, genreID)
+	}
+
+	return &movie, rows.Err()
+}
+
+func (m *PostgresDBRepo) InsertMovieRevision(ctx context.Context, revision models.MovieRevision) (int, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.writeContext(ctx)
+	defer cancel()
+
+	snapshot, err := json.Marshal(revision.Snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	// the unique (movie_id, revision) constraint makes one of two concurrent writers fail
+	stmt := `insert into movie_revisions (movie_id, revision, action, snapshot, user_id, created_at)
+				values ($1, (select coalesce(max(revision), 0) + 1 from movie_revisions where movie_id = $1),
+					$2, $3, $4, $5)
+				returning revision`
+
+	var newRevision int
+
+	err = m.conn().QueryRowContext(ctx, stmt,
+		revision.MovieID,
+		revision.Action,
+		string(snapshot),
+		revision.UserID,
+		revision.CreatedAt,
+	).Scan(&newRevision)
+
+	if err != nil {
+		return 0, err
+	}
+	return newRevision, nil
+}
+
+func (m *PostgresDBRepo) MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	query := `select id, movie_id, revision, action, snapshot, user_id, created_at
+				from movie_revisions where movie_id = $1 order by revision desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*models.MovieRevision
+
+	for rows.Next() {
+		revision, err := scanMovieRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (m *PostgresDBRepo) MovieRevision(ctx context.Context, movieID int, revision int) (*models.MovieRevision, error) {
+	//you have a limited time with the context before time out
+	ctx, cancel := m.adminContext(ctx)
+	defer cancel()
+
+	query := `select id, movie_id, revision, action, snapshot, user_id, created_at
+				from movie_revisions where movie_id = $1 and revision = $2`
+
+	return scanMovieRevision(m.conn().QueryRowContext(ctx, query, movieID, revision))
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMovieRevision(row scanner) (*models.MovieRevision, error) {
+	var revision models.MovieRevision
+	var snapshot []byte
+
+	err := row.Scan(
+		&revision.ID,
+		&revision.MovieID,
+		&revision.Revision,
+		&revision.Action,
+		&snapshot,
+		&revision.UserID,
+		&revision.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(snapshot, &revision.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &revision, nil
 }
@@ -0,0 +1,38 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestCanceledQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool // reported as the deadline of the context
+	}{
+		{"cancelled by the server", &pgconn.PgError{Code: queryCanceled, Message: "canceling statement due to user request"}, true},
+		{"wrapped", fmt.Errorf("query: %w", &pgconn.PgError{Code: queryCanceled}), true},
+		{"other server error", &pgconn.PgError{Code: "42P01"}, false},
+		{"no rows", sql.ErrNoRows, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := canceledQuery(tt.err)
+			if errors.Is(err, context.DeadlineExceeded) != tt.want {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+
+	if err := canceledQuery(nil); err != nil {
+		t.Fatalf("no error: got %v", err)
+	}
+}
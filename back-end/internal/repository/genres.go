@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+)
+
+// longest name the genres.genre column can hold
+const MaxGenreLength = 255
+
+var ErrDuplicateGenre = errors.New("a genre with this name already exists")
+
+// ValidGenreName trims a genre name typed by an admin and checks it can be stored
+func ValidGenreName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("genre name is required")
+	}
+	if len(name) > MaxGenreLength {
+		return "", errors.New("genre name is too long")
+	}
+	return name, nil
+}
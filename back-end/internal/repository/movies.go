@@ -0,0 +1,243 @@
+package repository
+
+import (
+	"backend/internal/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMovieLimit = 20
+	MaxMovieLimit     = 100
+)
+
+// columns a movie list can be sorted by
+var MovieSortFields = []string{"title", "release_date", "runtime", "created_at"}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// returned by UpdateMovie and DeleteMovie when the movie is no longer at the version the caller read
+var ErrVersionConflict = errors.New("movie was changed by someone else")
+
+// MovieListOptions selects one page of movies.
+// Either Page or Cursor is used, a non-empty Cursor wins.
+type MovieListOptions struct {
+	Page   int    // 1-based page number for offset pagination
+	Limit  int    // page size
+	Cursor string // opaque keyset cursor from a previous MovieList
+
+	Sort       string // one of MovieSortFields
+	Descending bool
+
+	Genres      []int    // movies having any of these genres
+	MPAARatings []string // movies having any of these ratings
+	YearFrom    int      // release year range, 0 means unbounded
+	YearTo      int
+	RuntimeMin  int // runtime range in minutes, 0 means unbounded
+	RuntimeMax  int
+}
+
+// MovieList is one page of movies plus what the client needs to fetch the next ones
+type MovieList struct {
+	Movies     []*models.Movie
+	Total      int    // number of movies matching the filters, on every page
+	NextCursor string // empty on the last page
+	PrevCursor string // empty on the first page
+}
+
+// Normalize fills in defaults and rejects options that can not be queried
+func (o *MovieListOptions) Normalize() error {
+	if o.Limit <= 0 {
+		o.Limit = DefaultMovieLimit
+	}
+	if o.Limit > MaxMovieLimit {
+		o.Limit = MaxMovieLimit
+	}
+	if o.Page <= 0 {
+		o.Page = 1
+	}
+	if o.Sort == "" {
+		o.Sort = "title"
+	}
+
+	valid := false
+	for _, field := range MovieSortFields {
+		if o.Sort == field {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("cannot sort by %q, use one of %s", o.Sort, strings.Join(MovieSortFields, ", "))
+	}
+
+	if o.YearFrom > 0 && o.YearTo > 0 && o.YearFrom > o.YearTo {
+		return errors.New("year_from is after year_to")
+	}
+	if o.RuntimeMin > 0 && o.RuntimeMax > 0 && o.RuntimeMin > o.RuntimeMax {
+		return errors.New("runtime_min is greater than runtime_max")
+	}
+
+	return nil
+}
+
+// MovieCursor points just after (or just before, for Before cursors) one movie of a sorted list.
+// It is handed to clients base64 encoded and must be used with the same sort it was created for.
+type MovieCursor struct {
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d"`
+	Before bool   `json:"b"` // true for a cursor to the previous page
+	Value  string `json:"v"` // value of the sort column
+	ID     int    `json:"i"` // tie breaker
+}
+
+// NewMovieCursor returns the encoded cursor of movie m for the sort in opts
+func NewMovieCursor(m *models.Movie, opts MovieListOptions, before bool) string {
+	c := MovieCursor{
+		Sort:   opts.Sort,
+		Desc:   opts.Descending,
+		Before: before,
+		Value:  movieSortValue(m, opts.Sort),
+		ID:     m.ID,
+	}
+
+	out, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// DecodeMovieCursor reads a cursor sent back by a client and checks it fits opts
+func DecodeMovieCursor(s string, opts MovieListOptions) (MovieCursor, error) {
+	var c MovieCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(raw, &c)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	// a cursor only makes sense for the ordering it was created with
+	if c.Sort != opts.Sort || c.Desc != opts.Descending {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// Movie returns a movie holding only the cursor position (ID and the sort column)
+func (c MovieCursor) Movie() (*models.Movie, error) {
+	m := models.Movie{ID: c.ID}
+
+	var err error
+	switch c.Sort {
+	case "title":
+		m.Title = c.Value
+	case "runtime":
+		m.RunTime, err = strconv.Atoi(c.Value)
+	case "release_date":
+		m.ReleaseDate, err = time.Parse("2006-01-02", c.Value)
+	case "created_at":
+		m.CreateAt, err = time.Parse(time.RFC3339Nano, c.Value)
+	default:
+		err = ErrInvalidCursor
+	}
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &m, nil
+}
+
+// MovieSortKey returns the value of the sort column of m, typed for use as a query argument
+func MovieSortKey(m *models.Movie, field string) interface{} {
+	switch field {
+	case "runtime":
+		return m.RunTime
+	case "release_date":
+		return m.ReleaseDate
+	case "created_at":
+		return m.CreateAt
+	default:
+		return m.Title
+	}
+}
+
+// CompareMovies orders a and b by field, then by id, ascending
+func CompareMovies(a, b *models.Movie, field string) int {
+	c := 0
+	switch field {
+	case "runtime":
+		c = a.RunTime - b.RunTime
+	case "release_date":
+		c = a.ReleaseDate.Compare(b.ReleaseDate)
+	case "created_at":
+		c = a.CreateAt.Compare(b.CreateAt)
+	default:
+		c = strings.Compare(a.Title, b.Title)
+	}
+
+	if c == 0 {
+		c = a.ID - b.ID
+	}
+	return c
+}
+
+func movieSortValue(m *models.Movie, field string) string {
+	switch field {
+	case "runtime":
+		return strconv.Itoa(m.RunTime)
+	case "release_date":
+		return m.ReleaseDate.Format("2006-01-02")
+	case "created_at":
+		return m.CreateAt.Format(time.RFC3339Nano)
+	default:
+		return m.Title
+	}
+}
+
+// PageMovies builds a MovieList from the rows of a list query.
+// fetched is in query order and holds up to opts.Limit+1 rows, the extra row only tells there is more.
+// For a Before cursor the query runs in reverse order, so the rows are flipped back here.
+func PageMovies(fetched []*models.Movie, total int, opts MovieListOptions, cursor *MovieCursor) *MovieList {
+	hasMore := len(fetched) > opts.Limit
+	if hasMore {
+		fetched = fetched[:opts.Limit]
+	}
+
+	var hasNext, hasPrev bool
+	switch {
+	case cursor == nil:
+		hasNext, hasPrev = hasMore, opts.Page > 1
+	case cursor.Before:
+		hasNext, hasPrev = true, hasMore
+		for i, j := 0, len(fetched)-1; i < j; i, j = i+1, j-1 {
+			fetched[i], fetched[j] = fetched[j], fetched[i]
+		}
+	default:
+		hasNext, hasPrev = hasMore, true
+	}
+
+	list := &MovieList{
+		Movies: append([]*models.Movie{}, fetched...),
+		Total:  total,
+	}
+
+	if len(list.Movies) > 0 {
+		if hasNext {
+			list.NextCursor = NewMovieCursor(list.Movies[len(list.Movies)-1], opts, false)
+		}
+		if hasPrev {
+			list.PrevCursor = NewMovieCursor(list.Movies[0], opts, true)
+		}
+	}
+
+	return list
+}
@@ -2,40 +2,261 @@ package repository
 
 import (
 	"backend/internal/models"
+	"context"
 	"database/sql"
+	"time"
 )
 
+// every method that touches the data takes the context of the caller (usually r.Context())
+// so the query is cancelled when the client goes away
 type DatabaseRepo interface {
 	//return the pointer to the SQL db
 	Connection() *sql.DB
 
+	// run fn in a transaction: everything done through repo is committed if fn returns nil, rolled back otherwise
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
+
 	//return a list of pointers that point to every movie queried from the database
-	AllMovies(genre ...int) ([]*models.Movie, error)
+	AllMovies(ctx context.Context, genre ...int) ([]*models.Movie, error)
+
+	//return one page of movies matching the filters, in the requested order
+	ListMovies(ctx context.Context, opts MovieListOptions) (*MovieList, error)
+
+	//full text search over titles and descriptions, best matches first
+	SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error)
+
+	//titles starting with or close to prefix (typos allowed), best matches first
+	SuggestMovies(ctx context.Context, prefix string, limit int) ([]*models.MovieSuggestion, error)
 
 	// get the existing movie by id just for display
-	OneMovie(id int) (*models.Movie, error)
+	OneMovie(ctx context.Context, id int) (*models.Movie, error)
 
 	//get the existing movie by id to edit (required authorization)
-	OneMovieForEdit(id int) (*models.Movie, []*models.Genre, error)
+	OneMovieForEdit(ctx context.Context, id int) (*models.Movie, []*models.Genre, error)
 
 	//query user by email
-	GetUserByEmail(email string) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
 
 	//query user by id
-	GetUserByID(id int) (*models.User, error)
+	GetUserByID(ctx context.Context, id int) (*models.User, error)
+
+	//users whose name or email contains search, every user if search is empty
+	ListUsers(ctx context.Context, search string) ([]*models.User, error)
+
+	//insert one user, ErrDuplicateEmail if the email is taken
+	InsertUser(ctx context.Context, user models.User) (int, error)
+
+	//update the name and email of a user, ErrDuplicateEmail if the email is taken
+	UpdateUser(ctx context.Context, user models.User) error
+
+	//disable a user at disabledAt, or enable it again with nil
+	SetUserDisabled(ctx context.Context, id int, disabledAt *time.Time) error
+
+	//mark the email of a user as verified, a user verified already keeps the first time
+	SetEmailVerified(ctx context.Context, id int, verifiedAt time.Time) error
+
+	//replace the bcrypt hash of the password of a user
+	SetUserPassword(ctx context.Context, id int, hash string, updatedAt time.Time) error
+
+	//remember a password reset token that was emailed
+	InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error
+
+	//one password reset by the hash of its token
+	GetPasswordReset(ctx context.Context, tokenHash string) (*models.PasswordReset, error)
+
+	//use a password reset token along with every other unused token of its user,
+	//sql.ErrNoRows if it was used already or has expired at usedAt
+	UsePasswordReset(ctx context.Context, tokenHash string, usedAt time.Time) error
+
+	//record something that happened to the credentials of a user
+	InsertAuthEvent(ctx context.Context, event models.AuthEvent) error
+
+	//the events of a user, newest first
+	UserAuthEvents(ctx context.Context, userID int) ([]*models.AuthEvent, error)
+
+	//start the two-factor enrollment of a user with a new secret, not required at login yet
+	SetTOTPSecret(ctx context.Context, id int, secret string) error
+
+	//require two-factor authentication from a user, replacing their recovery codes with codeHashes
+	EnableTOTP(ctx context.Context, id int, enabledAt time.Time, codeHashes []string) error
+
+	//stop requiring two-factor authentication, forgetting the secret and the recovery codes
+	DisableTOTP(ctx context.Context, id int) error
+
+	//remember the time step of a code that was accepted, sql.ErrNoRows if a code of this step or a later one was
+	UseTOTPStep(ctx context.Context, id int, step int64) error
+
+	//use one recovery code of a user, sql.ErrNoRows if it does not exist or was used already
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string, usedAt time.Time) error
+
+	//the passkeys of a user, oldest first
+	UserWebAuthnCredentials(ctx context.Context, userID int) ([]*models.WebAuthnCredential, error)
+
+	//one passkey by its base64url credential id, sql.ErrNoRows if unknown
+	GetWebAuthnCredential(ctx context.Context, credentialID string) (*models.WebAuthnCredential, error)
+
+	//register a passkey, ErrDuplicateCredential if it is registered already
+	InsertWebAuthnCredential(ctx context.Context, cred models.WebAuthnCredential) (int, error)
+
+	//record a login with a passkey and its new signature counter,
+	//sql.ErrNoRows if the counter did not increase (both 0 for authenticators without a counter)
+	UseWebAuthnCredential(ctx context.Context, id int, signCount int64, usedAt time.Time) error
+
+	//delete a passkey of a user, sql.ErrNoRows if they have no such passkey
+	DeleteWebAuthnCredential(ctx context.Context, userID int, id int) error
+
+	//store the challenge of a ceremony being started, forgetting those expired
+	InsertWebAuthnChallenge(ctx context.Context, challenge models.WebAuthnChallenge) error
+
+	//take the challenge of a ceremony to finish it, sql.ErrNoRows if unknown, already taken or expired
+	UseWebAuthnChallenge(ctx context.Context, challenge string, ceremony string, now time.Time) (*models.WebAuthnChallenge, error)
+
+	//number of login links asked for an email address since a time, whether it has an account or not
+	CountMagicLinks(ctx context.Context, email string, since time.Time) (int, error)
+
+	//record a login link asked for, forgetting those asked for more than a day before it
+	InsertMagicLink(ctx context.Context, link models.MagicLink) error
+
+	//use a login link, which cancels the other links of the user, sql.ErrNoRows if unknown, used or expired
+	UseMagicLink(ctx context.Context, tokenHash string, usedAt time.Time) (*models.MagicLink, error)
+
+	//store a login sent to the OpenID Connect provider, forgetting those expired
+	InsertOIDCLogin(ctx context.Context, login models.OIDCLogin) error
+
+	//take the login a callback brings the state of, sql.ErrNoRows if unknown, already taken or expired
+	UseOIDCLogin(ctx context.Context, state string, now time.Time) (*models.OIDCLogin, error)
+
+	//the account of a provider by its subject, sql.ErrNoRows if it is not linked to a user
+	GetUserIdentity(ctx context.Context, issuer string, subject string) (*models.UserIdentity, error)
+
+	//link the account of a provider to a user
+	InsertUserIdentity(ctx context.Context, identity models.UserIdentity) (int, error)
+
+	//record a login with the account of a provider, and the email it has now
+	RecordIdentityLogin(ctx context.Context, id int, email string, at time.Time) error
+
+	//the failed logins counted for an email and for a client address, those without any left out
+	LoginThrottles(ctx context.Context, email string, ip string) ([]*models.LoginThrottle, error)
+
+	//count a failed login, starting again from 1 when the last failure is before since,
+	//and forget the keys without failure since then that are not locked
+	RecordLoginFailure(ctx context.Context, kind string, key string, at time.Time, since time.Time) (*models.LoginThrottle, error)
+
+	//block the logins of a key until a time, unless it is blocked longer already
+	LockLogin(ctx context.Context, id int, until time.Time) error
+
+	//forget the failed logins of a key
+	ClearLoginFailures(ctx context.Context, kind string, key string) error
+
+	//the keys blocked after a time
+	LoginLockouts(ctx context.Context, now time.Time) ([]*models.LoginThrottle, error)
+
+	//forget the failed logins of a key by id, sql.ErrNoRows if unknown
+	DeleteLoginThrottle(ctx context.Context, id int) error
+
+	//delete one user
+	DeleteUser(ctx context.Context, id int) error
+
+	//every role with its permissions
+	AllRoles(ctx context.Context) ([]*models.Role, error)
+
+	//permissions granted by a role, sorted
+	RolePermissions(ctx context.Context, role string) ([]string, error)
+
+	//give a user another role, ErrUnknownRole if it does not exist
+	SetUserRole(ctx context.Context, id int, role string) error
+
+	//remember a refresh token that was handed out
+	InsertRefreshToken(ctx context.Context, token models.RefreshToken) error
+
+	//one refresh token by jti
+	GetRefreshToken(ctx context.Context, id string) (*models.RefreshToken, error)
+
+	//mark a refresh token as exchanged for replacedBy, sql.ErrNoRows if it was already used or revoked
+	UseRefreshToken(ctx context.Context, id string, replacedBy string, usedAt time.Time) error
+
+	//revoke the tokens of a family not revoked yet and return how many there were
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) (int, error)
+
+	//revoke the tokens of a user not revoked yet and return how many there were
+	RevokeUserRefreshTokens(ctx context.Context, userID int, revokedAt time.Time) (int, error)
+
+	//add an entry to the access token revocation list, revoking a jti twice is not an error
+	InsertRevokedToken(ctx context.Context, token models.RevokedToken) error
+
+	//revoke a single-use token by its jti, sql.ErrNoRows when it was revoked already:
+	//of the requests racing with the same token, only one gets to use it
+	ConsumeToken(ctx context.Context, token models.RevokedToken) error
+
+	//entries of the revocation list that still match tokens not expired at now
+	RevokedTokens(ctx context.Context, now time.Time) ([]*models.RevokedToken, error)
+
+	//forget the entries that expired before now and return how many there were
+	DeleteExpiredRevokedTokens(ctx context.Context, now time.Time) (int, error)
+
+	//every API key with its scopes, newest first
+	AllAPIKeys(ctx context.Context) ([]*models.APIKey, error)
+
+	//one API key by the prefix of the key
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error)
+
+	//insert one API key with its scopes
+	InsertAPIKey(ctx context.Context, key models.APIKey) (int, error)
+
+	//revoke an API key, a key revoked already keeps its first revocation time
+	RevokeAPIKey(ctx context.Context, id int, revokedAt time.Time) error
+
+	//record when an API key was last used
+	TouchAPIKey(ctx context.Context, id int, usedAt time.Time) error
 
 	// get all genres
-	AllGenres() ([]*models.Genre, error)
+	AllGenres(ctx context.Context) ([]*models.Genre, error)
+
+	//insert one genre, ErrDuplicateGenre if the name is taken
+	InsertGenre(ctx context.Context, genre models.Genre) (int, error)
+
+	//rename a genre, ErrDuplicateGenre if the name is taken
+	UpdateGenre(ctx context.Context, genre models.Genre) error
+
+	//number of movies, trashed ones included, linked to a genre
+	GenreMovieCount(ctx context.Context, id int) (int, error)
+
+	//move every movie of genre from to genre into, delete from and return how many movies were moved
+	MergeGenres(ctx context.Context, from int, into int) (int, error)
+
+	//delete a genre and its links to movies
+	DeleteGenre(ctx context.Context, id int) error
 
 	// insert one movie
-	InsertMovie(movie models.Movie) (int, error)
+	InsertMovie(ctx context.Context, movie models.Movie) (int, error)
 
-	//update movie
-	UpdateMovie(movie models.Movie) error
+	//update movie if it is still at movie.Version, otherwise ErrVersionConflict
+	UpdateMovie(ctx context.Context, movie models.Movie) error
 
 	//update movie genres id list
-	UpdateMovieGenres(id int, genreIDs []int) error
+	UpdateMovieGenres(ctx context.Context, id int, genreIDs []int) error
+
+	//move one movie to the trash if it is still at version, otherwise ErrVersionConflict
+	DeleteMovie(ctx context.Context, id int, version int) error
+
+	//movies in the trash, most recently deleted first
+	TrashedMovies(ctx context.Context) ([]*models.Movie, error)
+
+	//take a movie out of the trash, with the genres it had
+	RestoreMovie(ctx context.Context, id int) error
+
+	//permanently delete the movies trashed before deletedBefore and return how many there were
+	PurgeTrash(ctx context.Context, deletedBefore time.Time) (int, error)
+
+	//get a movie with its genre ids whether it is in the trash or not, to snapshot it
+	MovieSnapshot(ctx context.Context, id int) (*models.Movie, error)
+
+	//append a revision to the history of a movie and return its revision number
+	InsertMovieRevision(ctx context.Context, revision models.MovieRevision) (int, error)
+
+	//history of a movie, newest first
+	MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error)
 
-	//delete one movie
-	DeleteMovie(id int) error
+	//one revision of a movie
+	MovieRevision(ctx context.Context, movieID int, revision int) (*models.MovieRevision, error)
 }
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var ErrEmptySearch = errors.New("search query is empty")
+
+// SearchTerm is one part of a search query that every result has to match
+type SearchTerm struct {
+	Words  []string // more than one word is a phrase, matched in this order
+	Prefix bool     // the last word only has to be the start of a word
+}
+
+// ParseSearchQuery splits what a user typed into terms.
+// Quoted text is a phrase and a trailing * makes a prefix, e.g. `"lost ark" indi*`.
+// Only letters and digits are kept, so the terms are safe to turn into a tsquery.
+func ParseSearchQuery(q string) ([]SearchTerm, error) {
+	var terms []SearchTerm
+
+	// odd parts are inside quotes
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			if term, ok := newSearchTerm(part); ok {
+				terms = append(terms, term)
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			// a word like "spider-man" becomes the phrase spider <-> man
+			if term, ok := newSearchTerm(field); ok {
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	return terms, nil
+}
+
+func newSearchTerm(text string) (SearchTerm, bool) {
+	term := SearchTerm{
+		Words:  SearchWords(text),
+		Prefix: strings.HasSuffix(strings.TrimSpace(text), "*"),
+	}
+	return term, len(term.Words) > 0
+}
+
+// SearchWords lowercases text and splits it into words of letters and digits
+func SearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// shortest password a user can have
+const MinPasswordLength = 8
+
+// bcrypt ignores whatever comes after 72 bytes
+const MaxPasswordLength = 72
+
+var ErrDuplicateEmail = errors.New("a user with this email already exists")
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// ValidEmail trims an email typed by an admin and checks it is a bare address
+func ValidEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errors.New("invalid email address")
+	}
+	return email, nil
+}
+
+// ValidPassword checks a new password is long enough, mixes letters with digits or symbols,
+// and does not contain the name of the email address it is for
+func ValidPassword(password string, email string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", MaxPasswordLength)
+	}
+
+	var letters, others bool
+	for _, r := range password {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else {
+			others = true
+		}
+	}
+	if !letters || !others {
+		return errors.New("password must contain letters and digits or symbols")
+	}
+
+	name, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if len(name) >= 3 && strings.Contains(strings.ToLower(password), name) {
+		return errors.New("password must not contain your email address")
+	}
+
+	return nil
+}
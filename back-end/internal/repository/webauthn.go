@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+)
+
+// longest name the webauthn_credentials.name column can hold
+const MaxCredentialNameLength = 255
+
+var ErrDuplicateCredential = errors.New("this passkey is already registered")
+
+// ValidCredentialName trims the name a user gives a passkey, "Passkey" when they give none
+func ValidCredentialName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Passkey", nil
+	}
+	if len(name) > MaxCredentialNameLength {
+		return "", errors.New("passkey name is too long")
+	}
+	return name, nil
+}
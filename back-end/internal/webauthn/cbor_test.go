@@ -0,0 +1,130 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func unhex(t testing.TB, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// a COSE_Key of an ES256 public key, its coordinates all zero: not a point of the curve
+const coseEC2Key = "a5010203262001215820" + zeros32 + "225820" + zeros32
+
+const zeros32 = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func TestDecodeCBOR(t *testing.T) {
+	// examples of RFC 8949 appendix A, and what is left out of the supported subset
+	tests := []struct {
+		hex  string
+		want interface{}
+		err  bool
+	}{
+		{"00", int64(0), false},
+		{"17", int64(23), false},
+		{"1818", int64(24), false},
+		{"1903e8", int64(1000), false},
+		{"1b000000e8d4a51000", int64(1000000000000), false},
+		{"1bffffffffffffffff", nil, true}, // above int64
+		{"20", int64(-1), false},
+		{"3903e7", int64(-1000), false},
+		{"4401020304", []byte{1, 2, 3, 4}, false},
+		{"6449455446", "IETF", false},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}, false},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}, false},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}, false},
+		{"f4", false, false},
+		{"f5", true, false},
+		{"f6", nil, false},
+		{"f7", nil, true},                       // undefined
+		{"f93c00", nil, true},                   // float
+		{"c074323031332d30332d3231", nil, true}, // tag
+		{"5f42010243030405ff", nil, true},       // indefinite length
+		{"a1f401", nil, true},                   // map key neither integer nor text
+		{"", nil, true},
+		{"1a0102", nil, true},                   // argument cut short
+		{"45010203", nil, true},                 // byte string cut short
+		{"9a7fffffff", nil, true},               // array longer than the data
+		{"818181818181818181818100", nil, true}, // too deep
+	}
+
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(unhex(t, tt.hex))
+		if tt.err {
+			if !errors.Is(err, errCBOR) {
+				t.Errorf("%s: got %v, want %v", tt.hex, got, errCBOR)
+			}
+			continue
+		}
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, %x left: %v, want %#v", tt.hex, got, rest, err, tt.want)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	for _, seed := range []string{"00", "1b000000e8d4a51000", "3903e7", "4401020304", "6449455446", "83010203", "a26161016162820203", "f5", "f6", coseEC2Key, "9a7fffffff", "818181818181818181818100"} {
+		f.Add(unhex(f, seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, rest, err := decodeCBOR(data)
+		if err != nil {
+			return
+		}
+
+		// what is left is the end of data, after one value at least a byte long
+		if len(rest) >= len(data) || !bytes.Equal(data[len(data)-len(rest):], rest) {
+			t.Fatalf("%x left of %x", rest, data)
+		}
+
+		// and the value alone decodes to nothing left
+		_, again, err := decodeCBOR(data[:len(data)-len(rest)])
+		if err != nil || len(again) != 0 {
+			t.Fatalf("value %x alone: %x left: %v", data[:len(data)-len(rest)], again, err)
+		}
+	})
+}
+
+func FuzzParsePublicKey(f *testing.F) {
+	f.Add(unhex(f, coseEC2Key))
+	f.Add(unhex(f, "a4010103272006215820"+zeros32))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return
+		}
+		if key.Key == nil {
+			t.Fatalf("no key in %x", data)
+		}
+		key.Verify([]byte("data"), []byte("signature"))
+	})
+}
+
+func FuzzParseAuthenticatorData(f *testing.F) {
+	header := zeros32 + "41" + "00000001"
+	f.Add(unhex(f, header))
+	f.Add(unhex(f, zeros32+"45"+"00000000"+"00000000000000000000000000000000"+"0004"+"01020304"+coseEC2Key))
+	f.Add(unhex(f, zeros32+"81"+"00000000"+"a0"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ad, err := parseAuthenticatorData(data)
+		if err != nil {
+			return
+		}
+		if ad.flags&flagAttestedData != 0 && (len(ad.credentialID) == 0 || len(ad.publicKey) == 0) {
+			t.Fatalf("attested credential data without a credential in %x", data)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) of the public keys accepted, in order of preference
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// labels of a COSE_Key map
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // the modulus n for RSA keys
+	coseX   = -2 // the exponent e for RSA keys
+	coseY   = -3
+)
+
+// key types and curves
+const (
+	coseOKP     = 1
+	coseEC2     = 2
+	coseRSA     = 3
+	coseP256    = 1
+	coseEd25519 = 6
+)
+
+// PublicKey is a credential public key
+type PublicKey struct {
+	Algorithm int
+	Key       crypto.PublicKey
+}
+
+// ParsePublicKey reads a public key in the COSE_Key format of the authenticator data
+func ParsePublicKey(cose []byte) (*PublicKey, error) {
+	value, rest, err := decodeCBOR(cose)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	integer := func(label int64) int64 {
+		n, _ := m[label].(int64)
+		return n
+	}
+	bytes := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	alg := integer(coseAlg)
+
+	switch {
+	case integer(coseKty) == coseEC2 && alg == AlgES256 && integer(coseCrv) == coseP256:
+		x, y := bytes(coseX), bytes(coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrMalformed
+		}
+
+		point := append(append([]byte{4}, x...), y...)
+		px, py := elliptic.Unmarshal(elliptic.P256(), point)
+		if px == nil {
+			// not on the curve
+			return nil, ErrMalformed
+		}
+		return &PublicKey{AlgES256, &ecdsa.PublicKey{Curve: elliptic.P256(), X: px, Y: py}}, nil
+
+	case integer(coseKty) == coseOKP && alg == AlgEdDSA && integer(coseCrv) == coseEd25519:
+		x := bytes(coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		return &PublicKey{AlgEdDSA, ed25519.PublicKey(x)}, nil
+
+	case integer(coseKty) == coseRSA && alg == AlgRS256:
+		n, e := new(big.Int).SetBytes(bytes(coseCrv)), new(big.Int).SetBytes(bytes(coseX))
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, ErrMalformed
+		}
+		return &PublicKey{AlgRS256, &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+
+	default:
+		return nil, ErrAlgorithm
+	}
+}
+
+// Verify checks the signature of data made with the private key
+func (k *PublicKey) Verify(data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,464 @@
+// Package webauthn verifies the ceremonies of WebAuthn (https://www.w3.org/TR/webauthn-2/),
+// how passkeys are registered and used to log in, from the side of the relying party.
+//
+// Credentials are requested without attestation: the statement of the authenticator about
+// its own make is not verified, the public key it returns is trusted from then on.
+// Logging in requires the user to be verified by the authenticator (a PIN, a fingerprint),
+// so a passkey stands for a password and a second factor at once.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Encoding is how binary values, such as credential ids and challenges, travel in JSON: base64url without padding
+var Encoding = base64.RawURLEncoding
+
+// type of the client data of each ceremony
+const (
+	TypeCreate = "webauthn.create"
+	TypeGet    = "webauthn.get"
+)
+
+// the only credential type there is
+const publicKeyType = "public-key"
+
+// flags of the authenticator data
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagAttestedData   = 0x40
+	flagExtensionData  = 0x80
+	authDataHeaderSize = 37 // rpIdHash, flags and signCount
+)
+
+var (
+	ErrMalformed        = errors.New("malformed credential")
+	ErrType             = errors.New("response is for another ceremony")
+	ErrChallenge        = errors.New("response is for another challenge")
+	ErrOrigin           = errors.New("response comes from another origin")
+	ErrRelyingParty     = errors.New("credential is for another relying party")
+	ErrUserPresence     = errors.New("user was not present")
+	ErrUserVerification = errors.New("user was not verified by the authenticator")
+	ErrAlgorithm        = errors.New("unsupported public key algorithm")
+	ErrCredential       = errors.New("response is for another credential")
+	ErrSignature        = errors.New("invalid signature")
+	ErrSignCount        = errors.New("signature counter went backwards, the authenticator may have been cloned")
+)
+
+// RelyingParty is the site passkeys are registered with
+type RelyingParty struct {
+	ID      string        // domain of the site, such as example.com
+	Name    string        // shown by the authenticator
+	Origin  string        // where the front-end runs the ceremonies, such as https://example.com
+	Timeout time.Duration // time the user has to answer the prompt of the browser
+}
+
+// Credential is what the relying party keeps of a registered passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge, base64url encoded
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return Encoding.EncodeToString(b), nil
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"` // user handle, base64url
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"` // base64url
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the options of navigator.credentials.create, binary values base64url encoded
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"` // milliseconds
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of navigator.credentials.get, binary values base64url encoded
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout,omitempty"` // milliseconds
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions asks to create a passkey for user, which can not be one of the credentials of exclude.
+// Passkeys are discoverable credentials: the user picks theirs at login, without typing their email.
+func (rp *RelyingParty) CreationOptions(challenge string, user UserEntity, exclude [][]byte) CreationOptions {
+	opts := CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+	for _, alg := range Algorithms {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, CredentialParameter{Type: publicKeyType, Alg: alg})
+	}
+	return opts
+}
+
+// RequestOptions asks to log in with one of the credentials of allow, or any passkey of the site when empty
+func (rp *RelyingParty) RequestOptions(challenge string, allow [][]byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          rp.Timeout.Milliseconds(),
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	out := []CredentialDescriptor{}
+	for _, id := range ids {
+		out = append(out, CredentialDescriptor{Type: publicKeyType, ID: Encoding.EncodeToString(id)})
+	}
+	return out
+}
+
+type AuthenticatorAttestationResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// AttestationResponse is the credential returned by navigator.credentials.create, binary values base64url encoded
+type AttestationResponse struct {
+	ID       string                           `json:"id"`
+	RawID    string                           `json:"rawId"`
+	Type     string                           `json:"type"`
+	Response AuthenticatorAttestationResponse `json:"response"`
+}
+
+type AuthenticatorAssertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// AssertionResponse is the credential returned by navigator.credentials.get, binary values base64url encoded
+type AssertionResponse struct {
+	ID       string                         `json:"id"`
+	RawID    string                         `json:"rawId"`
+	Type     string                         `json:"type"`
+	Response AuthenticatorAssertionResponse `json:"response"`
+}
+
+// ClientData is what the browser tells of the ceremony, signed by the authenticator with the authenticator data
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+func parseClientData(encoded string) (*ClientData, []byte, error) {
+	raw, err := Encoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+
+	var data ClientData
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	return &data, raw, nil
+}
+
+// Challenge is the challenge the response answers, to look up the ceremony it finishes
+func (r *AttestationResponse) Challenge() (string, error) {
+	data, _, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return data.Challenge, nil
+}
+
+// Challenge is the challenge the response answers, to look up the ceremony it finishes
+func (r *AssertionResponse) Challenge() (string, error) {
+	data, _, err := parseClientData(r.Response.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return data.Challenge, nil
+}
+
+// CredentialID is the id of the credential used to log in
+func (r *AssertionResponse) CredentialID() ([]byte, error) {
+	id, err := Encoding.DecodeString(r.RawID)
+	if err != nil || len(id) == 0 {
+		return nil, ErrMalformed
+	}
+	return id, nil
+}
+
+// UserHandle is the user the authenticator says the credential belongs to, nil if it does not say
+func (r *AssertionResponse) UserHandle() ([]byte, error) {
+	if r.Response.UserHandle == "" {
+		return nil, nil
+	}
+
+	handle, err := Encoding.DecodeString(r.Response.UserHandle)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return handle, nil
+}
+
+// check the client data answers challenge for this site
+func (rp *RelyingParty) checkClientData(data *ClientData, typ, challenge string) error {
+	if data.Type != typ {
+		return ErrType
+	}
+	if subtle.ConstantTimeCompare([]byte(data.Challenge), []byte(challenge)) != 1 {
+		return ErrChallenge
+	}
+	if data.Origin != rp.Origin || data.CrossOrigin {
+		return ErrOrigin
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte // with the attested credential data of a registration only
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < authDataHeaderSize {
+		return nil, ErrMalformed
+	}
+
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[authDataHeaderSize:]
+
+	if ad.flags&flagAttestedData != 0 {
+		// aaguid, then the length of the credential id
+		if len(rest) < 18 {
+			return nil, ErrMalformed
+		}
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || len(rest) < length {
+			return nil, ErrMalformed
+		}
+		ad.credentialID, rest = rest[:length], rest[length:]
+
+		// the public key is the CBOR value that follows
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		ad.publicKey, rest = rest[:len(rest)-len(after)], after
+	}
+
+	if ad.flags&flagExtensionData != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+	return ad, nil
+}
+
+// check the authenticator data is for this site and the user proved who they are
+func (rp *RelyingParty) checkAuthenticatorData(ad *authenticatorData) error {
+	hash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, hash[:]) {
+		return ErrRelyingParty
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return ErrUserPresence
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return ErrUserVerification
+	}
+	return nil
+}
+
+// FinishRegistration verifies the response to CreationOptions with challenge and returns the new credential
+func (rp *RelyingParty) FinishRegistration(res *AttestationResponse, challenge string) (*Credential, error) {
+	if res.Type != publicKeyType {
+		return nil, ErrMalformed
+	}
+
+	data, _, err := parseClientData(res.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	err = rp.checkClientData(data, TypeCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := Encoding.DecodeString(res.Response.AttestationObject)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	value, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+	object, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	err = rp.checkAuthenticatorData(ad)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, ErrMalformed
+	}
+
+	rawID, err := Encoding.DecodeString(res.RawID)
+	if err != nil || !bytes.Equal(rawID, ad.credentialID) {
+		return nil, ErrCredential
+	}
+
+	// only keys we know how to verify signatures with are registered
+	_, err = ParsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        ad.credentialID,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// FinishLogin verifies the response to RequestOptions with challenge, made with the credential cred,
+// and returns the new value of its signature counter
+func (rp *RelyingParty) FinishLogin(res *AssertionResponse, challenge string, cred *Credential) (uint32, error) {
+	if res.Type != publicKeyType {
+		return 0, ErrMalformed
+	}
+
+	id, err := res.CredentialID()
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(id, cred.ID) {
+		return 0, ErrCredential
+	}
+
+	data, clientDataJSON, err := parseClientData(res.Response.ClientDataJSON)
+	if err != nil {
+		return 0, err
+	}
+	err = rp.checkClientData(data, TypeGet, challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	authData, err := Encoding.DecodeString(res.Response.AuthenticatorData)
+	if err != nil {
+		return 0, ErrMalformed
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	err = rp.checkAuthenticatorData(ad)
+	if err != nil {
+		return 0, err
+	}
+
+	signature, err := Encoding.DecodeString(res.Response.Signature)
+	if err != nil {
+		return 0, ErrMalformed
+	}
+	key, err := ParsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// the authenticator signs its data followed by the hash of the client data
+	hash := sha256.Sum256(clientDataJSON)
+	if !key.Verify(append(append([]byte(nil), authData...), hash[:]...), signature) {
+		return 0, ErrSignature
+	}
+
+	// authenticators without a counter always send 0, the others must send more than last time
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return ad.signCount, nil
+}
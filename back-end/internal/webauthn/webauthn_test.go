@@ -0,0 +1,160 @@
+package webauthn_test
+
+import (
+	"backend/internal/webauthn"
+	"backend/internal/webauthn/webauthntest"
+	"errors"
+	"testing"
+	"time"
+)
+
+const origin = "https://movies.test"
+
+var rp = &webauthn.RelyingParty{
+	ID:      "movies.test",
+	Name:    "Movies",
+	Origin:  origin,
+	Timeout: time.Minute,
+}
+
+var user = webauthn.UserEntity{ID: webauthn.Encoding.EncodeToString([]byte("1")), Name: "admin@example.com"}
+
+func challenge(t *testing.T) string {
+	t.Helper()
+
+	c, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// register creates a passkey on authenticator and returns it as the relying party stores it
+func register(t *testing.T, authenticator *webauthntest.Authenticator) *webauthn.Credential {
+	t.Helper()
+
+	c := challenge(t)
+	res, err := authenticator.Create(rp.CreationOptions(c, user, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := rp.FinishRegistration(res, c)
+	if err != nil {
+		t.Fatalf("registration: %v", err)
+	}
+	return cred
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	authenticator := webauthntest.New(origin)
+	cred := register(t, authenticator)
+
+	for i := 0; i < 2; i++ {
+		c := challenge(t)
+		res, err := authenticator.Get(rp.RequestOptions(c, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handle, err := res.UserHandle()
+		if err != nil || string(handle) != "1" {
+			t.Fatalf("user handle %q: %v", handle, err)
+		}
+
+		signCount, err := rp.FinishLogin(res, c, cred)
+		if err != nil {
+			t.Fatalf("login %d: %v", i+1, err)
+		}
+		if signCount <= cred.SignCount {
+			t.Fatalf("login %d: sign count %d after %d", i+1, signCount, cred.SignCount)
+		}
+		cred.SignCount = signCount
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		answer func(sent string) string // the challenge the authenticator answers
+		want   error
+	}{
+		{"other origin", "https://evil.test", func(sent string) string { return sent }, webauthn.ErrOrigin},
+		{"other challenge", origin, func(string) string { return "another" }, webauthn.ErrChallenge},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := challenge(t)
+			res, err := webauthntest.New(tt.origin).Create(rp.CreationOptions(tt.answer(c), user, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = rp.FinishRegistration(res, c)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		origin    string
+		answer    func(sent string) string
+		signCount uint32 // stored by the relying party before the login
+		want      error
+	}{
+		{"other origin", "https://evil.test", func(sent string) string { return sent }, 0, webauthn.ErrOrigin},
+		{"other challenge", origin, func(string) string { return "another" }, 0, webauthn.ErrChallenge},
+		{"sign count going backwards", origin, func(sent string) string { return sent }, 5, webauthn.ErrSignCount},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := webauthntest.New(origin)
+			cred := register(t, authenticator)
+			cred.SignCount = tt.signCount
+
+			// the passkey is registered from the site, the login comes from tt.origin
+			authenticator.Origin = tt.origin
+
+			c := challenge(t)
+			res, err := authenticator.Get(rp.RequestOptions(tt.answer(c), nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = rp.FinishLogin(res, c, cred)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginWithAnotherKey(t *testing.T) {
+	cred := register(t, webauthntest.New(origin))
+
+	// a passkey of another authenticator, presented with the id of the one registered
+	other := webauthntest.New(origin)
+	register(t, other)
+
+	c := challenge(t)
+	res, err := other.Get(rp.RequestOptions(c, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ID = webauthn.Encoding.EncodeToString(cred.ID)
+	res.RawID = res.ID
+
+	_, err = rp.FinishLogin(res, c, cred)
+	if !errors.Is(err, webauthn.ErrSignature) {
+		t.Fatalf("got %v, want %v", err, webauthn.ErrSignature)
+	}
+}
@@ -0,0 +1,176 @@
+// Package webauthntest is a software authenticator, to run the WebAuthn ceremonies
+// of a relying party without a browser or a security key, such as in tests.
+package webauthntest
+
+import (
+	"backend/internal/webauthn"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Authenticator holds passkeys with ES256 keys, and verifies every user
+type Authenticator struct {
+	Origin string // origin of the client data, the page running the ceremonies
+
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// New returns an authenticator without any passkey, used from origin
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// Create answers opts the way navigator.credentials.create does, with a new passkey
+func (a *Authenticator) Create(opts webauthn.CreationOptions) (*webauthn.AttestationResponse, error) {
+	supported := false
+	for _, param := range opts.PubKeyCredParams {
+		supported = supported || param.Alg == webauthn.AlgES256
+	}
+	if !supported {
+		return nil, errors.New("ES256 is not accepted")
+	}
+
+	userHandle, err := webauthn.Encoding.DecodeString(opts.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, excluded := range opts.ExcludeCredentials {
+		for _, c := range a.credentials {
+			if webauthn.Encoding.EncodeToString(c.id) == excluded.ID {
+				return nil, errors.New("a passkey of the user is already registered")
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &credential{id: id, rpID: opts.RP.ID, userHandle: userHandle, key: key}
+
+	// attested credential data: an aaguid of zeros, the credential id and its public key
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, encodeCBOR(cborMap{
+		{1, 2},  // kty: EC2
+		{3, -7}, // alg: ES256
+		{-1, 1}, // crv: P-256
+		{-2, pad(key.X.Bytes())},
+		{-3, pad(key.Y.Bytes())},
+	})...)
+
+	authData := c.authenticatorData(0x40, attested)
+
+	clientData, err := a.clientData(webauthn.TypeCreate, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation := encodeCBOR(cborMap{
+		{"fmt", "none"},
+		{"attStmt", cborMap{}},
+		{"authData", authData},
+	})
+
+	a.credentials = append(a.credentials, c)
+
+	return &webauthn.AttestationResponse{
+		ID:    webauthn.Encoding.EncodeToString(id),
+		RawID: webauthn.Encoding.EncodeToString(id),
+		Type:  "public-key",
+		Response: webauthn.AuthenticatorAttestationResponse{
+			ClientDataJSON:    webauthn.Encoding.EncodeToString(clientData),
+			AttestationObject: webauthn.Encoding.EncodeToString(attestation),
+		},
+	}, nil
+}
+
+// Get answers opts the way navigator.credentials.get does, with the first passkey allowed,
+// or the first passkey of the site when opts allows any
+func (a *Authenticator) Get(opts webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	var c *credential
+	for _, candidate := range a.credentials {
+		if candidate.rpID != opts.RPID {
+			continue
+		}
+		allowed := len(opts.AllowCredentials) == 0
+		for _, allow := range opts.AllowCredentials {
+			allowed = allowed || webauthn.Encoding.EncodeToString(candidate.id) == allow.ID
+		}
+		if allowed {
+			c = candidate
+			break
+		}
+	}
+	if c == nil {
+		return nil, errors.New("no passkey for this site")
+	}
+
+	c.signCount++
+	authData := c.authenticatorData(0, nil)
+
+	clientData, err := a.clientData(webauthn.TypeGet, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), hash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.AssertionResponse{
+		ID:    webauthn.Encoding.EncodeToString(c.id),
+		RawID: webauthn.Encoding.EncodeToString(c.id),
+		Type:  "public-key",
+		Response: webauthn.AuthenticatorAssertionResponse{
+			ClientDataJSON:    webauthn.Encoding.EncodeToString(clientData),
+			AuthenticatorData: webauthn.Encoding.EncodeToString(authData),
+			Signature:         webauthn.Encoding.EncodeToString(signature),
+			UserHandle:        webauthn.Encoding.EncodeToString(c.userHandle),
+		},
+	}, nil
+}
+
+func (a *Authenticator) clientData(typ, challenge string) ([]byte, error) {
+	return json.Marshal(webauthn.ClientData{Type: typ, Challenge: challenge, Origin: a.Origin})
+}
+
+// the hash of the rp id, the flags with the user present and verified, the counter and then extra
+func (c *credential) authenticatorData(flags byte, extra []byte) []byte {
+	hash := sha256.Sum256([]byte(c.rpID))
+
+	data := append([]byte(nil), hash[:]...)
+	data = append(data, flags|0x01|0x04)
+	data = binary.BigEndian.AppendUint32(data, c.signCount)
+	return append(data, extra...)
+}
+
+// coordinates of a P-256 point are 32 bytes, with their leading zeros
+func pad(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
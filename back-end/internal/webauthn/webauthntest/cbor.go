@@ -0,0 +1,50 @@
+package webauthntest
+
+import "encoding/binary"
+
+// a CBOR map written in the order of its entries, the order authenticators use
+type cborMap []cborEntry
+
+type cborEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// encodeCBOR encodes the values an authenticator writes: int, string, []byte and cborMap
+func encodeCBOR(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHeader(1, uint64(-1-v))
+		}
+		return cborHeader(0, uint64(v))
+	case []byte:
+		return append(cborHeader(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHeader(3, uint64(len(v))), v...)
+	case cborMap:
+		out := cborHeader(5, uint64(len(v)))
+		for _, entry := range v {
+			out = append(out, encodeCBOR(entry.key)...)
+			out = append(out, encodeCBOR(entry.value)...)
+		}
+		return out
+	default:
+		panic("webauthntest: can not encode value as CBOR")
+	}
+}
+
+func cborHeader(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+}
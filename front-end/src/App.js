@@ -48,9 +48,16 @@ function App() {
   }, [tickInterval])
   
   const logOut = () => {
+    // send the access token too, so it is revoked along with the refresh token
+    const headers = new Headers();
+    if (jwtToken !== "") {
+      headers.append("Authorization", "Bearer " + jwtToken);
+    }
+
     const requestOptions = {
       method: "GET",
-      credentials: "include"
+      credentials: "include",
+      headers: headers,
     }
     fetch(`/logout`, requestOptions)
       .catch(error => {
@@ -177,6 +177,8 @@ const EditMovie = () => {
         // if we are editing existing movie, change to PATCH
         if (movie.id > 0) {
             method = "PATCH";
+            // only save if nobody changed the movie since we loaded it
+            headers.append("If-Match", `"${movie.version}"`);
         }
 
         const requestBody = movie;
@@ -193,7 +195,12 @@ const EditMovie = () => {
         }
 
         fetch(`/admin/movies/${movie.id}`, requestOptions)
-            .then(response => response.json())
+            .then(response => {
+                if (response.status === 412) {
+                    alertConflict();
+                }
+                return response.json()
+            })
             .then(data => {
                 if (data.error) {
                     console.log(data.error); 
@@ -235,6 +242,15 @@ const EditMovie = () => {
         })
     }
 
+    // the movie was saved by someone else after we loaded it
+    const alertConflict = () => {
+        Swal.fire({
+            title: 'Movie changed',
+            text: "Someone else saved this movie while you were editing it. Reload the page to see their changes.",
+            icon: 'warning',
+        })
+    }
+
     const confirmDelete = () => {
         Swal.fire({
             title: 'Delete movie?',
@@ -248,13 +264,19 @@ const EditMovie = () => {
             if (result.isConfirmed) {
                 let headers = new Headers();
                 headers.append("Authorization", "Bearer "+jwtToken)
+                headers.append("If-Match", `"${movie.version}"`)
 
                 const requestOptions = {
                     method:"DELETE",
                     headers: headers,
                 }
                 fetch(`/admin/movies/${movie.id}`, requestOptions)
-                    .then(response => response.json())
+                    .then(response => {
+                        if (response.status === 412) {
+                            alertConflict();
+                        }
+                        return response.json()
+                    })
                     .then(data => {
                         if (data.error) {
                             console.log(data.error);
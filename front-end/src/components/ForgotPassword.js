@@ -0,0 +1,54 @@
+import { useState } from "react";
+import { useOutletContext } from "react-router-dom";
+import Input from "./form/input";
+
+const ForgotPassword = () => {
+    const [email, setEmail] = useState("");
+
+    const { setAlertClassName, setAlertMessage } = useOutletContext();
+
+    const handleSubmit = (e) => {
+        e.preventDefault();
+
+        const requestOptions = {
+            method: "POST",
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ email: email })
+        }
+
+        fetch(`/auth/forgot-password`, requestOptions)
+            .then((response) => response.json())
+            .then((data) => {
+                // the answer is the same whether the account exists or not
+                setAlertClassName(data.error ? "alert-danger" : "alert-success");
+                setAlertMessage(data.message);
+            })
+            .catch(error => {
+                setAlertClassName("alert-danger")
+                setAlertMessage(error);
+            })
+    }
+
+    return(
+        <div className="col-md-6 offset-md-3">
+            <h2>Forgot your password?</h2>
+            <hr />
+            <form onSubmit={handleSubmit}>
+                <Input
+                    title="Email Address"
+                    type="email"
+                    className='form-control'
+                    name="email"
+                    autoComplete="email"
+                    onChange={event => setEmail(event.target.value)}
+                />
+                <hr />
+                <input type="submit" className="btn btn-primary" value="Send me a link" />
+            </form>
+        </div>
+    )
+}
+
+export default ForgotPassword;
@@ -0,0 +1,15 @@
+// how many movies of a paged list are shown, and the button to load the next page
+const LoadMore = ({ shown, total, hasMore, onClick }) => {
+    return (
+        <div className="d-flex align-items-center mb-3">
+            <span className="text-muted me-3">{shown} of {total} movies</span>
+            {hasMore &&
+            <button type="button" className="btn btn-outline-secondary btn-sm" onClick={onClick}>
+                Load more
+            </button>
+            }
+        </div>
+    )
+}
+
+export default LoadMore;
@@ -1,10 +1,17 @@
 import { useState } from "react";
-import { useNavigate, useOutletContext } from "react-router-dom";
+import { Link, useLocation, useNavigate, useOutletContext } from "react-router-dom";
 import Input from "./form/input";
 
 const Login = () => {
     const [email, setEmail] = useState("");
     const [password, setPassword] = useState("")
+    // set when the account has two-factor authentication, the code is asked next.
+    // A login link of an account with it lands here with its challenge, and so does
+    // single sign-on, in the fragment of the URL.
+    const location = useLocation();
+    const [challengeToken, setChallengeToken] = useState(
+        location.state?.challengeToken || new URLSearchParams(location.hash.slice(1)).get("challenge") || "");
+    const [code, setCode] = useState("");
 
     const { setJwtToken, setAlertClassName, setAlertMessage, toggleRefresh } = useOutletContext();
 
@@ -13,11 +20,19 @@ const Login = () => {
     const handleSubmit = (e) => {
         e.preventDefault();
 
-        // build the request payload
+        // build the request payload, the code goes with the challenge of the password step
+        let url = `/auth`;
         let payload = {
             email: email,
             password: password,
         }
+        if (challengeToken !== "") {
+            url = `/auth/2fa`;
+            payload = {
+                challenge_token: challengeToken,
+                code: code,
+            }
+        }
 
         const requestOptions = {
             method: "POST",
@@ -28,12 +43,19 @@ const Login = () => {
             body: JSON.stringify(payload)
         }
 
-        fetch(`/auth`, requestOptions)
+        fetch(url, requestOptions)
             .then((response) => response.json())
             .then((data) => {
                 if (data.error) {
+                    // a challenge is good for one code, a wrong one starts over with the password
+                    setChallengeToken("");
+                    setCode("");
                     setAlertClassName("alert-danger");
                     setAlertMessage(data.message);
+                } else if (data.two_factor_required) {
+                    setChallengeToken(data.challenge_token);
+                    setAlertClassName("d-none");
+                    setAlertMessage("");
                 } else {
                     setJwtToken(data.access_token)
                     setAlertClassName("d-none");
@@ -47,10 +69,100 @@ const Login = () => {
                 setAlertMessage(error);
             })
     }
+    // email a link to log in without the password
+    const handleMagicLink = () => {
+        const requestOptions = {
+            method: "POST",
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ email: email })
+        }
+
+        fetch(`/auth/magic-link`, requestOptions)
+            .then((response) => response.json())
+            .then((data) => {
+                setAlertClassName(data.error ? "alert-danger" : "alert-success");
+                setAlertMessage(data.message);
+            })
+            .catch(error => {
+                setAlertClassName("alert-danger")
+                setAlertMessage(error);
+            })
+    }
+
+    // log in with a passkey: the browser asks the authenticator to sign the challenge of the api
+    const handlePasskey = async () => {
+        try {
+            const begin = await fetch(`/auth/webauthn/login/begin`, { method: "POST", credentials: 'include' })
+                .then((response) => response.json());
+            if (begin.error) {
+                throw new Error(begin.message);
+            }
+
+            const options = begin.data;
+            const credential = await navigator.credentials.get({
+                publicKey: {
+                    ...options,
+                    challenge: fromBase64url(options.challenge),
+                    allowCredentials: options.allowCredentials.map((c) => ({ ...c, id: fromBase64url(c.id) })),
+                },
+            });
+
+            const requestOptions = {
+                method: "POST",
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                credentials: 'include',
+                body: JSON.stringify({
+                    id: credential.id,
+                    rawId: toBase64url(credential.rawId),
+                    type: credential.type,
+                    response: {
+                        clientDataJSON: toBase64url(credential.response.clientDataJSON),
+                        authenticatorData: toBase64url(credential.response.authenticatorData),
+                        signature: toBase64url(credential.response.signature),
+                        userHandle: credential.response.userHandle ? toBase64url(credential.response.userHandle) : "",
+                    },
+                }),
+            }
+
+            const data = await fetch(`/auth/webauthn/login/finish`, requestOptions).then((response) => response.json());
+            if (data.error) {
+                throw new Error(data.message);
+            }
+
+            setJwtToken(data.access_token)
+            setAlertClassName("d-none");
+            setAlertMessage("");
+            toggleRefresh(true);
+            navigate("/");
+        } catch (error) {
+            setAlertClassName("alert-danger")
+            setAlertMessage(error.message);
+        }
+    }
+
     return(
         <div className="col-md-6 offset-md-3">
             <h2>Login</h2>
             <hr />
+            {challengeToken !== "" ?
+            <form onSubmit={handleSubmit}>
+                <Input 
+                    title="Code from your authenticator app, or a recovery code"
+                    type="text"
+                    className='form-control'
+                    name="code"
+                    autoComplete="one-time-code"
+                    value={code}
+                    onChange={event => setCode(event.target.value)}
+                />
+                <hr />
+                <input type="submit" className="btn btn-primary" value="Verify" />
+            </form>
+            :
             <form onSubmit={handleSubmit}>
                 <Input 
                     title="Email Address"
@@ -72,8 +184,33 @@ const Login = () => {
                 <hr />
                 <input type="submit" className="btn btn-primary" value="Login" />
             </form>
+            }
+            {challengeToken === "" &&
+            <div className="mt-3">
+                <button type="button" className="btn btn-outline-secondary me-2" onClick={handlePasskey}>
+                    Log in with a passkey
+                </button>
+                <button type="button" className="btn btn-outline-secondary me-2" onClick={handleMagicLink}>
+                    Email me a login link
+                </button>
+                {/* a page load, not a fetch: the dev server only proxies fetches to the api */}
+                <a className="btn btn-outline-secondary" href="http://localhost:8080/auth/oidc/login">
+                    Log in with SSO
+                </a>
+            </div>
+            }
+            <p className="mt-3">
+                <Link to="/forgot-password">Forgot your password?</Link>
+            </p>
         </div>
     )
 }
 
+// WebAuthn binary values travel in JSON as base64url
+const toBase64url = (buffer) =>
+    btoa(String.fromCharCode(...new Uint8Array(buffer))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+
+const fromBase64url = (value) =>
+    Uint8Array.from(atob(value.replace(/-/g, "+").replace(/_/g, "/")), (c) => c.charCodeAt(0));
+
 export default Login;
\ No newline at end of file
@@ -0,0 +1,54 @@
+import { useEffect, useRef } from "react";
+import { useNavigate, useOutletContext, useSearchParams } from "react-router-dom";
+
+const MagicLink = () => {
+    const [searchParams] = useSearchParams();
+
+    const { setJwtToken, setAlertClassName, setAlertMessage, toggleRefresh } = useOutletContext();
+
+    const navigate = useNavigate();
+
+    // a link works once, it must not be sent twice when the effect runs again
+    const sent = useRef(false);
+
+    useEffect(() => {
+        if (sent.current) {
+            return;
+        }
+        sent.current = true;
+
+        // the token comes from the link of the email
+        const token = searchParams.get("token") || "";
+
+        fetch(`/auth/magic-link/verify?token=${encodeURIComponent(token)}`, { credentials: 'include' })
+            .then((response) => response.json())
+            .then((data) => {
+                if (data.error) {
+                    setAlertClassName("alert-danger");
+                    setAlertMessage(data.message);
+                    navigate("/login");
+                } else if (data.two_factor_required) {
+                    // the code is asked on the login page
+                    navigate("/login", { state: { challengeToken: data.challenge_token } });
+                } else {
+                    setJwtToken(data.access_token)
+                    setAlertClassName("d-none");
+                    setAlertMessage("");
+                    toggleRefresh(true);
+                    navigate("/");
+                }
+            })
+            .catch(error => {
+                setAlertClassName("alert-danger")
+                setAlertMessage(error);
+            })
+    }, [searchParams, setJwtToken, setAlertClassName, setAlertMessage, toggleRefresh, navigate]);
+
+    return(
+        <div className="col-md-6 offset-md-3">
+            <h2>Logging in...</h2>
+        </div>
+    )
+}
+
+export default MagicLink;
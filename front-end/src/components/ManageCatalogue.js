@@ -1,34 +1,17 @@
-import { useEffect, useState } from "react";
+import { useEffect } from "react";
 import { Link, useNavigate, useOutletContext } from "react-router-dom";
+import LoadMore from "./LoadMore";
+import useMoviePages from "./useMoviePages";
 
 const ManageCatalogue = () => {
-    const [movies, setMovies] = useState([]);
     const { jwtToken } = useOutletContext();
     const navigate = useNavigate();
+    const { movies, total, hasMore, loadMore } = useMoviePages(`/admin/movies?limit=100`, jwtToken);
 
     useEffect( () => {
         if (jwtToken === "") {
             navigate("/login");
-            return
         }
-        const headers = new Headers();
-        headers.append("Content-Type", "application/json");
-        headers.append("Authorization", "Bearer " + jwtToken);
-        
-        const requestOptions = {
-            method: "GET",
-            headers: headers
-        }
-
-        fetch(`/admin/movies`, requestOptions)
-            .then((response) => response.json())
-            .then((data) => {
-                setMovies(data)
-            })
-            .catch(err => {
-                console.log(err);
-            })
-
     }, [jwtToken, navigate]);
 
     return(
@@ -57,6 +40,7 @@ const ManageCatalogue = () => {
                     ))}
                 </tbody>
             </table>
+            <LoadMore shown={movies.length} total={total} hasMore={hasMore} onClick={loadMore} />
         </div>
     )
 }
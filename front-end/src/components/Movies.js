@@ -1,28 +1,9 @@
-import { useEffect, useState } from "react";
 import { Link } from "react-router-dom";
+import LoadMore from "./LoadMore";
+import useMoviePages from "./useMoviePages";
 
 const Movies = () => {
-    const [movies, setMovies] = useState([]);
-
-    useEffect( () => {
-        const headers = new Headers();
-        headers.append("Content-Type", "applcation/json");
-
-        const requestOptions = {
-            method: "GET",
-            headers: headers
-        }
-
-        fetch(`http://localhost:8080/movies`, requestOptions)
-            .then((response) => response.json())
-            .then((data) => {
-                setMovies(data)
-            })
-            .catch(err => {
-                console.log(err);
-            })
-
-    }, [])
+    const { movies, total, hasMore, loadMore } = useMoviePages(`http://localhost:8080/movies?limit=100`);
 
     return(
         <div>
@@ -50,6 +31,7 @@ const Movies = () => {
                     ))}
                 </tbody>
             </table>
+            <LoadMore shown={movies.length} total={total} hasMore={hasMore} onClick={loadMore} />
         </div>
     )
 }
@@ -1,5 +1,6 @@
-import { useEffect, useState } from "react";
 import { Link, useLocation, useParams } from "react-router-dom";
+import LoadMore from "./LoadMore";
+import useMoviePages from "./useMoviePages";
 
 
 const OneGenre = ()=>{
@@ -7,35 +8,11 @@ const OneGenre = ()=>{
   const location = useLocation();
   const {genreName} = location.state;
   
-  //set stateful variables
-  const [movies, setMovies] = useState([]);
-
   // get the id from the url
   let {id} = useParams();
 
-  // useEffect to get list of movies
-  useEffect(()=> {
-    const headers = new Headers();
-    headers.append("Content-Type", "application/json")
-
-    const requestOptions = {
-      method: "GET",
-      headers: headers,
-    }
-
-    fetch(`/movies/genres/${id}`)
-      .then(response => response.json())
-      .then(data => {
-        if (data.error) {
-          console.log(data.message);
-        } else {
-          setMovies(data)
-        }
-      })
-      .catch(err => {
-        console.log(err);
-      })
-  }, [id])
+  // the movies of the genre, a page at a time
+  const { movies, total, hasMore, loadMore } = useMoviePages(`/movies/genres/${id}?limit=100`);
 
   // return jsx
 
@@ -43,7 +20,8 @@ const OneGenre = ()=>{
     <>
       <h2>Genre: {genreName}</h2>
       <hr />
-      {movies ? (
+      {movies.length > 0 ? (
+      <>
       <table className="table table-striped table-hover">
         <thead>
           <tr>
@@ -66,7 +44,8 @@ const OneGenre = ()=>{
           ))}
         </tbody>
       </table>
-
+      <LoadMore shown={movies.length} total={total} hasMore={hasMore} onClick={loadMore} />
+      </>
   ) : (
     <p>No movies in this genre (yet)!</p>
   )}
@@ -0,0 +1,68 @@
+import { useState } from "react";
+import { useNavigate, useOutletContext, useSearchParams } from "react-router-dom";
+import Input from "./form/input";
+
+const ResetPassword = () => {
+    const [password, setPassword] = useState("");
+    const [searchParams] = useSearchParams();
+
+    const { setAlertClassName, setAlertMessage } = useOutletContext();
+
+    const navigate = useNavigate();
+
+    const handleSubmit = (e) => {
+        e.preventDefault();
+
+        // the token comes from the link of the email
+        let payload = {
+            token: searchParams.get("token") || "",
+            password: password,
+        }
+
+        const requestOptions = {
+            method: "POST",
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify(payload)
+        }
+
+        fetch(`/auth/reset-password`, requestOptions)
+            .then((response) => response.json())
+            .then((data) => {
+                if (data.error) {
+                    setAlertClassName("alert-danger");
+                    setAlertMessage(data.message);
+                } else {
+                    setAlertClassName("alert-success");
+                    setAlertMessage(data.message);
+                    navigate("/login");
+                }
+            })
+            .catch(error => {
+                setAlertClassName("alert-danger")
+                setAlertMessage(error);
+            })
+    }
+
+    return(
+        <div className="col-md-6 offset-md-3">
+            <h2>Choose a new password</h2>
+            <hr />
+            <form onSubmit={handleSubmit}>
+                <Input
+                    title="New Password"
+                    type="password"
+                    className='form-control'
+                    name="password"
+                    autoComplete="new-password"
+                    onChange={event => setPassword(event.target.value)}
+                />
+                <hr />
+                <input type="submit" className="btn btn-primary" value="Change password" />
+            </form>
+        </div>
+    )
+}
+
+export default ResetPassword;
@@ -0,0 +1,67 @@
+import { useCallback, useEffect, useState } from "react";
+
+// the movies of a paged list of the api, loaded a page at a time: loadMore follows meta.next_cursor.
+// Nothing is loaded while jwtToken is the empty string, lists that need no login leave it undefined.
+const useMoviePages = (url, jwtToken) => {
+    const [movies, setMovies] = useState([]);
+    const [total, setTotal] = useState(0);
+    const [nextCursor, setNextCursor] = useState("");
+
+    const fetchPage = useCallback((cursor) => {
+        const headers = new Headers();
+        headers.append("Content-Type", "application/json");
+        if (jwtToken) {
+            headers.append("Authorization", "Bearer " + jwtToken);
+        }
+
+        // the cursor keeps the limit, sort and filters of url
+        const separator = url.includes("?") ? "&" : "?";
+        const pageURL = cursor === "" ? url : `${url}${separator}cursor=${encodeURIComponent(cursor)}`;
+
+        return fetch(pageURL, { method: "GET", headers: headers })
+            .then((response) => response.json())
+            .then((data) => {
+                if (data.error) {
+                    throw new Error(data.message);
+                }
+                return data;
+            });
+    }, [url, jwtToken]);
+
+    useEffect(() => {
+        if (jwtToken === "") {
+            return;
+        }
+
+        let current = true;
+        fetchPage("")
+            .then((data) => {
+                if (current) {
+                    setMovies(data.data ?? []);
+                    setTotal(data.meta?.total ?? 0);
+                    setNextCursor(data.meta?.next_cursor ?? "");
+                }
+            })
+            .catch(err => {
+                console.log(err);
+            })
+
+        // a page answered after the url changed belongs to the previous list
+        return () => { current = false; };
+    }, [fetchPage, jwtToken]);
+
+    const loadMore = () => {
+        fetchPage(nextCursor)
+            .then((data) => {
+                setMovies((loaded) => [...loaded, ...(data.data ?? [])]);
+                setNextCursor(data.meta?.next_cursor ?? "");
+            })
+            .catch(err => {
+                console.log(err);
+            })
+    };
+
+    return { movies, total, hasMore: nextCursor !== "", loadMore };
+}
+
+export default useMoviePages;
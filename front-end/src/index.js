@@ -4,6 +4,7 @@ import { createBrowserRouter, createRoutesFromElements, Route, RouterProvider }
 import App from './App';
 import EditMovie from './components/EditMovie';
 import ErrorPage from './components/ErrorPage';
+import ForgotPassword from './components/ForgotPassword';
 import Genres from './components/Genres';
 import GraphQL from './components/GraphQL';
 import Home from './components/Home';
@@ -12,6 +13,8 @@ import ManageCatalogue from './components/ManageCatalogue';
 import Movies from './components/Movies';
 import Movie from './components/Movie';
 import OneGenre from './components/OneGenre';
+import ResetPassword from './components/ResetPassword';
+import MagicLink from './components/MagicLink';
 
 // const router = createBrowserRouter([
 //   {
@@ -64,6 +67,9 @@ const router = createBrowserRouter(
       <Route path='manage-catalogue' element={<ManageCatalogue />}></Route>
       <Route path='/graphql' element={<GraphQL />}></Route>
       <Route path='/login' element={<Login />}></Route>'
+      <Route path='/forgot-password' element={<ForgotPassword />}></Route>
+      <Route path='/reset-password' element={<ResetPassword />}></Route>
+      <Route path='/magic-link' element={<MagicLink />}></Route>
       <Route path='/genres/:id' element={<OneGenre />}></Route>
     </Route>
   )